@@ -0,0 +1,209 @@
+package mynat
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ek-170/myroute/pkg/logger"
+)
+
+const (
+	defaultTraceMaxHops = 16
+)
+
+// AddressSpace is a kind of address block an IP address belongs to
+type AddressSpace string
+
+const (
+	SpacePublic    AddressSpace = "public"
+	SpacePrivate   AddressSpace = "private (RFC 1918)"
+	SpaceShared    AddressSpace = "shared (RFC 6598, CGN)"
+	SpaceLoopback  AddressSpace = "loopback"
+	SpaceLinkLocal AddressSpace = "link-local"
+	SpaceOther     AddressSpace = "special purpose"
+)
+
+var (
+	// RFC 1918
+	privateBlocks = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16")
+	// RFC 6598
+	sharedBlock = mustParseCIDRs("100.64.0.0/10")[0]
+	// other blocks which never appear as public address
+	specialBlocks = mustParseCIDRs("0.0.0.0/8", "192.0.0.0/24", "192.0.2.0/24", "198.18.0.0/15",
+		"198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4", "2001:db8::/32")
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// ClassifyAddress returns the address space ip belongs to
+func ClassifyAddress(ip net.IP) AddressSpace {
+	switch {
+	case ip.IsLoopback():
+		return SpaceLoopback
+	case ip.IsLinkLocalUnicast():
+		return SpaceLinkLocal
+	case sharedBlock.Contains(ip):
+		return SpaceShared
+	}
+	for _, n := range privateBlocks {
+		if n.Contains(ip) {
+			return SpacePrivate
+		}
+	}
+	for _, n := range specialBlocks {
+		if n.Contains(ip) {
+			return SpaceOther
+		}
+	}
+	return SpacePublic
+}
+
+// realmOf returns the address block ip belongs to, or "" for public address.
+// each non-public block behind the host is assumed to be a separate address realm.
+func realmOf(ip net.IP) string {
+	if sharedBlock.Contains(ip) {
+		return sharedBlock.String()
+	}
+	for _, n := range privateBlocks {
+		if n.Contains(ip) {
+			return n.String()
+		}
+	}
+	for _, n := range specialBlocks {
+		if n.Contains(ip) {
+			return n.String()
+		}
+	}
+	return ""
+}
+
+// Hop is a router which answered TTL-limited probe
+type Hop struct {
+	TTL  int
+	Addr net.IP // nil if no router answered
+}
+
+func (h Hop) String() string {
+	if h.Addr == nil {
+		return fmt.Sprintf("%2d  *", h.TTL)
+	}
+	return fmt.Sprintf("%2d  %-15s %s", h.TTL, h.Addr, ClassifyAddress(h.Addr))
+}
+
+// CGNResult is a result of Carrier-grade NAT and multiple NAT detection
+type CGNResult struct {
+	Local  net.IP
+	Mapped net.IP
+	// Hops are routers on the path to STUN server, empty if the trace is unavailable
+	Hops []Hop
+	// Reached reports whether the STUN server answered within max hops
+	Reached bool
+}
+
+// CGN reports whether Carrier-grade NAT is detected, that is, shared address
+// space of RFC 6598 is used by the host, the mapping, or a router on the path
+func (r CGNResult) CGN() bool {
+	if sharedBlock.Contains(r.Local) || (r.Mapped != nil && sharedBlock.Contains(r.Mapped)) {
+		return true
+	}
+	for _, h := range r.Hops {
+		if h.Addr != nil && sharedBlock.Contains(h.Addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Layers estimates the number of translation layers between the host and the
+// STUN server, by counting non-public address realms traversed before the
+// first public router. ISP may use private addresses on routers without NAT,
+// so this is only an estimation.
+func (r CGNResult) Layers() int {
+	if r.Mapped != nil && r.Local.Equal(r.Mapped) {
+		return 0
+	}
+	var realms []string
+	add := func(ip net.IP) bool {
+		realm := realmOf(ip)
+		if realm == "" {
+			return false
+		}
+		if len(realms) == 0 || realms[len(realms)-1] != realm {
+			realms = append(realms, realm)
+		}
+		return true
+	}
+	add(r.Local)
+	for _, h := range r.Hops {
+		if h.Addr == nil {
+			continue
+		}
+		if !add(h.Addr) {
+			break
+		}
+	}
+	// public local address can still be translated, the mapping differs from it
+	return max(len(realms), 1)
+}
+
+func (r CGNResult) String() string {
+	var b strings.Builder
+	if r.CGN() {
+		b.WriteString("detected")
+	} else {
+		b.WriteString("not detected")
+	}
+	if len(r.Hops) == 0 && !r.Reached {
+		fmt.Fprintf(&b, ", translation layers: at least %d (path was not traced)", r.Layers())
+		return b.String()
+	}
+	fmt.Fprintf(&b, ", translation layers: %d (estimated)", r.Layers())
+	if r.Layers() > 1 {
+		b.WriteString(", double NAT")
+	}
+	return b.String()
+}
+
+// Detail returns address spaces and traced routers as lines
+func (r CGNResult) Detail() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "  local  %-15s %s\n", r.Local, ClassifyAddress(r.Local))
+	if r.Mapped != nil {
+		fmt.Fprintf(&b, "  mapped %-15s %s\n", r.Mapped, ClassifyAddress(r.Mapped))
+	}
+	for _, h := range r.Hops {
+		fmt.Fprintf(&b, "  %s\n", h)
+	}
+	if len(r.Hops) > 0 && !r.Reached {
+		b.WriteString("  STUN server was not reached\n")
+	}
+	return b.String()
+}
+
+// diagnoseCGN classifies local and mapped address, and traces routers to server
+func diagnoseCGN(lip net.IP, mapped net.IP, server stunServer) CGNResult {
+	result := CGNResult{Local: lip, Mapped: mapped}
+	if lip.To4() == nil {
+		logger.Debug("TTL-limited probe is only implemented for IPv4")
+		return result
+	}
+	hops, reached, err := traceHops(lip, server.addr, defaultTraceMaxHops)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("TTL-limited probe was skipped: %s", err))
+		return result
+	}
+	result.Hops = hops
+	result.Reached = reached
+	return result
+}
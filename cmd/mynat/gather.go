@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	mynat "github.com/ek-170/myroute"
+	"github.com/ek-170/myroute/pkg/ice"
+)
+
+// runGather gathers ICE candidates and prints them as SDP lines
+func runGather(args []string) {
+	fs := flag.NewFlagSet("gather", flag.ExitOnError)
+	var (
+		targetIface = fs.String("i", "", "target network interface (default every interface)")
+		servers     = fs.String("s", "", "comma separated STUN server urls (default Google public STUN server)")
+		turnServer  = fs.String("turn", "", "TURN server url to allocate relayed candidate on")
+		username    = fs.String("u", "", "username of long-term credential for TURN")
+		password    = fs.String("p", "", "password of long-term credential for TURN")
+		timeout     = fs.Duration("timeout", 2*time.Second, "timeout of each STUN and TURN transaction")
+		verbose     = fs.Bool("v", false, "verbose")
+	)
+	fs.Parse(args)
+
+	if err := initLogger(*verbose); err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	opts := []ice.GatherOption{ice.WithGatherTimeout(*timeout)}
+	if *servers != "" {
+		opts = append(opts, ice.WithSTUNServers(strings.Split(*servers, ",")...))
+	}
+	if *turnServer != "" {
+		opts = append(opts, ice.WithTURNServer(*turnServer, *username, *password))
+	}
+	g, candidates, err := mynat.GatherCandidates(*targetIface, opts...)
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+	defer g.Close()
+
+	fmt.Println("--- Candidates ---")
+	for _, c := range candidates {
+		fmt.Println(c.SDP())
+	}
+	fmt.Printf("\n")
+	fmt.Println("--- Hints ---")
+	for _, h := range mynat.CandidateHints(candidates) {
+		fmt.Printf("- %s\n", h)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	mynat "github.com/ek-170/myroute"
+	"github.com/ek-170/myroute/pkg/ice"
+)
+
+// runICE acts as an ICE agent, which checks connectivity with the peer
+// whose description is read from a file or stdin
+func runICE(args []string) {
+	fs := flag.NewFlagSet("ice", flag.ExitOnError)
+	var (
+		targetIface = fs.String("i", "", "target network interface (default every interface)")
+		servers     = fs.String("s", "", "comma separated STUN server urls (default Google public STUN server)")
+		turnServer  = fs.String("turn", "", "TURN server url to allocate relayed candidate on")
+		username    = fs.String("u", "", "username of long-term credential for TURN")
+		password    = fs.String("p", "", "password of long-term credential for TURN")
+		remote      = fs.String("remote", "-", `file of remote description, "-" reads stdin`)
+		controlling = fs.Bool("controlling", false, "start as controlling agent")
+		ufrag       = fs.String("ufrag", "", "local ice-ufrag (default random)")
+		pwd         = fs.String("pwd", "", "local ice-pwd (default random)")
+		timeout     = fs.Duration("timeout", 10*time.Second, "how long to keep checking")
+		verbose     = fs.Bool("v", false, "verbose")
+	)
+	fs.Parse(args)
+
+	if err := initLogger(*verbose); err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	opts := []ice.GatherOption{}
+	if *servers != "" {
+		opts = append(opts, ice.WithSTUNServers(strings.Split(*servers, ",")...))
+	}
+	if *turnServer != "" {
+		opts = append(opts, ice.WithTURNServer(*turnServer, *username, *password))
+	}
+	g, candidates, err := mynat.GatherCandidates(*targetIface, opts...)
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+	defer g.Close()
+
+	local := ice.NewCredentials()
+	if *ufrag != "" {
+		local.Ufrag = *ufrag
+	}
+	if *pwd != "" {
+		local.Pwd = *pwd
+	}
+	fmt.Println("--- Local Description ---")
+	fmt.Print(ice.Description{Credentials: local, Candidates: candidates})
+	fmt.Println("a=end-of-candidates")
+	fmt.Printf("\n")
+
+	var r io.Reader = os.Stdin
+	if *remote != "-" {
+		f, err := os.Open(*remote)
+		if err != nil {
+			fmt.Printf("error has occured: %s", err)
+			return
+		}
+		defer f.Close()
+		r = f
+	} else {
+		fmt.Println("paste remote description, end with a=end-of-candidates")
+	}
+	desc, err := ice.ParseDescription(r)
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	agent := ice.NewAgent(g, local, ice.WithControlling(*controlling), ice.WithCheckTimeout(*timeout))
+	result, err := agent.Check(desc)
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+	fmt.Println("--- Pairs ---")
+	fmt.Print(result.Detail())
+	fmt.Printf("\n")
+	fmt.Println("--- Results ---")
+	role := "controlled"
+	if result.Controlling {
+		role = "controlling"
+	}
+	fmt.Printf("Role: %s (%d role conflicts)\n", role, result.RoleConflicts)
+	fmt.Printf("Connectivity Check: %s\n", result)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	mynat "github.com/ek-170/myroute"
+)
+
+// runLifetime measures NAT binding lifetime with RFC 5780 STUN server
+func runLifetime(args []string) {
+	fs := flag.NewFlagSet("lifetime", flag.ExitOnError)
+	var (
+		server      = fs.String("s", "", "STUN server url. RESPONSE-PORT Attribute must be implemented in server")
+		targetIface = fs.String("i", "", "target network interface of inspection (default interface of default route)")
+		initial     = fs.Duration("initial", 15*time.Second, "first idle interval to probe")
+		maxIdle     = fs.Duration("max", 20*time.Minute, "longest idle interval to probe")
+		resolution  = fs.Duration("resolution", 5*time.Second, "accuracy of measured lifetime")
+		verbose     = fs.Bool("v", false, "verbose")
+	)
+	fs.Parse(args)
+
+	if *server == "" {
+		fmt.Println("STUN server is not specified.")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := initLogger(*verbose); err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	fmt.Println("measuring NAT binding lifetime, this may take a long time.")
+	fmt.Printf("\n")
+	res, err := mynat.MeasureBindingLifetime(*targetIface, *server,
+		mynat.WithLifetimeInitial(*initial),
+		mynat.WithLifetimeMax(*maxIdle),
+		mynat.WithLifetimeResolution(*resolution),
+	)
+	if errors.Is(err, mynat.ErrInvalidLifetimeRange) {
+		fmt.Printf("%s.\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+	fmt.Println("--- Results ---")
+	fmt.Printf("NAT Binding Lifetime: %s\n", res)
+}
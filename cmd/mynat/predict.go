@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	mynat "github.com/ek-170/myroute"
+)
+
+// runPredict predicts the next external port of symmetric NAT
+func runPredict(args []string) {
+	fs := flag.NewFlagSet("predict", flag.ExitOnError)
+	var (
+		targetIface = fs.String("i", "", "target network interface of inspection (default interface of default route)")
+		samples     = fs.Int("n", 20, "number of local sockets to map")
+		verbose     = fs.Bool("v", false, "verbose")
+	)
+	fs.Parse(args)
+
+	if err := initLogger(*verbose); err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	alloc, prediction, err := mynat.PredictPorts(*targetIface, *samples)
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+	fmt.Println("--- Probes ---")
+	fmt.Print(alloc.Detail())
+	fmt.Printf("\n")
+	fmt.Println("--- Results ---")
+	fmt.Printf("NAT Port Allocation: %s\n", alloc)
+	fmt.Printf("NAT Port Prediction: %s\n", prediction)
+	fmt.Printf("Candidates: %v\n", prediction.Candidates(10))
+	fmt.Printf("Suggested Traversal: %s\n", prediction.Recommendation())
+}
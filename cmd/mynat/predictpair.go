@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	mynat "github.com/ek-170/myroute"
+)
+
+// runPredictPair predicts connectivity between two hosts from their
+// diagnosis results written with -json
+func runPredictPair(args []string) {
+	fs := flag.NewFlagSet("predict-pair", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mynat predict-pair a.json b.json")
+		fmt.Fprintln(fs.Output(), "each file is the output of mynat -json on either host,")
+		fmt.Fprintln(fs.Output(), `"Filtering" may be filled by hand when known, it is assumed to be APDF otherwise.`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	a, err := loadDiagnosis(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+	b, err := loadDiagnosis(fs.Arg(1))
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	p := mynat.PredictPair(a, b)
+	fmt.Println("--- Peers ---")
+	fmt.Printf("A: %s (%s)\n", a.Mapping, fs.Arg(0))
+	fmt.Printf("B: %s (%s)\n", b.Mapping, fs.Arg(1))
+	fmt.Printf("\n")
+	fmt.Println("--- Reasons ---")
+	fmt.Print(p.Detail())
+	fmt.Printf("\n")
+	fmt.Println("--- Results ---")
+	fmt.Printf("Connectivity: %s\n", p)
+	fmt.Printf("Relay Required: %t\n", p.RelayRequired)
+}
+
+// loadDiagnosis reads a result of mynat -json, a single result of -all -json is also accepted
+func loadDiagnosis(path string) (*mynat.DiagnosisResult, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	res := &mynat.DiagnosisResult{}
+	if err := json.Unmarshal(b, res); err != nil {
+		results := []*mynat.DiagnosisResult{}
+		if err := json.Unmarshal(b, &results); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(results) != 1 {
+			return nil, fmt.Errorf("%s has %d results, keep only the one to predict with", path, len(results))
+		}
+		res = results[0]
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("%s: diagnosis failed: %s", path, res.Error)
+	}
+	return res, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	mynat "github.com/ek-170/myroute"
+)
+
+// runPunch tries UDP hole punching with another instance through rendezvous server
+func runPunch(args []string) {
+	hostname, _ := os.Hostname()
+	fs := flag.NewFlagSet("punch", flag.ExitOnError)
+	var (
+		peer        = fs.String("peer", "", "id of the peer to punch with")
+		id          = fs.String("id", hostname, "id of this host registered with rendezvous server")
+		server      = fs.String("r", "", "rendezvous server url, e.g. http://example.com:8080")
+		session     = fs.String("session", "", "rendezvous session id (default derived from both ids)")
+		stunServer  = fs.String("s", "", "STUN server url to learn server reflexive candidate (default public STUN server)")
+		targetIface = fs.String("i", "", "target network interface of inspection (default interface of default route)")
+		localPort   = fs.Int("p", 0, "local port to punch from (default chosen by OS)")
+		timeout     = fs.Duration("timeout", 10*time.Second, "how long to keep punching")
+		verbose     = fs.Bool("v", false, "verbose")
+	)
+	fs.Parse(args)
+
+	if *peer == "" || *server == "" {
+		fmt.Println("peer id and rendezvous server must be specified.")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := initLogger(*verbose); err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	fmt.Printf("waiting for %s to register as %s ...\n", *peer, *id)
+	res, err := mynat.Punch(*targetIface, *server, *id, *peer,
+		mynat.WithPunchLocalPort(*localPort),
+		mynat.WithSession(*session),
+		mynat.WithPunchSTUNServer(*stunServer),
+		mynat.WithPunchTimeout(*timeout),
+	)
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+	fmt.Println("--- Probes ---")
+	fmt.Print(res.Detail())
+	fmt.Printf("\n")
+	fmt.Println("--- Results ---")
+	fmt.Printf("UDP Hole Punching: %s\n", res)
+}
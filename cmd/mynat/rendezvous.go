@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+
+	"github.com/ek-170/myroute/pkg/rendezvous"
+)
+
+// runRendezvous serves rendezvous sessions for peer tests
+func runRendezvous(args []string) {
+	fs := flag.NewFlagSet("rendezvous", flag.ExitOnError)
+	var (
+		listen      = fs.String("l", ":8080", "address to listen on")
+		ttl         = fs.Duration("ttl", rendezvous.DefaultSessionTTL, "how long a session lives since the last registration")
+		delay       = fs.Duration("delay", rendezvous.DefaultPunchDelay, "how long after both peers joined they start punching")
+		maxSessions = fs.Int("max", rendezvous.DefaultMaxSessions, "how many sessions can live at the same time")
+		verbose     = fs.Bool("v", false, "verbose")
+	)
+	fs.Parse(args)
+
+	if err := initLogger(*verbose); err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	s := rendezvous.NewServer(rendezvous.WithSessionTTL(*ttl), rendezvous.WithPunchDelay(*delay), rendezvous.WithMaxSessions(*maxSessions))
+	fmt.Printf("rendezvous server listening on %s\n", *listen)
+	if err := http.ListenAndServe(*listen, s); err != nil {
+		fmt.Printf("error has occured: %s", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ek-170/myroute/pkg/turn"
+)
+
+// runServer serves STUN, and TURN if any user is given, for local relay testing
+func runServer(args []string) {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	var (
+		listen  = fs.String("l", ":3478", "address to listen on")
+		realm   = fs.String("realm", turn.DefaultRealm, "realm of long-term credential")
+		users   = fs.String("users", "", "comma separated user:password list, TURN is enabled if given")
+		relayIP = fs.String("relay-ip", "", "address to allocate relayed addresses on (default listening address)")
+		verbose = fs.Bool("v", false, "verbose")
+	)
+	fs.Parse(args)
+
+	if err := initLogger(*verbose); err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	opts := []turn.ServerOption{turn.WithRealm(*realm)}
+	if *users != "" {
+		for _, u := range strings.Split(*users, ",") {
+			name, password, ok := strings.Cut(u, ":")
+			if !ok {
+				fmt.Printf("invalid user, must be user:password: %s", u)
+				return
+			}
+			opts = append(opts, turn.WithUser(name, password))
+		}
+	}
+	if *relayIP != "" {
+		ip := net.ParseIP(*relayIP)
+		if ip == nil {
+			fmt.Printf("invalid relay address: %s", *relayIP)
+			return
+		}
+		opts = append(opts, turn.WithRelayIP(ip))
+	}
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+	s := turn.NewServer(conn, opts...)
+	if s.TURNEnabled() {
+		fmt.Printf("STUN/TURN server listening on %s, realm %q\n", s.Addr(), *realm)
+	} else {
+		fmt.Printf("STUN server listening on %s, TURN is disabled without -users\n", s.Addr())
+	}
+	if err := s.Serve(); err != nil {
+		fmt.Printf("error has occured: %s", err)
+	}
+}
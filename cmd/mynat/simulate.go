@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	mynat "github.com/ek-170/myroute"
+	"github.com/ek-170/myroute/pkg/natsim"
+)
+
+// runSimulate runs diagnosis against simulated NAT profiles,
+// and exits with 1 if any result differs from the profile
+func runSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	var (
+		profile = fs.String("profile", "", "comma separated NAT profiles to simulate (default every profile)")
+		list    = fs.Bool("list", false, "list NAT profiles")
+		verbose = fs.Bool("v", false, "verbose")
+	)
+	fs.Parse(args)
+
+	if *list {
+		for _, p := range natsim.Profiles() {
+			fmt.Printf("%-22s mapping %-4s filtering %-4s ports %-10s hairpin %-5t arbitrary pooling %-5t binding timeout %s\n",
+				p.Name, p.Mapping, p.Filtering, p.PortAllocation, p.Hairpin, p.ArbitraryPooling, p.BindingTimeout)
+		}
+		return
+	}
+
+	if err := initLogger(*verbose); err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	profiles := natsim.Profiles()
+	if *profile != "" {
+		profiles = nil
+		for _, name := range strings.Split(*profile, ",") {
+			p, err := natsim.Profile(strings.TrimSpace(name))
+			if err != nil {
+				fmt.Printf("error has occured: %s", err)
+				os.Exit(1)
+			}
+			profiles = append(profiles, p)
+		}
+	}
+
+	fmt.Printf("simulating %d NAT profiles, this takes a while ...\n\n", len(profiles))
+	cases := mynat.Simulate(profiles)
+
+	failed := 0
+	fmt.Println("--- Results ---")
+	for _, c := range cases {
+		fmt.Println(c)
+		if c.Err != nil || !c.Pass {
+			failed++
+		}
+	}
+	fmt.Printf("\n%d cases, %d failed\n", len(cases), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	mynat "github.com/ek-170/myroute"
+)
+
+// runTURN verifies TURN server end-to-end and measures relay round trip time
+func runTURN(args []string) {
+	fs := flag.NewFlagSet("turn", flag.ExitOnError)
+	var (
+		server      = fs.String("s", "", "TURN server url, e.g. turn:example.com:3478")
+		username    = fs.String("u", "", "username of long-term credential")
+		password    = fs.String("p", "", "password of long-term credential")
+		targetIface = fs.String("i", "", "target network interface of inspection (default interface of default route)")
+		pings       = fs.Int("n", 5, "number of round trips to measure for each relay method")
+		verbose     = fs.Bool("v", false, "verbose")
+	)
+	fs.Parse(args)
+
+	if *server == "" {
+		fmt.Println("TURN server is not specified.")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := initLogger(*verbose); err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+
+	res, err := mynat.MeasureRelay(*targetIface, *server, *username, *password, mynat.WithRelayPings(*pings))
+	if err != nil {
+		fmt.Printf("error has occured: %s", err)
+		return
+	}
+	fmt.Println("--- Probes ---")
+	fmt.Print(res.Detail())
+	fmt.Printf("\n")
+	fmt.Println("--- Results ---")
+	fmt.Printf("TURN Relay: %s\n", res)
+}
@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"strconv"
+	"sync"
 
 	"github.com/ek-170/myroute/pkg/logger"
 	"github.com/ek-170/myroute/pkg/stun"
+	"github.com/ek-170/myroute/pkg/transport"
 )
 
 // TODO for CHANGE-REQUEST implemented STUN server
@@ -55,114 +59,564 @@ import (
 // }
 
 // default STUN server candidates
-// "stun.l.google.com:19302",
-// "stun1.l.google.com:19302",
-// "stun2.l.google.com:19302",
-// "stun3.l.google.com:19302",
-// "stun4.l.google.com:19302",
-// "global.stun.twilio.com:3478",
-const (
-	defaultX = "stun.l.google.com:19302"
-	defaultY = "stun1.l.google.com:19302"
-)
+// servers are tried in order, and the first two which resolve to
+// distinct IP addresses are used for the mapping test
+var defaultServers = []string{
+	"stun.l.google.com:19302",
+	"stun1.l.google.com:19302",
+	"stun2.l.google.com:19302",
+	"stun3.l.google.com:19302",
+	"stun4.l.google.com:19302",
+	"global.stun.twilio.com:3478",
+}
+
+// ports public STUN servers commonly listen on,
+// used to vary only the destination port for Test III
+var alternatePorts = []int{3478, 19302, 19305}
 
 var (
 	ErrRequest4STUNServer = errors.New("fialed to request for STUN server")
+	ErrNoDistinctServers  = errors.New("could not find two STUN servers with distinct IP addresses")
+	errNoAlternatePort    = errors.New("no alternate port of STUN server responded")
 )
 
-// DiagnoseWithPublicSTUN diagnose NAT with Google/Twillio public STUN server
-// this only EIM NAT or other can be determined, and can not know fileter type
-func DiagnoseWithPublicSTUN(targetIface string) error {
-	// TODO add support ipv6
-	ip4, _, err := GetIPFromIface(targetIface)
-	if err != nil {
-		return err
+// stunServer is a STUN server whose host name has been resolved once,
+// so that every probe is sent to exactly the same remote address
+type stunServer struct {
+	name string
+	url  url.URL
+	addr *net.UDPAddr
+}
+
+// MappingProbe records a single Binding request of the mapping test
+type MappingProbe struct {
+	Server string       // server name as specified
+	Local  *net.UDPAddr // local address the request was sent from
+	Remote *net.UDPAddr // remote address the request was actually sent to
+	Mapped *net.UDPAddr // server reflexive address in XOR-MAPPED-ADDRESS
+}
+
+func (p MappingProbe) String() string {
+	return fmt.Sprintf("%s -> %s (%s) -> mapped %s", p.Local, p.Remote, p.Server, p.Mapped)
+}
+
+type diagnoseConfig struct {
+	lport     int
+	gateway   net.IP
+	pcpServer net.IP
+	servers   []string
+	transport transport.Transport
+	// filtering is the transport of filtering test sender, bound to filteringIP
+	filtering   transport.Transport
+	filteringIP net.IP
+	// filteringPort is the transport of the sender on the IP address of server X
+	filteringPort transport.Transport
+}
+
+type DiagnoseOption func(c *diagnoseConfig)
+
+// WithLocalPort binds the socket of probes to port
+func WithLocalPort(port int) DiagnoseOption {
+	return func(c *diagnoseConfig) {
+		c.lport = port
 	}
+}
 
-	if len(ip4) == 0 {
-		return errors.New("not found ipv4 in spcefied interface")
+// WithGateway specifies the gateway for port mapping protocol tests,
+// the gateway of default route is used if not specified
+func WithGateway(gateway net.IP) DiagnoseOption {
+	return func(c *diagnoseConfig) {
+		c.gateway = gateway
 	}
-	logger.Info(fmt.Sprintf("using local ip: %s", ip4[0].String()))
+}
+
+// WithPCPServer queries server with PCP instead of gateway
+func WithPCPServer(server net.IP) DiagnoseOption {
+	return func(c *diagnoseConfig) {
+		c.pcpServer = server
+	}
+}
 
-	// STUN Bind-Request for Google Public STUN 1
-	urlX, err := stun.ParseSTUNURL(defaultX)
+// WithSTUNServers replaces the default public STUN servers probes are sent to,
+// at least two of them must have distinct IP addresses
+func WithSTUNServers(servers ...string) DiagnoseOption {
+	return func(c *diagnoseConfig) {
+		c.servers = servers
+	}
+}
+
+// WithTransport opens every probe socket with t, e.g. on a simulated network or
+// through a proxy, so that the NAT behavior on the path of t is diagnosed.
+// CGN and gateway tests, which need the host network stack, are skipped.
+func WithTransport(t transport.Transport) DiagnoseOption {
+	return func(c *diagnoseConfig) {
+		c.transport = t
+	}
+}
+
+// WithFilteringProbe runs filtering test, in which a socket of t bound to ip sends
+// to the mapping of probes from an address they have never sent to. it is useful only
+// if t reaches the NAT from outside, e.g. the host network stack when probes are
+// relayed by a proxy. lip of Diagnose is used if ip is nil.
+func WithFilteringProbe(t transport.Transport, ip net.IP) DiagnoseOption {
+	return func(c *diagnoseConfig) {
+		c.filtering = t
+		c.filteringIP = ip
+	}
+}
+
+// WithFilteringPortProbe tells ADF from APDF after filtering test of WithFilteringProbe,
+// by sending to the mapping of probes from the IP address of the first STUN server
+// on another port. t must be able to bind the address of the server, e.g. the
+// simulated network, or the host network stack on the STUN server host.
+func WithFilteringPortProbe(t transport.Transport) DiagnoseOption {
+	return func(c *diagnoseConfig) {
+		c.filteringPort = t
+	}
+}
+
+// clientOptions returns options common to every probe socket
+func (c diagnoseConfig) clientOptions() []stun.ClientOption {
+	return []stun.ClientOption{stun.WithTransport(c.transport)}
+}
+
+// MappingType is NAT mapping behavior of RFC 4787 Section 4.1
+type MappingType string
+
+const (
+	MappingNone      MappingType = "No NAT"
+	MappingEIM       MappingType = "Endpoint-Independent Mapping(EIM)"
+	MappingADM       MappingType = "Address-Dependent Mapping(ADM)"
+	MappingAPDM      MappingType = "Address and Port-Dependent Mapping(APDM)"
+	MappingADMOrAPDM MappingType = "Address-Dependent Mapping(ADM) or Address and Port-Dependent Mapping(APDM)"
+)
+
+// FilteringType is NAT filtering behavior of RFC 4787 Section 5.
+// it can not be determined without CHANGE-REQUEST, but may be given by hand
+// in JSON of DiagnosisResult for pair prediction. filtering test of
+// WithFilteringProbe tells EIF from the others, and WithFilteringPortProbe
+// tells ADF from APDF.
+type FilteringType string
+
+const (
+	FilteringUnknown   FilteringType = ""
+	FilteringEIF       FilteringType = "Endpoint-Independent Filtering(EIF)"
+	FilteringADF       FilteringType = "Address-Dependent Filtering(ADF)"
+	FilteringAPDF      FilteringType = "Address and Port-Dependent Filtering(APDF)"
+	FilteringADFOrAPDF FilteringType = "Address-Dependent Filtering(ADF) or Address and Port-Dependent Filtering(APDF)"
+)
+
+// DiagnosisResult is a result of diagnosis from one local address.
+// tests other than mapping are nil when there is no NAT.
+type DiagnosisResult struct {
+	Iface string
+	Local *net.UDPAddr
+	// Reason explains why Local was chosen for diagnosis
+	Reason    string
+	Mapping   MappingType
+	Filtering FilteringType
+	// Probes are Test I, II and III of mapping test in order
+	Probes         []MappingProbe
+	Hairpin        *HairpinResult
+	Pooling        *PoolingResult
+	PortAllocation *PortAllocation
+	// PortPrediction is only estimated for APDM
+	PortPrediction *PortPrediction
+	CGN            *CGNResult
+	Gateway        *GatewayResult
+	// Err is set when diagnosis failed in --all mode
+	Err error `json:"-"`
+	// Error is the message of Err, which is kept in JSON so that
+	// a failed result is not taken for an empty successful one
+	Error string `json:",omitempty"`
+}
+
+// DiagnoseWithPublicSTUN diagnose NAT with Google/Twillio public STUN server
+// mapping type is determined by varying destination IP and port separately,
+// but fileter type can not be known without CHANGE-REQUEST
+func DiagnoseWithPublicSTUN(targetIface string, opts ...DiagnoseOption) error {
+	res, err := DiagnoseIface(targetIface, opts...)
 	if err != nil {
 		return err
 	}
-	logger.Debug(fmt.Sprintf("target: %s:%s", urlX.Scheme, urlX.Host))
+	res.Report(os.Stdout)
+	return nil
+}
 
-	res1st, err := doSTUNRequest(*urlX, ip4[0], stun.NewMessage(stun.BindingReq))
+// DiagnoseIface runs Diagnose from the address chosen in targetIface,
+// the interface of default route is used if targetIface is empty
+func DiagnoseIface(targetIface string, opts ...DiagnoseOption) (*DiagnosisResult, error) {
+	choice, err := localIPv4(targetIface)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	res, err := Diagnose(choice.Iface, choice.Addr.IP(), opts...)
+	if err != nil {
+		return nil, err
 	}
+	res.Reason = choice.Reason
+	return res, nil
+}
 
-	xadd1st := stun.XORMappedAddress{}
-	attr, exist := res1st.Attributes.Extract(stun.AttrXorMappedAddress)
-	if !exist {
-		logger.Error("not exists XOR-MAPPED-ADDRESS")
-		return ErrRequest4STUNServer
+// Diagnose runs every test from lip of targetIface with public STUN servers.
+// all probes of mapping test are sent from one local socket.
+func Diagnose(targetIface string, lip net.IP, opts ...DiagnoseOption) (*DiagnosisResult, error) {
+	c := diagnoseConfig{servers: defaultServers}
+	for _, o := range opts {
+		o(&c)
 	}
-	if err := xadd1st.Parse(attr, res1st.TransactionID); err != nil {
-		return err
+	network := udpNetwork(lip)
+	clientOpts := c.clientOptions()
+
+	x, y, err := selectServers(c.servers, network)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := stun.NewPacketClient(lip, append(clientOpts, stun.WithLocalPort(c.lport))...)
+	if err != nil {
+		return nil, err
 	}
+	defer client.Close()
+	logger.Info(fmt.Sprintf("using local address: %s", client.LocalAddr()))
+	result := &DiagnosisResult{Iface: targetIface, Local: client.LocalAddr()}
 
-	fmt.Printf("public Address seen from %s is %s:%d\n\n", defaultX, xadd1st.Address, xadd1st.Port)
+	// Test I: Binding-Request for server X
+	probe1st, err := probeMapping(client, x)
+	if err != nil {
+		return nil, err
+	}
+	result.Probes = append(result.Probes, probe1st)
 
 	// check whether server reflexive ip equals private ip
-	contained := containIP(ip4, xadd1st.Address)
-	if contained {
-		fmt.Println("There is no NAT")
-		return nil
+	if isLocalIP(probe1st.Mapped.IP) || probe1st.Mapped.IP.Equal(lip) {
+		result.Mapping = MappingNone
+		return result, nil
 	}
 
-	// STUN Bind-Request for Google Public STUN 2
-	urlY, err := stun.ParseSTUNURL(defaultY)
+	// Test II: Binding-Request for server Y
+	// only the destination IP differs from Test I, the port is kept if possible
+	probe2nd, err := probeMapping(client, y)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	logger.Debug(fmt.Sprintf("target: %s:%s", urlY.Scheme, urlY.Host))
-	res2nd, err := doSTUNRequest(*urlY, ip4[0], stun.NewMessage(stun.BindingReq))
-	if err != nil {
-		return err
+	result.Probes = append(result.Probes, probe2nd)
+
+	// Test III: Binding-Request for server Y on another port
+	// only the destination port differs from Test II
+	switch {
+	case sameAddr(probe1st.Mapped, probe2nd.Mapped):
+		result.Mapping = MappingEIM
+	default:
+		result.Mapping = MappingADMOrAPDM
+		probe3rd, err := probeAlternatePort(client, y)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Test III was skipped: %s", err))
+			break
+		}
+		result.Probes = append(result.Probes, probe3rd)
+		if sameAddr(probe2nd.Mapped, probe3rd.Mapped) {
+			result.Mapping = MappingADM
+		} else {
+			result.Mapping = MappingAPDM
+		}
 	}
 
-	xadd2nd := stun.XORMappedAddress{}
-	attr, exist = res2nd.Attributes.Extract(stun.AttrXorMappedAddress)
-	if !exist {
-		logger.Error("not exists XOR-MAPPED-ADDRESS")
-		return ErrRequest4STUNServer
+	// hairpinning test: a second socket sends to the mapping of Test I
+	// tests below are skipped on failure, the mapping result is still worth reporting
+	if hairpin, err := diagnoseHairpin(client, probe1st.Mapped, x, clientOpts...); err != nil {
+		logger.Warn(fmt.Sprintf("hairpinning test was skipped: %s", err))
+	} else {
+		result.Hairpin = &hairpin
 	}
-	if err := xadd2nd.Parse(attr, res2nd.TransactionID); err != nil {
-		return err
+
+	// filtering test: a socket outside the path sends to the mapping of Test I
+	if c.filtering != nil {
+		ip := c.filteringIP
+		if ip == nil {
+			ip = lip
+		}
+		if filtering, err := diagnoseFiltering(client, probe1st.Mapped, ip, stun.WithTransport(c.filtering)); err != nil {
+			logger.Warn(fmt.Sprintf("filtering test was skipped: %s", err))
+		} else {
+			result.Filtering = filtering
+		}
+	}
+	if c.filteringPort != nil && result.Filtering == FilteringADFOrAPDF {
+		if filtering, err := diagnoseFilteringPort(client, probe1st.Mapped, x.addr.IP, stun.WithTransport(c.filteringPort)); err != nil {
+			logger.Warn(fmt.Sprintf("filtering test from another port was skipped: %s", err))
+		} else {
+			result.Filtering = filtering
+		}
 	}
 
-	fmt.Printf("public Address seen from %s is %s:%d\n\n", defaultX, xadd2nd.Address, xadd2nd.Port)
+	// port allocation test: many sockets are mapped in sequence
+	if alloc, err := probePortAllocation(lip, x, defaultPortSamples, clientOpts...); err != nil {
+		logger.Warn(fmt.Sprintf("port allocation test was skipped: %s", err))
+	} else {
+		result.PortAllocation = &alloc
+	}
+	if result.PortAllocation != nil && result.Mapping == MappingAPDM {
+		// external port of the next session must be guessed for hole punching
+		if prediction, err := PredictNextPort(result.PortAllocation.Ports()); err == nil {
+			result.PortPrediction = &prediction
+		}
+	}
 
-	fmt.Println("--- Results ---")
-	if xadd1st.Address.Equal(xadd2nd.Address) && xadd1st.Port == xadd2nd.Port {
-		fmt.Println("NAT Mapping Type: Endpoint-Independent Mapping(EIM)")
-		fmt.Println("NAT Filtering Type: could not determine")
+	// IP pooling test: several sockets are mapped by several servers
+	if pooling, err := probePooling(lip, distinctServers(c.servers, network, defaultPoolingServers), defaultPoolingSockets, clientOpts...); err != nil {
+		logger.Warn(fmt.Sprintf("IP pooling test was skipped: %s", err))
 	} else {
-		fmt.Println("NAT Mapping Type: Address-Dependent Mapping(ADM) or Address and Port-Dependent Mapping(APDM)")
-		fmt.Println("NAT Filtering Type: could not determine")
+		result.Pooling = &pooling
 	}
-	return nil
+
+	if c.transport != nil {
+		// traceroute and port mapping protocols are not available
+		// on sockets other than the host network stack
+		return result, nil
+	}
+
+	// CGN test: address spaces of local, mapped and routers on the path
+	cgn := diagnoseCGN(lip, probe1st.Mapped.IP, x)
+	result.CGN = &cgn
+
+	// gateway test: external address reported by gateway is compared with mapping
+	if c.gateway == nil && network == "udp4" {
+		c.gateway = defaultGateway(targetIface)
+	}
+	if c.pcpServer == nil {
+		c.pcpServer = c.gateway
+	}
+	gateway := diagnoseGateway(c.gateway, c.pcpServer, client.LocalAddr(), probe1st.Mapped.IP)
+	result.Gateway = &gateway
+
+	return result, nil
 }
 
-func doSTUNRequest(url url.URL, lip net.IP, req *stun.Message) (*stun.Message, error) {
-	client, err := stun.NewClient(url, lip)
+// DiagnoseAll runs Diagnose concurrently from every address of every
+// interface which is up and not loopback. link-local addresses are skipped.
+func DiagnoseAll(opts ...DiagnoseOption) ([]*DiagnosisResult, error) {
+	ifaces, err := Interfaces()
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := client.Do(req)
+	var results []*DiagnosisResult
+	for _, iface := range ifaces {
+		if !iface.Usable() {
+			continue
+		}
+		for _, choice := range iface.DiagnosableAddrs(false) {
+			results = append(results, &DiagnosisResult{
+				Iface:  iface.Name,
+				Local:  &net.UDPAddr{IP: choice.Addr.IP()},
+				Reason: choice.Reason,
+			})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, r := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := Diagnose(r.Iface, r.Local.IP, opts...)
+			if err != nil {
+				r.Err = err
+				r.Error = err.Error()
+				return
+			}
+			res.Reason = r.Reason
+			results[i] = res
+		}()
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func udpNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// isLocalIP reports whether ip is assigned to any interface of this host
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		return nil, err
+		return false
 	}
-	if err := client.Close(); err != nil {
-		return nil, err
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
 	}
-	return res, nil
+	return false
+}
+
+// probeAlternatePort sends Binding-Request to the same IP as server
+// on the alternate ports, and returns the first mapping answered
+func probeAlternatePort(client *stun.PacketClient, server stunServer) (MappingProbe, error) {
+	for _, port := range alternatePorts {
+		if port == server.addr.Port {
+			continue
+		}
+		addr := &net.UDPAddr{IP: server.addr.IP, Port: port}
+		alt := stunServer{
+			name: fmt.Sprintf("%s:%d", server.url.Hostname(), port),
+			url:  url.URL{Scheme: server.url.Scheme, Host: addr.String()},
+			addr: addr,
+		}
+		if u, err := stun.ParseSTUNURL(server.name); err == nil {
+			// show host name as specified instead of resolved IP
+			alt.name = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+		}
+		p, err := probeMapping(client, alt)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("%s did not respond: %s", alt.name, err))
+			continue
+		}
+		return p, nil
+	}
+	return MappingProbe{}, errNoAlternatePort
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// localIPv4 chooses ipv4 address of targetIface to send probes from.
+// the interface of default route is used if targetIface is empty.
+func localIPv4(targetIface string) (AddrChoice, error) {
+	targetIface, err := resolveIface(targetIface)
+	if err != nil {
+		return AddrChoice{}, err
+	}
+	iface, err := InterfaceByName(targetIface)
+	if err != nil {
+		return AddrChoice{}, err
+	}
+	// TODO add support ipv6
+	choice, err := iface.ChooseAddr(4)
+	if err != nil {
+		return AddrChoice{}, err
+	}
+	logger.Info(fmt.Sprintf("using local ip: %s (%s)", choice.Addr.Addr(), choice.Reason))
+	return choice, nil
+}
+
+// defaultGateway returns the gateway of default route if it goes through targetIface
+func defaultGateway(targetIface string) net.IP {
+	r, err := DefaultRoute()
+	if err != nil {
+		logger.Warn(err.Error())
+		return nil
+	}
+	if targetIface != "" && r.Iface != targetIface {
+		logger.Warn(fmt.Sprintf("default route is not through %s, gateway is unknown", targetIface))
+		return nil
+	}
+	logger.Info(fmt.Sprintf("using gateway of default route: %s", r.Gateway))
+	return r.Gateway
+}
+
+// selectServers resolves candidates in order, and returns the first server
+// and another one which has a different IP address.
+// a server listening on the same port as the first one is preferred,
+// so that only the destination IP address varies between the probes.
+func selectServers(candidates []string, network string) (x, y stunServer, err error) {
+	resolved := make([]stunServer, 0, len(candidates))
+	for _, c := range candidates {
+		s, err := resolveServer(c, network)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("skip STUN server %s: %s", c, err))
+			continue
+		}
+		logger.Debug(fmt.Sprintf("resolved STUN server %s: %s", c, s.addr))
+		resolved = append(resolved, s)
+	}
+	if len(resolved) < 2 {
+		return stunServer{}, stunServer{}, ErrNoDistinctServers
+	}
+
+	x = resolved[0]
+	var fallback *stunServer
+	for i := 1; i < len(resolved); i++ {
+		s := resolved[i]
+		if s.addr.IP.Equal(x.addr.IP) {
+			logger.Warn(fmt.Sprintf("%s and %s resolve to the same IP %s", x.name, s.name, s.addr.IP))
+			continue
+		}
+		if s.addr.Port == x.addr.Port {
+			return x, s, nil
+		}
+		if fallback == nil {
+			fallback = &resolved[i]
+		}
+	}
+	if fallback == nil {
+		return stunServer{}, stunServer{}, ErrNoDistinctServers
+	}
+	logger.Warn(fmt.Sprintf("no server on port %d with distinct IP, use %s", x.addr.Port, fallback.name))
+	return x, *fallback, nil
+}
+
+// firstServer returns the first candidate which can be resolved
+func firstServer(candidates []string, network string) (stunServer, error) {
+	for _, c := range candidates {
+		s, err := resolveServer(c, network)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("skip STUN server %s: %s", c, err))
+			continue
+		}
+		return s, nil
+	}
+	return stunServer{}, ErrRequest4STUNServer
+}
+
+// resolveServer resolves server for network, "udp4" or "udp6"
+func resolveServer(server, network string) (stunServer, error) {
+	u, err := stun.ParseSTUNURL(server)
+	if err != nil {
+		return stunServer{}, err
+	}
+	addr, err := net.ResolveUDPAddr(network, u.Host)
+	if err != nil {
+		return stunServer{}, err
+	}
+	return stunServer{
+		name: server,
+		// fix the destination to the resolved address,
+		// DNS may return another address on next lookup
+		url:  url.URL{Scheme: u.Scheme, Host: addr.String()},
+		addr: addr,
+	}, nil
+}
+
+// probeMapping sends Binding-Request to server, and returns the mapping seen by it
+func probeMapping(client *stun.PacketClient, server stunServer) (MappingProbe, error) {
+	logger.Debug(fmt.Sprintf("target: %s:%s (%s)", server.url.Scheme, server.url.Host, server.name))
+	res, _, err := client.Do(stun.NewMessage(stun.BindingReq), server.addr)
+	if err != nil {
+		return MappingProbe{}, err
+	}
+
+	xadd := stun.XORMappedAddress{}
+	attr, exist := res.Attributes.Extract(stun.AttrXorMappedAddress)
+	if !exist {
+		logger.Error("not exists XOR-MAPPED-ADDRESS")
+		return MappingProbe{}, ErrRequest4STUNServer
+	}
+	if err := xadd.Parse(attr, res.TransactionID); err != nil {
+		return MappingProbe{}, err
+	}
+	return MappingProbe{
+		Server: server.name,
+		Local:  client.LocalAddr(),
+		Remote: server.addr,
+		Mapped: &net.UDPAddr{IP: xadd.Address, Port: int(xadd.Port)},
+	}, nil
 }
 
 func containIP(comparator []net.IP, target net.IP) bool {
@@ -0,0 +1,53 @@
+package mynat
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/stun"
+)
+
+// diagnoseFiltering sends Binding-Request from a socket bound to ip to mapped, which
+// is the public mapping of receiver. receiver has never sent to the socket, so the
+// request passes only EIF. ADF and APDF can not be told apart, since that needs
+// a sender on the IP address of a server receiver has sent to.
+func diagnoseFiltering(receiver *stun.PacketClient, mapped *net.UDPAddr, ip net.IP, opts ...stun.ClientOption) (FilteringType, error) {
+	sender, err := stun.NewPacketClient(ip, opts...)
+	if err != nil {
+		return FilteringUnknown, err
+	}
+	defer sender.Close()
+
+	logger.Debug(fmt.Sprintf("send unsolicited request %s -> %s", sender.LocalAddr(), mapped))
+	from, err := sendUnsolicited(sender, receiver, mapped)
+	if err != nil {
+		return FilteringUnknown, err
+	}
+	if from == nil {
+		return FilteringADFOrAPDF, nil
+	}
+	logger.Debug(fmt.Sprintf("unsolicited request arrived from %s", from))
+	return FilteringEIF, nil
+}
+
+// diagnoseFilteringPort sends Binding-Request to mapped from serverIP, which
+// receiver has sent to, on another port than the server. the request passes ADF
+// but not APDF, so it tells them apart once EIF is ruled out.
+func diagnoseFilteringPort(receiver *stun.PacketClient, mapped *net.UDPAddr, serverIP net.IP, opts ...stun.ClientOption) (FilteringType, error) {
+	sender, err := stun.NewPacketClient(serverIP, opts...)
+	if err != nil {
+		return FilteringUnknown, err
+	}
+	defer sender.Close()
+
+	logger.Debug(fmt.Sprintf("send request from another port %s -> %s", sender.LocalAddr(), mapped))
+	from, err := sendUnsolicited(sender, receiver, mapped)
+	if err != nil {
+		return FilteringUnknown, err
+	}
+	if from == nil {
+		return FilteringAPDF, nil
+	}
+	return FilteringADF, nil
+}
@@ -0,0 +1,238 @@
+package mynat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/natpmp"
+	"github.com/ek-170/myroute/pkg/pcp"
+	"github.com/ek-170/myroute/pkg/upnp"
+)
+
+const (
+	gatewayTestMappingLifetime = 60 * time.Second
+	upnpDiscoverTimeout        = 3 * time.Second
+)
+
+var (
+	errGatewayNotSpecified = errors.New("gateway is not specified")
+	errIPv4Only            = errors.New("only IPv4 is supported")
+)
+
+// GatewayResult is a result of querying the default gateway with
+// port mapping protocols, and comparing with the STUN mapping
+type GatewayResult struct {
+	Gateway net.IP
+	Mapped  net.IP
+
+	// NATPMPExternal is the external address reported by NAT-PMP, nil if unavailable
+	NATPMPExternal net.IP
+	// NATPMPMapping is the mapping created for test, nil if failed
+	NATPMPMapping *natpmp.Mapping
+	NATPMPErr     error `json:"-"`
+
+	// PCPServer is the server queried with PCP, the gateway unless specified
+	PCPServer net.IP
+	// PCPMapping is the mapping created by PCP MAP for test, nil if failed
+	PCPMapping *pcp.Mapping
+	PCPErr     error `json:"-"`
+
+	// UPnPDevice is the name of Internet Gateway Device discovered
+	UPnPDevice string
+	// UPnPExternal is the external address reported by IGD, nil if unavailable
+	UPnPExternal net.IP
+	// UPnPMapping reports whether AddPortMapping succeeded
+	UPnPMapping bool
+	// UPnPPermanent reports whether the gateway accepted only a permanent lease
+	UPnPPermanent  bool
+	UPnPErr        error `json:"-"`
+	UPnPMappingErr error `json:"-"`
+}
+
+// UpstreamNAT reports whether there is another NAT above the gateway,
+// that is, the external address of the gateway differs from the STUN mapping
+func (r GatewayResult) UpstreamNAT() bool {
+	if r.Mapped == nil {
+		return false
+	}
+	if r.NATPMPExternal != nil && !r.NATPMPExternal.Equal(r.Mapped) {
+		return true
+	}
+	if r.UPnPExternal != nil && !r.UPnPExternal.Equal(r.Mapped) {
+		return true
+	}
+	return r.PCPMapping != nil && !r.PCPMapping.ExternalIP.Equal(r.Mapped)
+}
+
+// ExplicitMapping reports whether any port mapping protocol could create a mapping
+func (r GatewayResult) ExplicitMapping() bool {
+	return r.NATPMPMapping != nil || r.PCPMapping != nil || r.UPnPMapping
+}
+
+// Detail returns the result of each protocol as lines. results are branched on
+// what is present, since errors are lost in JSON and may be missing.
+func (r GatewayResult) Detail() string {
+	var b strings.Builder
+	if r.NATPMPExternal != nil {
+		fmt.Fprintf(&b, "  NAT-PMP : external address %s (%s), %s\n",
+			r.NATPMPExternal, ClassifyAddress(r.NATPMPExternal), mappingSupport(r.NATPMPMapping != nil))
+	} else {
+		fmt.Fprintf(&b, "  NAT-PMP : %s\n", unavailable(r.NATPMPErr))
+	}
+	if r.PCPMapping != nil {
+		fmt.Fprintf(&b, "  PCP     : server %s, external %s:%d for %s, %s\n",
+			r.PCPServer, r.PCPMapping.ExternalIP, r.PCPMapping.ExternalPort, r.PCPMapping.Lifetime, mappingSupport(true))
+	} else {
+		fmt.Fprintf(&b, "  PCP     : %s\n", unavailable(r.PCPErr))
+	}
+	if r.UPnPExternal != nil {
+		support := mappingSupport(r.UPnPMapping)
+		switch {
+		case r.UPnPPermanent:
+			support += " (permanent lease only)"
+		case r.UPnPMappingErr != nil:
+			support += fmt.Sprintf(" (%s)", r.UPnPMappingErr)
+		}
+		fmt.Fprintf(&b, "  UPnP IGD: %q, external address %s (%s), %s\n",
+			r.UPnPDevice, r.UPnPExternal, ClassifyAddress(r.UPnPExternal), support)
+	} else {
+		fmt.Fprintf(&b, "  UPnP IGD: %s\n", unavailable(r.UPnPErr))
+	}
+	return b.String()
+}
+
+func unavailable(err error) string {
+	if err == nil {
+		return "not available"
+	}
+	return fmt.Sprintf("not available (%s)", err)
+}
+
+func mappingSupport(ok bool) string {
+	if ok {
+		return "mapping creation supported"
+	}
+	return "mapping creation refused"
+}
+
+func (r GatewayResult) String() string {
+	var b strings.Builder
+	if r.ExplicitMapping() {
+		b.WriteString("explicit port mapping available")
+	} else {
+		b.WriteString("explicit port mapping not available")
+	}
+	if r.UpstreamNAT() {
+		fmt.Fprintf(&b, ", gateway external address differs from STUN mapping %s: additional NAT upstream", r.Mapped)
+	}
+	return b.String()
+}
+
+// diagnoseGateway asks gateway for its external address, creates and deletes
+// a test mapping for lport with NAT-PMP, PCP and UPnP IGD, and compares the
+// external address with mapped. pcpServer may differ from gateway, e.g. CGN.
+// NAT-PMP and PCP are skipped if gateway is nil, UPnP IGD is discovered by multicast.
+func diagnoseGateway(gateway, pcpServer net.IP, laddr *net.UDPAddr, mapped net.IP) GatewayResult {
+	result := GatewayResult{Gateway: gateway, Mapped: mapped, PCPServer: pcpServer}
+	if gateway == nil {
+		result.NATPMPErr = errGatewayNotSpecified
+	} else {
+		diagnoseNATPMP(&result, gateway, laddr.Port)
+	}
+	if pcpServer == nil {
+		result.PCPErr = errGatewayNotSpecified
+	} else {
+		result.PCPMapping, result.PCPErr = diagnosePCP(pcpServer, laddr.Port)
+	}
+	if laddr.IP.To4() == nil {
+		result.UPnPErr = errIPv4Only
+	} else {
+		diagnoseUPnP(&result, laddr)
+	}
+	return result
+}
+
+func diagnoseNATPMP(result *GatewayResult, gateway net.IP, lport int) {
+	pmp := natpmp.NewClient(gateway)
+	ext, err := pmp.ExternalAddress()
+	if err != nil {
+		result.NATPMPErr = err
+		return
+	}
+	result.NATPMPExternal = ext.Address
+
+	m, err := pmp.AddMapping(natpmp.UDP, uint16(lport), uint16(lport), gatewayTestMappingLifetime)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("NAT-PMP mapping request failed: %s", err))
+		return
+	}
+	result.NATPMPMapping = &m
+	logger.Debug(fmt.Sprintf("NAT-PMP mapped %s %d -> %d for %s", m.Protocol, m.InternalPort, m.ExternalPort, m.Lifetime))
+	if err := pmp.DeleteMapping(natpmp.UDP, m.InternalPort); err != nil {
+		logger.Warn(fmt.Sprintf("NAT-PMP could not delete test mapping: %s", err))
+	}
+}
+
+// diagnosePCP creates a test mapping for lport with PCP MAP, then deletes it
+func diagnosePCP(server net.IP, lport int) (*pcp.Mapping, error) {
+	c := pcp.NewClient(server)
+	m, err := c.Map(pcp.MapRequest{
+		Protocol:      pcp.UDP,
+		InternalPort:  uint16(lport),
+		SuggestedPort: uint16(lport),
+		Lifetime:      gatewayTestMappingLifetime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug(fmt.Sprintf("PCP mapped %d -> %s:%d for %s", m.InternalPort, m.ExternalIP, m.ExternalPort, m.Lifetime))
+	if err := c.Delete(m); err != nil {
+		logger.Warn(fmt.Sprintf("PCP could not delete test mapping: %s", err))
+	}
+	return &m, nil
+}
+
+// diagnoseUPnP discovers IGD, reads its external address, and tests
+// AddPortMapping and DeletePortMapping for laddr
+func diagnoseUPnP(result *GatewayResult, laddr *net.UDPAddr) {
+	clients, err := upnp.Discover(laddr.IP, upnpDiscoverTimeout)
+	if err != nil {
+		result.UPnPErr = err
+		return
+	}
+	c := clients[0]
+	result.UPnPDevice = c.FriendlyName
+	logger.Debug(fmt.Sprintf("UPnP IGD %q at %s, service %s", c.FriendlyName, c.ControlURL, c.ServiceType))
+
+	ext, err := c.GetExternalIPAddress()
+	if err != nil {
+		result.UPnPErr = err
+		return
+	}
+	result.UPnPExternal = ext
+
+	m := upnp.PortMapping{
+		ExternalPort:   uint16(laddr.Port),
+		Protocol:       "UDP",
+		InternalPort:   uint16(laddr.Port),
+		InternalClient: laddr.IP,
+		Description:    "mynat test",
+		LeaseDuration:  gatewayTestMappingLifetime,
+	}
+	lease, err := c.AddPortMappingOrPermanent(m)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("UPnP AddPortMapping failed: %s", err))
+		result.UPnPMappingErr = err
+		return
+	}
+	result.UPnPMapping = true
+	result.UPnPPermanent = lease == 0
+	// a permanent mapping stays on the gateway unless it is deleted
+	if err := c.DeletePortMapping("", m.ExternalPort, m.Protocol); err != nil {
+		logger.Warn(fmt.Sprintf("UPnP could not delete test mapping %d/%s, lease %s: %s", m.ExternalPort, m.Protocol, lease, err))
+	}
+}
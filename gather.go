@@ -0,0 +1,108 @@
+package mynat
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/ek-170/myroute/pkg/ice"
+)
+
+// GatherCandidates gathers ICE candidates on every usable address of targetIface,
+// or of every interface if it is empty. the interface of default route comes first,
+// so its addresses get higher local preference. srflx candidates are learned from
+// the first public STUN server unless ice.WithSTUNServers is given.
+// the caller must close the returned gatherer when the candidates are no longer used.
+func GatherCandidates(targetIface string, opts ...ice.GatherOption) (*ice.Gatherer, []ice.Candidate, error) {
+	bases, err := iceBases(targetIface)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts = append([]ice.GatherOption{ice.WithSTUNServers(defaultServers[0])}, opts...)
+	g := ice.NewGatherer(opts...)
+	candidates, err := g.Gather(bases)
+	if err != nil {
+		g.Close()
+		return nil, nil, err
+	}
+	return g, candidates, nil
+}
+
+// iceBases returns addresses host candidates are gathered on.
+// link-local and deprecated addresses are skipped as RFC 8445 Section 5.1.1.1 recommends.
+func iceBases(targetIface string) ([]net.IP, error) {
+	var ifaces []Interface
+	if targetIface != "" {
+		iface, err := InterfaceByName(targetIface)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = []Interface{iface}
+	} else {
+		all, err := Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range all {
+			if iface.Usable() {
+				ifaces = append(ifaces, iface)
+			}
+		}
+		sort.SliceStable(ifaces, func(i, j int) bool {
+			return ifaces[i].DefaultRoute && !ifaces[j].DefaultRoute
+		})
+	}
+
+	var bases []net.IP
+	for _, iface := range ifaces {
+		for _, choice := range iface.DiagnosableAddrs(false) {
+			if choice.Addr.Deprecated {
+				continue
+			}
+			bases = append(bases, choice.Addr.IP())
+		}
+	}
+	if len(bases) == 0 {
+		return nil, ErrNoUsableAddress
+	}
+	return bases, nil
+}
+
+// CandidateHints explains what gathered candidates imply for connectivity,
+// e.g. why ICE may end up relayed
+func CandidateHints(candidates []ice.Candidate) []string {
+	var hints []string
+	count := map[ice.CandidateType]int{}
+	// server reflexive ports seen for each base
+	mapped := map[string]map[string]bool{}
+	for _, c := range candidates {
+		count[c.Type]++
+		if c.Type == ice.CandidateServerReflexive {
+			base := c.Related.String()
+			if mapped[base] == nil {
+				mapped[base] = map[string]bool{}
+			}
+			mapped[base][c.Addr.String()] = true
+		}
+	}
+
+	if count[ice.CandidateServerReflexive] == 0 {
+		hints = append(hints, "no srflx candidate, STUN is blocked or there is no NAT, peers outside can only reach host or relay candidates")
+	}
+	bases := make([]string, 0, len(mapped))
+	for base := range mapped {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+	for _, base := range bases {
+		if n := len(mapped[base]); n > 1 {
+			hints = append(hints, fmt.Sprintf("%s is mapped to %d addresses by different servers, the NAT is not EIM and srflx candidates may not work", base, n))
+		}
+	}
+	if count[ice.CandidateRelay] == 0 {
+		hints = append(hints, "no relay candidate, connectivity fails if no direct pair succeeds")
+	} else if count[ice.CandidateServerReflexive] == 0 {
+		hints = append(hints, "relay is the only candidate reachable from outside, ICE will end up relayed against peers behind NAT")
+	}
+	return hints
+}
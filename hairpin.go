@@ -0,0 +1,135 @@
+package mynat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/stun"
+)
+
+const (
+	hairpinSendCount    = 3
+	hairpinSendInterval = 200 * time.Millisecond
+	hairpinTimeout      = 2 * time.Second
+)
+
+// HairpinResult is a result of hairpinning test
+// see RFC 4787 REQ-9 and RFC 5780 Section 4.5
+type HairpinResult struct {
+	Supported bool
+	// Sender is the local address of the sending socket
+	Sender *net.UDPAddr
+	// SenderMapped is the public mapping of the sending socket
+	SenderMapped *net.UDPAddr
+	// Source is the source address of the hairpinned packet seen by receiver
+	Source *net.UDPAddr
+}
+
+// External reports whether the hairpinned packet arrived with the external
+// source address of the sender, as RFC 4787 REQ-9 b) requires
+func (r HairpinResult) External() bool {
+	return r.Supported && r.SenderMapped != nil && sameAddr(r.Source, r.SenderMapped)
+}
+
+func (r HairpinResult) String() string {
+	switch {
+	case !r.Supported:
+		return "not supported (or filtered)"
+	case r.External():
+		return fmt.Sprintf("supported, source seen is external address %s", r.Source)
+	case r.Source.IP.Equal(r.Sender.IP) && r.Source.Port == r.Sender.Port:
+		return fmt.Sprintf("supported, source seen is internal address %s", r.Source)
+	default:
+		return fmt.Sprintf("supported, source seen is %s", r.Source)
+	}
+}
+
+// diagnoseHairpin sends Binding-Request from a second local socket to mapped,
+// which is the public mapping of receiver, and waits for the NAT to loop it back.
+// server is used to learn the public mapping of the second socket.
+func diagnoseHairpin(receiver *stun.PacketClient, mapped *net.UDPAddr, server stunServer, opts ...stun.ClientOption) (HairpinResult, error) {
+	sender, err := stun.NewPacketClient(receiver.LocalAddr().IP, opts...)
+	if err != nil {
+		return HairpinResult{}, err
+	}
+	defer sender.Close()
+
+	result := HairpinResult{Sender: sender.LocalAddr()}
+	probe, err := probeMapping(sender, server)
+	if err != nil {
+		// the test can still be done, only the source can not be classified
+		logger.Warn(fmt.Sprintf("could not learn mapping of hairpin sender: %s", err))
+	} else {
+		result.SenderMapped = probe.Mapped
+		// open the filter of receiver toward the sender, so that ADF and APDF
+		// of EIM do not hide hairpinning. the request may be hairpinned to the
+		// sender, which just ignores it.
+		if err := receiver.Send(stun.NewMessage(stun.BindingReq), probe.Mapped); err != nil {
+			return HairpinResult{}, err
+		}
+	}
+
+	logger.Debug(fmt.Sprintf("send hairpin request %s -> %s", sender.LocalAddr(), mapped))
+	from, err := sendUnsolicited(sender, receiver, mapped)
+	if err != nil {
+		return HairpinResult{}, err
+	}
+	if from != nil {
+		result.Supported = true
+		result.Source = from
+	}
+	return result, nil
+}
+
+// sendUnsolicited sends Binding-Request from sender to dest several times, and returns
+// the source address receiver saw it from, nil if none arrived until timeout
+func sendUnsolicited(sender, receiver *stun.PacketClient, dest *net.UDPAddr) (*net.UDPAddr, error) {
+	req := stun.NewMessage(stun.BindingReq)
+	received := make(chan *net.UDPAddr, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(received)
+		deadline := time.Now().Add(hairpinTimeout)
+		// wait in slices, so that the receiver stops soon when sending fails
+		for time.Now().Before(deadline) {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			msg, from, err := receiver.Receive(min(time.Until(deadline), hairpinSendInterval))
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			if err != nil {
+				logger.Warn(fmt.Sprintf("receiver of %s: %s", dest, err))
+				return
+			}
+			if msg.TransactionID != req.TransactionID {
+				continue
+			}
+			addr, ok := from.(*net.UDPAddr)
+			if !ok {
+				logger.Debug(fmt.Sprintf("ignore request from %s, which is not a UDP address", from))
+				continue
+			}
+			received <- addr
+			return
+		}
+	}()
+
+	for i := 0; i < hairpinSendCount; i++ {
+		if err := sender.Send(req, dest); err != nil {
+			// the receiver must not take packets of the next test on the same socket
+			close(done)
+			<-received
+			return nil, err
+		}
+		time.Sleep(hairpinSendInterval)
+	}
+	return <-received, nil
+}
@@ -0,0 +1,51 @@
+package mynat
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/stun"
+)
+
+func TestSendUnsolicitedStopsReceiverOnSendError(t *testing.T) {
+	loopback := net.IPv4(127, 0, 0, 1)
+	receiver, err := stun.NewPacketClient(loopback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sender, err := stun.NewPacketClient(loopback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.Close()
+
+	start := time.Now()
+	if _, err := sendUnsolicited(sender, receiver, receiver.LocalAddr()); err == nil {
+		t.Fatal("sending from a closed socket succeeded")
+	}
+	if elapsed := time.Since(start); elapsed >= hairpinTimeout {
+		t.Errorf("returned after %s", elapsed)
+	}
+
+	// the next test on the receiver gets its packet
+	other, err := stun.NewPacketClient(loopback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	req := stun.NewMessage(stun.BindingReq)
+	if err := other.Send(req, receiver.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	// nobody should be reading the socket in the meantime
+	time.Sleep(100 * time.Millisecond)
+	msg, _, err := receiver.Receive(time.Second)
+	if err != nil {
+		t.Fatalf("packet of the next test was taken: %s", err)
+	}
+	if msg.TransactionID != req.TransactionID {
+		t.Errorf("received another transaction")
+	}
+}
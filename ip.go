@@ -1,60 +1,270 @@
 package mynat
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 
 	"github.com/ek-170/myroute/pkg/logger"
 )
 
-func GetIPFromIface(targetIface string) (ip4 []net.IP, ip6 []net.IP, err error) {
-	interfaces, err := net.Interfaces()
+var (
+	ErrInterfaceNotFound = errors.New("network interface not found")
+	ErrInterfaceDown     = errors.New("network interface is down or loopback")
+	ErrNoUsableAddress   = errors.New("no usable address in network interface")
+)
+
+// AddrScope is the reachability scope of an interface address
+type AddrScope string
+
+const (
+	ScopeLoopback  AddrScope = "loopback"
+	ScopeLinkLocal AddrScope = "link-local"
+	ScopePrivate   AddrScope = "private"      // IPv4 of RFC 1918 and RFC 6598
+	ScopeULA       AddrScope = "unique local" // IPv6 of RFC 4193
+	ScopeGlobal    AddrScope = "global"
+)
+
+// InterfaceAddr is an address assigned to a network interface
+type InterfaceAddr struct {
+	Prefix netip.Prefix
+	Scope  AddrScope
+	// Temporary reports whether it is IPv6 privacy address of RFC 8981,
+	// which OS prefers for outgoing connections. only detected on Linux.
+	Temporary bool
+	// Deprecated reports whether its preferred lifetime has expired,
+	// OS does not use it as source of new connections. only detected on Linux.
+	Deprecated bool
+}
+
+// Addr returns the address with zone of iface for link-local IPv6
+func (a InterfaceAddr) Addr() netip.Addr {
+	return a.Prefix.Addr()
+}
+
+// IP returns the address as net.IP
+func (a InterfaceAddr) IP() net.IP {
+	return net.IP(a.Prefix.Addr().Unmap().AsSlice())
+}
+
+func (a InterfaceAddr) String() string {
+	s := fmt.Sprintf("%s %s", a.Prefix, a.Scope)
+	if a.Temporary {
+		s += " temporary"
+	}
+	if a.Deprecated {
+		s += " deprecated"
+	}
+	return s
+}
+
+// inet6Flags are flags of IPv6 address which net.Interface does not expose
+type inet6Flags struct {
+	temporary  bool
+	deprecated bool
+}
+
+// Interface is a network interface with its addresses
+type Interface struct {
+	Index int
+	Name  string
+	MTU   int
+	Flags net.Flags
+	Addrs []InterfaceAddr
+	// DefaultRoute reports whether the IPv4 default route goes through it
+	DefaultRoute bool
+}
+
+// Usable reports whether the interface is up and not loopback
+func (i Interface) Usable() bool {
+	return i.Flags&net.FlagUp != 0 && i.Flags&net.FlagLoopback == 0
+}
+
+// Interfaces returns every network interface of the host with rich address information
+func Interfaces() ([]Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	route, err := DefaultRoute()
 	if err != nil {
-		return nil, nil, err
+		logger.Debug(err.Error())
 	}
+	flags := inet6AddrFlags()
 
-	var addrs []net.Addr
-	for _, iface := range interfaces {
-		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
-			continue
+	result := make([]Interface, 0, len(ifaces))
+	for _, iface := range ifaces {
+		i, err := newInterface(iface, flags)
+		if err != nil {
+			return nil, err
 		}
+		i.DefaultRoute = iface.Name == route.Iface
+		result = append(result, i)
+	}
+	return result, nil
+}
 
-		if iface.Name != targetIface {
+// InterfaceByName returns the network interface named name.
+// it fails if the interface is down or loopback.
+func InterfaceByName(name string) (Interface, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return Interface{}, fmt.Errorf("%w: %s (available: %s)", ErrInterfaceNotFound, name, availableIfaces())
+	}
+	if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+		return Interface{}, fmt.Errorf("%w: %s (available: %s)", ErrInterfaceDown, name, availableIfaces())
+	}
+	i, err := newInterface(*iface, inet6AddrFlags())
+	if err != nil {
+		return Interface{}, err
+	}
+	if route, err := DefaultRoute(); err == nil {
+		i.DefaultRoute = route.Iface == name
+	}
+	return i, nil
+}
+
+func newInterface(iface net.Interface, flags map[netip.Addr]inet6Flags) (Interface, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return Interface{}, err
+	}
+	i := Interface{
+		Index: iface.Index,
+		Name:  iface.Name,
+		MTU:   iface.MTU,
+		Flags: iface.Flags,
+	}
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if !ok {
 			continue
 		}
-
-		addrs, err = iface.Addrs()
-		if err != nil {
-			return nil, nil, err
+		ip, ok := netip.AddrFromSlice(n.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		ones, _ := n.Mask.Size()
+		a := InterfaceAddr{Scope: scopeOf(ip)}
+		if a.Scope == ScopeLinkLocal && ip.Is6() {
+			// link-local IPv6 is ambiguous without zone
+			ip = ip.WithZone(iface.Name)
 		}
+		a.Prefix = netip.PrefixFrom(ip, ones)
+		if f, ok := flags[ip.WithZone("")]; ok {
+			a.Temporary = f.temporary
+			a.Deprecated = f.deprecated
+		}
+		logger.Debug(fmt.Sprintf("found address in interface %s: %s", iface.Name, a))
+		i.Addrs = append(i.Addrs, a)
 	}
+	return i, nil
+}
 
-	ip4 = []net.IP{}
-	ip6 = []net.IP{}
-	for _, addr := range addrs {
-		var ip net.IP
+func scopeOf(ip netip.Addr) AddrScope {
+	switch {
+	case ip.IsLoopback():
+		return ScopeLoopback
+	case ip.IsLinkLocalUnicast():
+		return ScopeLinkLocal
+	case ip.Is4() && (ip.IsPrivate() || sharedBlock.Contains(ip.AsSlice())):
+		return ScopePrivate
+	case ip.Is6() && ip.IsPrivate():
+		return ScopeULA
+	}
+	return ScopeGlobal
+}
 
-		switch v := addr.(type) {
-		case *net.IPNet:
-			ip = v.IP
-		case *net.IPAddr:
-			ip = v.IP
-		}
+// AddrChoice is an address chosen to be diagnosed with the reason
+type AddrChoice struct {
+	Iface  string
+	Addr   InterfaceAddr
+	Reason string
+}
 
-		if ip == nil || ip.IsLoopback() {
+// ChooseAddr returns the address of family, 4 or 6, the OS would use to reach
+// public STUN servers. link-local addresses are never chosen since they are not
+// routed beyond the link. global scope is preferred, then temporary address
+// for IPv6 as OS prefers it for outgoing connections, deprecated ones last.
+func (i Interface) ChooseAddr(family int) (AddrChoice, error) {
+	var best *InterfaceAddr
+	var skipped int
+	for n := range i.Addrs {
+		a := &i.Addrs[n]
+		if (family == 4) != a.Addr().Is4() {
 			continue
 		}
-
-		if ip.To4() != nil {
-			logger.Info(fmt.Sprintf("found ipv4 in interface %s: %s\n", targetIface, ip.String()))
-			ip4 = append(ip4, ip)
+		switch a.Scope {
+		case ScopeLoopback:
+			continue
+		case ScopeLinkLocal:
+			skipped++
 			continue
 		}
+		if best == nil || addrPreference(*a) > addrPreference(*best) {
+			best = a
+		}
+	}
+	if best == nil {
+		if skipped > 0 {
+			return AddrChoice{}, fmt.Errorf("%w: IPv%d of %s is only link-local", ErrNoUsableAddress, family, i.Name)
+		}
+		return AddrChoice{}, fmt.Errorf("%w: no IPv%d in %s", ErrNoUsableAddress, family, i.Name)
+	}
 
-		if ip.To16() != nil {
-			logger.Info(fmt.Sprintf("found ipv6 in interface %s: %s\n", targetIface, ip.String()))
-			ip6 = append(ip6, ip)
+	reason := fmt.Sprintf("%s address of %s", best.Scope, i.Name)
+	if best.Temporary {
+		reason = "temporary " + reason + ", used by OS for outgoing connections"
+	}
+	if best.Deprecated {
+		reason += ", deprecated but no other candidate"
+	}
+	if i.DefaultRoute {
+		reason += " (default route)"
+	}
+	if skipped > 0 {
+		reason += fmt.Sprintf(", %d link-local skipped", skipped)
+	}
+	return AddrChoice{Iface: i.Name, Addr: *best, Reason: reason}, nil
+}
+
+// DiagnosableAddrs returns every address to be diagnosed in --all mode.
+// link-local addresses are skipped unless linkLocal is set, because public
+// STUN servers can not be reached from them.
+func (i Interface) DiagnosableAddrs(linkLocal bool) []AddrChoice {
+	var choices []AddrChoice
+	for _, a := range i.Addrs {
+		switch {
+		case a.Scope == ScopeLoopback:
+			continue
+		case a.Scope == ScopeLinkLocal && !linkLocal:
+			logger.Info(fmt.Sprintf("skip link-local address %s of %s, it is not routed beyond the link", a.Addr(), i.Name))
+			continue
+		}
+		reason := fmt.Sprintf("%s address of %s", a.Scope, i.Name)
+		if a.Temporary {
+			reason = "temporary " + reason
 		}
+		if a.Deprecated {
+			reason += ", deprecated and not used by OS for new connections"
+		}
+		choices = append(choices, AddrChoice{Iface: i.Name, Addr: a, Reason: reason})
+	}
+	return choices
+}
+
+func addrPreference(a InterfaceAddr) int {
+	p := 0
+	if a.Scope == ScopeGlobal {
+		p += 4
+	}
+	if a.Temporary {
+		p += 2
+	}
+	if !a.Deprecated {
+		p += 8
 	}
-	return ip4, ip6, nil
+	return p
 }
@@ -0,0 +1,53 @@
+//go:build linux
+
+package mynat
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	procIfInet6 = "/proc/net/if_inet6"
+
+	// IFA_F_* in linux/if_addr.h
+	ifaFTemporary  = 0x01
+	ifaFDeprecated = 0x20
+)
+
+// inet6AddrFlags reads flags of IPv6 addresses from /proc/net/if_inet6,
+// which net.Interface does not expose
+func inet6AddrFlags() map[netip.Addr]inet6Flags {
+	flags := map[netip.Addr]inet6Flags{}
+	f, err := os.Open(procIfInet6)
+	if err != nil {
+		return flags
+	}
+	defer f.Close()
+
+	// address ifindex prefixlen scope flags name
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		b, err := hex.DecodeString(fields[0])
+		if err != nil || len(b) != 16 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[4], 16, 32)
+		if err != nil {
+			continue
+		}
+		flags[netip.AddrFrom16([16]byte(b))] = inet6Flags{
+			temporary:  v&ifaFTemporary != 0,
+			deprecated: v&ifaFDeprecated != 0,
+		}
+	}
+	return flags
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package mynat
+
+import "net/netip"
+
+// inet6AddrFlags is only implemented for Linux,
+// temporary and deprecated addresses are not distinguished
+func inet6AddrFlags() map[netip.Addr]inet6Flags {
+	return nil
+}
@@ -0,0 +1,234 @@
+package mynat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/stun"
+	"github.com/ek-170/myroute/pkg/transport"
+)
+
+const (
+	defaultLifetimeInitial    = 15 * time.Second
+	defaultLifetimeMax        = 20 * time.Minute
+	defaultLifetimeResolution = 5 * time.Second
+
+	lifetimeSendCount   = 3
+	lifetimeWaitPerSend = time.Second
+)
+
+var (
+	ErrResponsePortNotSupported = errors.New("STUN server does not support RESPONSE-PORT")
+	errResponseNotReceived      = errors.New("response to RESPONSE-PORT was not received even without idle time")
+	ErrInvalidLifetimeRange     = errors.New("invalid range of binding lifetime measurement")
+)
+
+type lifetimeConfig struct {
+	initial    time.Duration
+	max        time.Duration
+	resolution time.Duration
+	// progress receives a line for each probe
+	progress   io.Writer
+	clientOpts []stun.ClientOption
+}
+
+// validate rejects ranges the search never finishes with
+func (c lifetimeConfig) validate() error {
+	switch {
+	case c.initial <= 0:
+		return fmt.Errorf("%w: initial interval %s must be positive", ErrInvalidLifetimeRange, c.initial)
+	case c.resolution <= 0:
+		return fmt.Errorf("%w: resolution %s must be positive", ErrInvalidLifetimeRange, c.resolution)
+	case c.max < c.initial:
+		return fmt.Errorf("%w: max interval %s is shorter than initial %s", ErrInvalidLifetimeRange, c.max, c.initial)
+	}
+	return nil
+}
+
+type LifetimeOption func(c *lifetimeConfig)
+
+// WithLifetimeInitial sets the first idle interval to probe
+func WithLifetimeInitial(d time.Duration) LifetimeOption {
+	return func(c *lifetimeConfig) {
+		c.initial = d
+	}
+}
+
+// WithLifetimeMax sets the idle interval to give up searching the expiry
+func WithLifetimeMax(d time.Duration) LifetimeOption {
+	return func(c *lifetimeConfig) {
+		c.max = d
+	}
+}
+
+// WithLifetimeResolution sets the accuracy of the measured lifetime
+func WithLifetimeResolution(d time.Duration) LifetimeOption {
+	return func(c *lifetimeConfig) {
+		c.resolution = d
+	}
+}
+
+// WithLifetimeTransport opens sockets of probes with t instead of the host network stack
+func WithLifetimeTransport(t transport.Transport) LifetimeOption {
+	return func(c *lifetimeConfig) {
+		c.clientOpts = append(c.clientOpts, stun.WithTransport(t))
+	}
+}
+
+// LifetimeResult is a result of binding lifetime measurement.
+// the binding expires somewhere between Alive and Expired.
+type LifetimeResult struct {
+	Alive   time.Duration // longest idle interval the binding survived
+	Expired time.Duration // shortest idle interval the binding expired, 0 if never expired
+}
+
+func (r LifetimeResult) String() string {
+	if r.Expired == 0 {
+		return fmt.Sprintf("binding survived %s idle, longer than measured range", r.Alive)
+	}
+	return fmt.Sprintf("binding expires between %s and %s idle", r.Alive, r.Expired)
+}
+
+// MeasureBindingLifetime measures the UDP binding lifetime of NAT
+// as RFC 5780 Section 4.6 describes.
+// server must support RESPONSE-PORT attribute of RFC 5780.
+//
+// each probe opens a fresh mapping from socket X, stays idle for an interval,
+// then sends Binding-Request with RESPONSE-PORT set to the mapped port of X
+// from socket Y. if X receives the response, the binding is still alive.
+// the interval is doubled until the binding expires, then binary searched.
+func MeasureBindingLifetime(targetIface, server string, opts ...LifetimeOption) (LifetimeResult, error) {
+	c := lifetimeConfig{
+		initial:    defaultLifetimeInitial,
+		max:        defaultLifetimeMax,
+		resolution: defaultLifetimeResolution,
+		progress:   os.Stdout,
+	}
+	for _, o := range opts {
+		o(&c)
+	}
+	if err := c.validate(); err != nil {
+		return LifetimeResult{}, err
+	}
+
+	choice, err := localIPv4(targetIface)
+	if err != nil {
+		return LifetimeResult{}, err
+	}
+	s, err := resolveServer(server, "udp4")
+	if err != nil {
+		return LifetimeResult{}, err
+	}
+	return measureBindingLifetime(choice.Addr.IP(), s, c)
+}
+
+// measureBindingLifetime searches the expiry of bindings from lip, c must be valid
+func measureBindingLifetime(lip net.IP, s stunServer, c lifetimeConfig) (LifetimeResult, error) {
+	// the binding must be alive without idle time,
+	// otherwise the server does not support RESPONSE-PORT
+	alive, err := probeBindingAlive(lip, s, 0, c)
+	if err != nil {
+		return LifetimeResult{}, err
+	}
+	if !alive {
+		return LifetimeResult{}, errResponseNotReceived
+	}
+
+	result := LifetimeResult{}
+	for t := c.initial; result.Expired == 0; t *= 2 {
+		if t > c.max {
+			return result, nil
+		}
+		alive, err := probeBindingAlive(lip, s, t, c)
+		if err != nil {
+			return LifetimeResult{}, err
+		}
+		if alive {
+			result.Alive = t
+		} else {
+			result.Expired = t
+		}
+	}
+
+	for result.Expired-result.Alive > c.resolution {
+		t := (result.Alive + result.Expired) / 2
+		alive, err := probeBindingAlive(lip, s, t, c)
+		if err != nil {
+			return LifetimeResult{}, err
+		}
+		if alive {
+			result.Alive = t
+		} else {
+			result.Expired = t
+		}
+	}
+	return result, nil
+}
+
+// probeBindingAlive reports whether a new binding is still alive after idle
+func probeBindingAlive(lip net.IP, server stunServer, idle time.Duration, c lifetimeConfig) (bool, error) {
+	x, err := stun.NewPacketClient(lip, c.clientOpts...)
+	if err != nil {
+		return false, err
+	}
+	defer x.Close()
+	y, err := stun.NewPacketClient(lip, c.clientOpts...)
+	if err != nil {
+		return false, err
+	}
+	defer y.Close()
+
+	mx, err := probeMapping(x, server)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(c.progress, "idle %s with binding %s ...\n", idle, mx.Mapped)
+	time.Sleep(idle)
+
+	req := stun.NewMessage(stun.BindingReq)
+	req.Attributes.Add(stun.AttrResponsePort, stun.ResponsePort{Port: uint16(mx.Mapped.Port)}.Encode())
+	for i := 0; i < lifetimeSendCount; i++ {
+		if err := y.Send(req, server.addr); err != nil {
+			return false, err
+		}
+		received, err := receiveTransaction(x, req.TransactionID, lifetimeWaitPerSend)
+		if err != nil {
+			return false, err
+		}
+		if received {
+			fmt.Fprintf(c.progress, "idle %s: alive\n", idle)
+			return true, nil
+		}
+	}
+
+	// the server answered to Y, RESPONSE-PORT was ignored or rejected
+	res, _, err := y.Receive(10 * time.Millisecond)
+	if err == nil && res.TransactionID == req.TransactionID {
+		logger.Debug(fmt.Sprintf("response type %04X was sent to socket Y", uint16(res.Type)))
+		return false, ErrResponsePortNotSupported
+	}
+	fmt.Fprintf(c.progress, "idle %s: expired\n", idle)
+	return false, nil
+}
+
+// receiveTransaction waits for STUN message which has tid until timeout elapses
+func receiveTransaction(c *stun.PacketClient, tid stun.TransactionID, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, _, err := c.Receive(time.Until(deadline))
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return false, nil
+			}
+			return false, err
+		}
+		if msg.TransactionID == tid {
+			return true, nil
+		}
+	}
+}
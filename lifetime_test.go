@@ -0,0 +1,27 @@
+package mynat
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMeasureBindingLifetimeInvalidRange(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []LifetimeOption
+	}{
+		{"zero initial", []LifetimeOption{WithLifetimeInitial(0)}},
+		{"negative resolution", []LifetimeOption{WithLifetimeResolution(-time.Second)}},
+		{"max shorter than initial", []LifetimeOption{WithLifetimeInitial(time.Minute), WithLifetimeMax(time.Second)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the range is rejected before any interface or server is looked up
+			_, err := MeasureBindingLifetime("no-such-interface", "stun:invalid.invalid", tt.opts...)
+			if !errors.Is(err, ErrInvalidLifetimeRange) {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
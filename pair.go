@@ -0,0 +1,202 @@
+package mynat
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Connectivity is the expected way two peers can reach each other
+type Connectivity string
+
+const (
+	ConnectivityDirect     Connectivity = "direct"
+	ConnectivityPrediction Connectivity = "direct with port prediction"
+	ConnectivityRelay      Connectivity = "relay"
+)
+
+// Initiator of PairPrediction
+const (
+	InitiatorA      = "A"
+	InitiatorB      = "B"
+	InitiatorEither = "either"
+	// InitiatorBoth means both peers must send at the same time
+	InitiatorBoth = "both"
+)
+
+// PairPrediction is expected connectivity between two peers, A and B
+type PairPrediction struct {
+	Connectivity Connectivity
+	// Initiator is which side must send first, empty if relay is required
+	Initiator     string
+	RelayRequired bool
+	// Reasons are the rules and assumptions the prediction is based on
+	Reasons []string
+}
+
+func (p PairPrediction) String() string {
+	switch {
+	case p.RelayRequired:
+		return string(p.Connectivity)
+	case p.Initiator == InitiatorBoth:
+		return fmt.Sprintf("%s, both sides send simultaneously", p.Connectivity)
+	case p.Initiator == InitiatorEither:
+		return fmt.Sprintf("%s, either side may initiate", p.Connectivity)
+	default:
+		return fmt.Sprintf("%s, %s must initiate", p.Connectivity, p.Initiator)
+	}
+}
+
+// Detail returns reasons as lines
+func (p PairPrediction) Detail() string {
+	var b strings.Builder
+	for _, r := range p.Reasons {
+		fmt.Fprintf(&b, "  - %s\n", r)
+	}
+	return b.String()
+}
+
+func (p *PairPrediction) reason(format string, args ...any) {
+	p.Reasons = append(p.Reasons, fmt.Sprintf(format, args...))
+}
+
+// PredictPair predicts whether peers a and b can connect directly over UDP,
+// which side must send first and whether a relay is required.
+// filtering can not be diagnosed with public STUN servers, so unknown filtering
+// is assumed to be APDF, the most restrictive one, and it is stated in Reasons.
+func PredictPair(a, b *DiagnosisResult) PairPrediction {
+	p := PairPrediction{}
+	fa := p.filtering("A", a)
+	fb := p.filtering("B", b)
+
+	switch {
+	case a.Mapping == MappingNone && b.Mapping == MappingNone:
+		p.reason("neither A nor B is behind NAT")
+		p.direct(InitiatorEither)
+	case a.Mapping == MappingNone:
+		p.reason("A is not behind NAT, B opens its mapping by sending to A")
+		p.direct(InitiatorB)
+	case b.Mapping == MappingNone:
+		p.reason("B is not behind NAT, A opens its mapping by sending to B")
+		p.direct(InitiatorA)
+	case sameExternalIP(a, b):
+		p.predictHairpin(a, b)
+	case a.Mapping == MappingEIM && b.Mapping == MappingEIM:
+		p.reason("both A and B have EIM, the mapping learned by STUN is reused toward the peer")
+		p.direct(InitiatorBoth)
+	case a.Mapping == MappingEIM:
+		p.predictEIMPair("A", "B", fa, b)
+	case b.Mapping == MappingEIM:
+		p.predictEIMPair("B", "A", fb, a)
+	default:
+		p.reason("neither A nor B has EIM, the mapping toward the peer differs from the one learned by STUN")
+		pa, pb := predictable(a), predictable(b)
+		p.reason("port allocation of A is %s", predictability(pa))
+		p.reason("port allocation of B is %s", predictability(pb))
+		if pa && pb {
+			p.predicted(InitiatorBoth)
+		} else {
+			p.relay()
+		}
+	}
+	return p
+}
+
+// filtering returns filtering of r, or APDF with a stated assumption if not determined
+func (p *PairPrediction) filtering(side string, r *DiagnosisResult) FilteringType {
+	switch {
+	case r.Mapping == MappingNone:
+		return r.Filtering
+	case r.Filtering == FilteringUnknown:
+		p.reason("filtering of %s is unknown, assumed to be APDF", side)
+		return FilteringAPDF
+	case r.Filtering == FilteringADFOrAPDF:
+		p.reason("filtering of %s is ADF or APDF, assumed to be APDF", side)
+		return FilteringAPDF
+	default:
+		return r.Filtering
+	}
+}
+
+// predictEIMPair predicts when only side eim has EIM. packets of the other side
+// come from a port the EIM side has never sent to, which only EIF or ADF admits
+// unless the port is predictable.
+func (p *PairPrediction) predictEIMPair(eim, other string, filtering FilteringType, r *DiagnosisResult) {
+	p.reason("%s has EIM but %s does not, so %s can not know the mapping %s uses toward it", eim, other, eim, other)
+	switch {
+	case filtering == FilteringEIF:
+		p.reason("%s has EIF, which admits packets from any port of %s without %s sending first", eim, other, eim)
+		p.direct(other)
+	case filtering == FilteringADF:
+		p.reason("%s has ADF, which admits packets from any port of %s once %s sent to it", eim, other, eim)
+		p.reason("%s must send to the IP address of %s first to open its filter", eim, other)
+		p.direct(eim)
+	case predictable(r):
+		p.reason("%s has APDF, but port allocation of %s is predictable", eim, other)
+		p.predicted(InitiatorBoth)
+	default:
+		p.reason("%s has APDF and port allocation of %s is not predictable", eim, other)
+		p.relay()
+	}
+}
+
+// predictHairpin predicts when both peers are behind the same public IP,
+// which is likely the same NAT
+func (p *PairPrediction) predictHairpin(a, b *DiagnosisResult) {
+	p.reason("A and B share external IP %s, packets between them must be hairpinned", a.Probes[0].Mapped.IP)
+	ha, hb := a.Hairpin != nil && a.Hairpin.Supported, b.Hairpin != nil && b.Hairpin.Supported
+	if !ha || !hb {
+		p.reason("NAT of A or B does not support hairpinning, use local candidates or relay")
+		p.relay()
+		return
+	}
+	p.reason("NAT supports hairpinning")
+	if a.Mapping == MappingEIM && b.Mapping == MappingEIM {
+		p.direct(InitiatorBoth)
+		return
+	}
+	p.reason("mapping is not EIM, the hairpinned mapping can not be learned by STUN")
+	if predictable(a) && predictable(b) {
+		p.predicted(InitiatorBoth)
+	} else {
+		p.relay()
+	}
+}
+
+func (p *PairPrediction) direct(initiator string) {
+	p.Connectivity = ConnectivityDirect
+	p.Initiator = initiator
+}
+
+func (p *PairPrediction) predicted(initiator string) {
+	p.Connectivity = ConnectivityPrediction
+	p.Initiator = initiator
+}
+
+func (p *PairPrediction) relay() {
+	p.Connectivity = ConnectivityRelay
+	p.RelayRequired = true
+}
+
+// predictable reports whether the next external port of r can be guessed,
+// by port preservation, contiguous allocation or confident linear prediction
+func predictable(r *DiagnosisResult) bool {
+	if pa := r.PortAllocation; pa != nil && (pa.PortPreservation() || pa.Contiguous()) {
+		return true
+	}
+	pp := r.PortPrediction
+	return pp != nil && pp.Method == PredictLinear && pp.Confidence >= linearConfidenceThreshold
+}
+
+func predictability(ok bool) string {
+	if ok {
+		return "predictable"
+	}
+	return "not predictable (or unknown)"
+}
+
+func sameExternalIP(a, b *DiagnosisResult) bool {
+	if len(a.Probes) == 0 || len(b.Probes) == 0 || a.Probes[0].Mapped == nil || b.Probes[0].Mapped == nil {
+		return false
+	}
+	return a.Probes[0].Mapped.IP.Equal(b.Probes[0].Mapped.IP)
+}
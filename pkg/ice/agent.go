@@ -0,0 +1,659 @@
+package ice
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/stun"
+)
+
+const (
+	// defaultCheckInterval is Ta of RFC 8445 Section 14.2, pacing of checks
+	defaultCheckInterval = 50 * time.Millisecond
+	defaultCheckTimeout  = 10 * time.Second
+
+	checkRTO             = 500 * time.Millisecond
+	maxCheckAttempts     = 5
+	nominationDelay      = 500 * time.Millisecond
+	checkGracePeriod     = time.Second
+	checkReceiveInterval = 100 * time.Millisecond
+	eventQueueSize       = 64
+)
+
+var (
+	ErrNoPair = errors.New("no candidate pair to check")
+
+	errNotSTUN    = errors.New("relayed data is not STUN")
+	errNotUDPAddr = errors.New("source is not a UDP address")
+)
+
+// PairState is the state of a candidate pair of RFC 8445 Section 6.1.2.6.
+// pairs are never frozen, which only matters with multiple data streams.
+type PairState string
+
+const (
+	PairWaiting    PairState = "waiting"
+	PairInProgress PairState = "in-progress"
+	PairSucceeded  PairState = "succeeded"
+	PairFailed     PairState = "failed"
+)
+
+// Pair is a candidate pair of the check list
+type Pair struct {
+	// Local is the candidate checks are sent from, host or relay candidate.
+	// server reflexive candidates are replaced by their bases.
+	Local    Candidate
+	Remote   Candidate
+	Priority uint64
+	State    PairState
+	// Valid is set once a check on the pair succeeded
+	Valid     bool
+	Nominated bool
+	// Mapped is the address the peer saw the check from, which differs
+	// from Local if the check discovered a peer reflexive candidate
+	Mapped *net.UDPAddr
+	RTT    time.Duration
+
+	socket   *socket
+	attempts int
+	lastSent time.Time
+	// nominate makes the next check carry USE-CANDIDATE
+	nominate bool
+	// useCandidate is set when the controlling peer nominated the pair
+	useCandidate bool
+}
+
+func (p *Pair) String() string {
+	return fmt.Sprintf("%s %s -> %s %s", p.Local.Type, p.Local.Addr, p.Remote.Type, p.Remote.Addr)
+}
+
+// pairPriority computes pair priority of RFC 8445 Section 6.1.2.3
+func pairPriority(controlling bool, local, remote uint32) uint64 {
+	g, d := uint64(local), uint64(remote)
+	if !controlling {
+		g, d = d, g
+	}
+	p := 1<<32*min(g, d) + 2*max(g, d)
+	if g > d {
+		p++
+	}
+	return p
+}
+
+// CheckResult is a result of connectivity checks
+type CheckResult struct {
+	// Controlling is the role at the end, which a role conflict may have changed
+	Controlling   bool
+	RoleConflicts int
+	// Pairs are every pair checked in order of priority
+	Pairs []*Pair
+	// Selected is the nominated pair, nil if checks failed
+	Selected *Pair
+}
+
+func (r CheckResult) String() string {
+	if r.Selected != nil {
+		return fmt.Sprintf("selected %s, rtt %s", r.Selected, r.Selected.RTT.Round(time.Microsecond))
+	}
+	for _, p := range r.Pairs {
+		if p.Valid {
+			return "checks succeeded but no pair was nominated"
+		}
+	}
+	return fmt.Sprintf("failed, none of %d pairs succeeded", len(r.Pairs))
+}
+
+// Detail returns the state of every pair as lines
+func (r CheckResult) Detail() string {
+	var b strings.Builder
+	for _, p := range r.Pairs {
+		fmt.Fprintf(&b, "  %-11s %s", p.State, p)
+		if p.Valid {
+			fmt.Fprintf(&b, " rtt %s", p.RTT.Round(time.Microsecond))
+			if p.Mapped != nil && !sameAddr(p.Mapped, p.Local.Addr) {
+				fmt.Fprintf(&b, " (seen as %s)", p.Mapped)
+			}
+		}
+		if p.Nominated {
+			b.WriteString(" nominated")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+type agentOptions struct {
+	controlling bool
+	tieBreaker  uint64
+	interval    time.Duration
+	timeout     time.Duration
+}
+
+type AgentOption func(o *agentOptions)
+
+// WithControlling sets the initial role, controlled if not specified
+func WithControlling(controlling bool) AgentOption {
+	return func(o *agentOptions) {
+		o.controlling = controlling
+	}
+}
+
+// WithTieBreaker sets the tie-breaker resolving role conflict, random if not specified
+func WithTieBreaker(v uint64) AgentOption {
+	return func(o *agentOptions) {
+		o.tieBreaker = v
+	}
+}
+
+// WithCheckInterval sets the pacing of checks, Ta
+func WithCheckInterval(d time.Duration) AgentOption {
+	return func(o *agentOptions) {
+		o.interval = d
+	}
+}
+
+// WithCheckTimeout sets how long to keep checking until a pair is nominated
+func WithCheckTimeout(d time.Duration) AgentOption {
+	return func(o *agentOptions) {
+		o.timeout = d
+	}
+}
+
+// Agent is a full ICE agent of a single component which runs connectivity
+// checks from the sockets of gathered candidates. it nominates with regular
+// nomination when controlling.
+type Agent struct {
+	agentOptions
+	gatherer *Gatherer
+	local    Credentials
+
+	// the state below is only touched by the goroutine running Check
+	remote     Credentials
+	pairs      []*Pair
+	pending    map[stun.TransactionID]transaction
+	triggered  []*Pair
+	firstValid time.Time
+	nominating *Pair
+	result     CheckResult
+}
+
+type transaction struct {
+	pair        *Pair
+	sent        time.Time
+	controlling bool
+	nominate    bool
+}
+
+type event struct {
+	socket *socket
+	msg    *stun.Message
+	from   *net.UDPAddr
+}
+
+func NewAgent(g *Gatherer, local Credentials, opts ...AgentOption) *Agent {
+	o := agentOptions{
+		interval: defaultCheckInterval,
+		timeout:  defaultCheckTimeout,
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	o.tieBreaker = binary.BigEndian.Uint64(b)
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Agent{
+		agentOptions: o,
+		gatherer:     g,
+		local:        local,
+		pending:      map[stun.TransactionID]transaction{},
+	}
+}
+
+// Check pairs local candidates with candidates of remote, and sends
+// authenticated Binding-Request on every pair in order of priority while
+// answering the checks of the peer, until a pair is nominated or timeout
+// elapses. role conflicts are resolved by tie-breaker with 487 as RFC 8445
+// Section 7.3.1.1. the agent is always controlling against ICE lite peer.
+// it fails only if there is no pair to check, failed checks are reported in the result.
+func (a *Agent) Check(remote Description) (CheckResult, error) {
+	if remote.Lite && !a.controlling {
+		logger.Info("peer is ICE lite, take controlling role")
+		a.controlling = true
+	}
+	a.remote = remote.Credentials
+	a.formPairs(remote.Candidates)
+	if len(a.pairs) == 0 {
+		return CheckResult{}, ErrNoPair
+	}
+
+	events := make(chan event, eventQueueSize)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, s := range a.gatherer.sockets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.readLoop(events, done)
+		}()
+	}
+	defer wg.Wait()
+	defer close(done)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	deadline := time.Now().Add(a.timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case ev := <-events:
+			selected := a.result.Selected
+			a.handle(ev)
+			if selected == nil && a.result.Selected != nil {
+				// the peer may not have received our answers yet
+				deadline = time.Now().Add(checkGracePeriod)
+			}
+		case <-ticker.C:
+			a.tick()
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+
+	a.result.Controlling = a.controlling
+	a.result.Pairs = append([]*Pair(nil), a.pairs...)
+	return a.result, nil
+}
+
+// formPairs pairs every socket with remote candidates of the same address family
+func (a *Agent) formPairs(remote []Candidate) {
+	for _, s := range a.gatherer.sockets {
+		var permit []net.IP
+		for _, c := range remote {
+			if c.Component != s.cand.Component || (c.Addr.IP.To4() == nil) != (s.cand.Addr.IP.To4() == nil) {
+				continue
+			}
+			a.pairs = append(a.pairs, &Pair{Local: s.cand, Remote: c, State: PairWaiting, socket: s})
+			permit = append(permit, c.Addr.IP)
+		}
+		if s.relay != nil && len(permit) > 0 {
+			if err := s.relay.CreatePermission(permit...); err != nil {
+				logger.Warn(fmt.Sprintf("could not create permissions on %s: %s", s.cand.Addr, err))
+			}
+		}
+	}
+	a.prioritize()
+}
+
+// prioritize computes pair priorities for the current role and sorts the check list
+func (a *Agent) prioritize() {
+	for _, p := range a.pairs {
+		p.Priority = pairPriority(a.controlling, p.Local.Priority, p.Remote.Priority)
+	}
+	sort.SliceStable(a.pairs, func(i, j int) bool {
+		return a.pairs[i].Priority > a.pairs[j].Priority
+	})
+}
+
+func (a *Agent) switchRole() {
+	a.controlling = !a.controlling
+	a.nominating = nil
+	a.result.RoleConflicts++
+	logger.Info(fmt.Sprintf("role conflict, switched to %s", roleName(a.controlling)))
+	a.prioritize()
+}
+
+// tick sends the next check, a triggered check first, then the highest
+// priority pair waiting or due for retransmission
+func (a *Agent) tick() {
+	if a.result.Selected != nil {
+		return
+	}
+	now := time.Now()
+	for _, p := range a.pairs {
+		if p.State == PairInProgress && now.Sub(p.lastSent) >= checkRTO && p.attempts >= maxCheckAttempts {
+			logger.Debug(fmt.Sprintf("check on %s timed out", p))
+			p.State = PairFailed
+		}
+	}
+	if a.controlling {
+		a.nominate(now)
+	}
+
+	for len(a.triggered) > 0 {
+		p := a.triggered[0]
+		a.triggered = a.triggered[1:]
+		if p.State == PairWaiting {
+			a.sendCheck(p)
+			return
+		}
+	}
+	for _, p := range a.pairs {
+		if p.State == PairWaiting || (p.State == PairInProgress && now.Sub(p.lastSent) >= checkRTO) {
+			a.sendCheck(p)
+			return
+		}
+	}
+}
+
+// nominate starts a check with USE-CANDIDATE on the best valid pair,
+// once no pair of higher priority is pending or nominationDelay elapsed
+func (a *Agent) nominate(now time.Time) {
+	if a.nominating != nil || a.firstValid.IsZero() {
+		return
+	}
+	var best *Pair
+	for _, p := range a.pairs {
+		if p.Valid {
+			best = p
+			break
+		}
+		if (p.State == PairWaiting || p.State == PairInProgress) && now.Sub(a.firstValid) < nominationDelay {
+			return
+		}
+	}
+	if best == nil {
+		return
+	}
+	logger.Info(fmt.Sprintf("nominate %s", best))
+	a.nominating = best
+	best.nominate = true
+	a.retry(best)
+}
+
+// retry makes p wait for a triggered check
+func (a *Agent) retry(p *Pair) {
+	p.State = PairWaiting
+	p.attempts = 0
+	a.triggered = append(a.triggered, p)
+}
+
+func (a *Agent) sendCheck(p *Pair) {
+	req := stun.NewMessage(stun.BindingReq)
+	req.Attributes.Add(stun.AttrUsername, []byte(a.remote.Ufrag+":"+a.local.Ufrag))
+	prflx := Priority(CandidatePeerReflexive, uint16(p.Local.Priority>>8), p.Local.Component)
+	req.Attributes.Add(stun.AttrPriority, stun.Priority{Value: prflx}.Encode())
+	ctrl := stun.ICEControl{Controlling: a.controlling, TieBreaker: a.tieBreaker}
+	req.Attributes.Add(ctrl.Type(), ctrl.Encode())
+	nominate := p.nominate && a.controlling
+	if nominate {
+		req.Attributes.Add(stun.AttrUseCandidate, nil)
+	}
+	if err := a.sign(req, a.remote.Pwd); err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+
+	p.State = PairInProgress
+	p.attempts++
+	p.lastSent = time.Now()
+	a.pending[req.TransactionID] = transaction{pair: p, sent: p.lastSent, controlling: a.controlling, nominate: nominate}
+	logger.Debug(fmt.Sprintf("check %s (%d/%d)", p, p.attempts, maxCheckAttempts))
+	if err := p.socket.send(req, p.Remote.Addr); err != nil {
+		logger.Debug(fmt.Sprintf("could not send check on %s: %s", p, err))
+	}
+}
+
+func (a *Agent) handle(ev event) {
+	switch ev.msg.Type {
+	case stun.BindingReq:
+		a.handleRequest(ev)
+	case stun.BindingRes, stun.BindingErr:
+		a.handleResponse(ev)
+	}
+}
+
+// handleRequest answers a check of the peer as RFC 8445 Section 7.3,
+// and triggers a check on the same pair
+func (a *Agent) handleRequest(ev event) {
+	req := ev.msg
+	if err := req.CheckFingerprint(); errors.Is(err, stun.ErrFingerprintMismatch) {
+		logger.Debug(fmt.Sprintf("drop check from %s: %s", ev.from, err))
+		return
+	}
+	username, ok := req.Attributes.Extract(stun.AttrUsername)
+	if !ok {
+		a.reject(ev, stun.ErrorCode{Code: stun.CodeBadRequest, Reason: "USERNAME is required"})
+		return
+	}
+	if ufrag, _, _ := strings.Cut(string(username.Value), ":"); ufrag != a.local.Ufrag {
+		logger.Debug(fmt.Sprintf("check from %s is for another agent: %s", ev.from, username.Value))
+		a.reject(ev, stun.ErrorCode{Code: stun.CodeUnauthorized, Reason: "Unauthorized"})
+		return
+	}
+	if err := req.CheckIntegrity([]byte(a.local.Pwd)); err != nil {
+		logger.Debug(fmt.Sprintf("check from %s: %s", ev.from, err))
+		a.reject(ev, stun.ErrorCode{Code: stun.CodeUnauthorized, Reason: "Unauthorized"})
+		return
+	}
+
+	if ctrl, ok := req.Attributes.ExtractICEControl(); ok && ctrl.Controlling == a.controlling {
+		// the agent with the larger tie-breaker keeps controlling role
+		if a.controlling == (a.tieBreaker >= ctrl.TieBreaker) {
+			a.result.RoleConflicts++
+			a.reject(ev, stun.ErrorCode{Code: stun.CodeRoleConflict, Reason: "Role Conflict"})
+			return
+		}
+		a.switchRole()
+	}
+
+	res := stun.NewMessage(stun.BindingRes)
+	res.TransactionID = req.TransactionID
+	res.Attributes.Add(stun.AttrXorMappedAddress, stun.XORMappedAddress{Address: ev.from.IP, Port: uint16(ev.from.Port)}.Encode(res.TransactionID))
+	if err := a.sign(res, a.local.Pwd); err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	if err := ev.socket.send(res, ev.from); err != nil {
+		logger.Debug(fmt.Sprintf("could not answer check of %s: %s", ev.from, err))
+	}
+
+	p := a.pairOf(ev.socket, ev.from)
+	if p == nil {
+		p = a.addPeerReflexive(ev)
+	}
+	if _, ok := req.Attributes.Extract(stun.AttrUseCandidate); ok && !a.controlling {
+		p.useCandidate = true
+		if p.Valid && a.result.Selected == nil {
+			a.selectPair(p)
+		}
+	}
+	if p.State == PairWaiting || p.State == PairFailed {
+		a.retry(p)
+	}
+}
+
+// addPeerReflexive adds a pair with the remote peer reflexive candidate
+// a check came from, which is learned by the check of RFC 8445 Section 7.3.1.3
+func (a *Agent) addPeerReflexive(ev event) *Pair {
+	priority := stun.Priority{}
+	if attr, ok := ev.msg.Attributes.Extract(stun.AttrPriority); ok {
+		priority.Parse(attr)
+	}
+	remote := Candidate{
+		Foundation: Foundation(CandidatePeerReflexive, ev.from.IP, nil, transportUDP),
+		Component:  ev.socket.cand.Component,
+		Protocol:   transportUDP,
+		Priority:   priority.Value,
+		Addr:       ev.from,
+		Type:       CandidatePeerReflexive,
+	}
+	logger.Info(fmt.Sprintf("learned peer reflexive candidate %s", remote))
+	p := &Pair{Local: ev.socket.cand, Remote: remote, State: PairWaiting, socket: ev.socket}
+	a.pairs = append(a.pairs, p)
+	a.prioritize()
+	return p
+}
+
+// handleResponse processes the response of a check as RFC 8445 Section 7.2.5
+func (a *Agent) handleResponse(ev event) {
+	res := ev.msg
+	t, ok := a.pending[res.TransactionID]
+	if !ok {
+		return
+	}
+	if err := res.CheckIntegrity([]byte(a.remote.Pwd)); err != nil {
+		logger.Debug(fmt.Sprintf("drop response from %s: %s", ev.from, err))
+		return
+	}
+	delete(a.pending, res.TransactionID)
+	p := t.pair
+
+	if res.Type == stun.BindingErr {
+		ec := stun.ErrorCode{}
+		if attr, ok := res.Attributes.Extract(stun.AttrErrorCode); ok {
+			ec.Parse(attr)
+		}
+		if ec.Code == stun.CodeRoleConflict {
+			if a.controlling == t.controlling {
+				a.switchRole()
+			}
+			a.retry(p)
+			return
+		}
+		logger.Debug(fmt.Sprintf("check on %s failed: %s", p, ec))
+		p.State = PairFailed
+		return
+	}
+	if !sameAddr(ev.from, p.Remote.Addr) {
+		logger.Debug(fmt.Sprintf("check on %s answered from %s, not symmetric", p, ev.from))
+		p.State = PairFailed
+		return
+	}
+
+	xadd := stun.XORMappedAddress{}
+	if attr, ok := res.Attributes.Extract(stun.AttrXorMappedAddress); ok && xadd.Parse(attr, res.TransactionID) == nil {
+		p.Mapped = xadd.UDPAddr()
+	}
+	p.State = PairSucceeded
+	if !p.Valid {
+		p.Valid = true
+		p.RTT = time.Since(t.sent)
+		logger.Info(fmt.Sprintf("check succeeded on %s", p))
+	}
+	if a.firstValid.IsZero() {
+		a.firstValid = time.Now()
+	}
+	if a.result.Selected == nil && ((t.nominate && a.controlling) || (p.useCandidate && !a.controlling)) {
+		a.selectPair(p)
+	}
+}
+
+func (a *Agent) selectPair(p *Pair) {
+	p.Nominated = true
+	a.result.Selected = p
+	logger.Info(fmt.Sprintf("selected %s", p))
+}
+
+// reject answers a check with error response
+func (a *Agent) reject(ev event, ec stun.ErrorCode) {
+	res := stun.NewMessage(stun.BindingErr)
+	res.TransactionID = ev.msg.TransactionID
+	res.Attributes.Add(stun.AttrErrorCode, ec.Encode())
+	var err error
+	if ec.Code == stun.CodeUnauthorized || ec.Code == stun.CodeBadRequest {
+		// the request was not authenticated, so the response can not be
+		err = res.AddFingerprint()
+	} else {
+		err = a.sign(res, a.local.Pwd)
+	}
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	if err := ev.socket.send(res, ev.from); err != nil {
+		logger.Debug(fmt.Sprintf("could not reject check of %s: %s", ev.from, err))
+	}
+}
+
+func (a *Agent) pairOf(s *socket, remote *net.UDPAddr) *Pair {
+	for _, p := range a.pairs {
+		if p.socket == s && sameAddr(p.Remote.Addr, remote) {
+			return p
+		}
+	}
+	return nil
+}
+
+// sign adds MESSAGE-INTEGRITY of short-term credential and FINGERPRINT
+func (a *Agent) sign(msg *stun.Message, pwd string) error {
+	if err := msg.AddIntegrity([]byte(pwd)); err != nil {
+		return err
+	}
+	return msg.AddFingerprint()
+}
+
+func (s *socket) send(msg *stun.Message, to *net.UDPAddr) error {
+	if s.host != nil {
+		return s.host.Send(msg, to)
+	}
+	b, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+	return s.relay.WriteTo(b, to)
+}
+
+func (s *socket) receive(timeout time.Duration) (*stun.Message, *net.UDPAddr, error) {
+	if s.host != nil {
+		msg, from, err := s.host.Receive(timeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %s", errNotUDPAddr, from)
+		}
+		return msg, addr, nil
+	}
+	d, err := s.relay.Receive(timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := &stun.Message{}
+	if err := msg.Decode(d.Data); err != nil {
+		return nil, nil, errNotSTUN
+	}
+	return msg, d.Peer, nil
+}
+
+// readLoop delivers STUN messages received on s to events until done is closed
+func (s *socket) readLoop(events chan<- event, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		msg, from, err := s.receive(checkReceiveInterval)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, errNotSTUN) || errors.Is(err, errNotUDPAddr) {
+				continue
+			}
+			logger.Warn(fmt.Sprintf("receiver of %s: %s", s.cand.Addr, err))
+			return
+		}
+		select {
+		case events <- event{socket: s, msg: msg, from: from}:
+		case <-done:
+			return
+		}
+	}
+}
+
+func roleName(controlling bool) string {
+	if controlling {
+		return "controlling"
+	}
+	return "controlled"
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,148 @@
+// Package ice implements candidate gathering of Interactive Connectivity
+// Establishment to see which candidates a host can offer to its peer.
+// see RFC 8445 and RFC 8839
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// CandidateType is the type of candidate of RFC 8445 Section 5.1.1
+type CandidateType string
+
+const (
+	CandidateHost            CandidateType = "host"
+	CandidateServerReflexive CandidateType = "srflx"
+	CandidatePeerReflexive   CandidateType = "prflx"
+	CandidateRelay           CandidateType = "relay"
+)
+
+// Preference returns the type preference recommended by RFC 8445 Section 5.1.2.2
+func (t CandidateType) Preference() uint32 {
+	switch t {
+	case CandidateHost:
+		return 126
+	case CandidatePeerReflexive:
+		return 110
+	case CandidateServerReflexive:
+		return 100
+	default:
+		return 0
+	}
+}
+
+const (
+	// ComponentRTP is the only component mynat gathers for
+	ComponentRTP = 1
+
+	// MaxLocalPreference is local preference of the most preferred address
+	MaxLocalPreference = 65535
+
+	transportUDP = "udp"
+)
+
+var (
+	ErrInvalidCandidate = errors.New("invalid candidate attribute")
+)
+
+// Candidate is a transport address the peer may send to
+type Candidate struct {
+	Foundation string
+	Component  int
+	Protocol   string
+	Priority   uint32
+	Addr       *net.UDPAddr
+	Type       CandidateType
+	// Related is the base of srflx, and the mapped address of relay candidate.
+	// it is nil for host candidate.
+	Related *net.UDPAddr
+}
+
+// Priority computes candidate priority of RFC 8445 Section 5.1.2.1
+func Priority(typ CandidateType, localPref uint16, component int) uint32 {
+	return typ.Preference()<<24 | uint32(localPref)<<8 | uint32(256-component)
+}
+
+// Foundation returns the same value for candidates which have the same type,
+// base IP, server IP and transport as RFC 8445 Section 5.1.1.3 requires.
+// server is nil for host candidate.
+func Foundation(typ CandidateType, base, server net.IP, protocol string) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s|%s|%s|%s", typ, base, server, protocol)
+	return strconv.FormatUint(uint64(h.Sum32()), 10)
+}
+
+// String returns the value of candidate attribute of RFC 8839 Section 5.1
+func (c Candidate) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "candidate:%s %d %s %d %s %d typ %s",
+		c.Foundation, c.Component, c.Protocol, c.Priority, c.Addr.IP, c.Addr.Port, c.Type)
+	if c.Related != nil {
+		fmt.Fprintf(&b, " raddr %s rport %d", c.Related.IP, c.Related.Port)
+	}
+	return b.String()
+}
+
+// SDP returns the candidate as a line of SDP, "a=candidate:..."
+func (c Candidate) SDP() string {
+	return "a=" + c.String()
+}
+
+// ParseCandidate parses candidate attribute with or without "a=" prefix.
+// extension attributes following the related address are ignored.
+func ParseCandidate(s string) (Candidate, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "a=")
+	s, ok := strings.CutPrefix(s, "candidate:")
+	if !ok {
+		return Candidate{}, fmt.Errorf("%w: %q", ErrInvalidCandidate, s)
+	}
+	f := strings.Fields(s)
+	if len(f) < 8 || f[6] != "typ" {
+		return Candidate{}, fmt.Errorf("%w: %q", ErrInvalidCandidate, s)
+	}
+	component, err := strconv.Atoi(f[1])
+	if err != nil {
+		return Candidate{}, fmt.Errorf("%w: component %q", ErrInvalidCandidate, f[1])
+	}
+	priority, err := strconv.ParseUint(f[3], 10, 32)
+	if err != nil {
+		return Candidate{}, fmt.Errorf("%w: priority %q", ErrInvalidCandidate, f[3])
+	}
+	addr, err := parseAddr(f[4], f[5])
+	if err != nil {
+		return Candidate{}, err
+	}
+	c := Candidate{
+		Foundation: f[0],
+		Component:  component,
+		Protocol:   strings.ToLower(f[2]),
+		Priority:   uint32(priority),
+		Addr:       addr,
+		Type:       CandidateType(f[7]),
+	}
+	rest := f[8:]
+	if len(rest) >= 4 && rest[0] == "raddr" && rest[2] == "rport" {
+		if c.Related, err = parseAddr(rest[1], rest[3]); err != nil {
+			return Candidate{}, err
+		}
+	}
+	return c, nil
+}
+
+func parseAddr(host, port string) (*net.UDPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// FQDN and mDNS candidates can not be checked without resolution
+		return nil, fmt.Errorf("%w: address %q", ErrInvalidCandidate, host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, fmt.Errorf("%w: port %q", ErrInvalidCandidate, port)
+	}
+	return &net.UDPAddr{IP: ip, Port: p}, nil
+}
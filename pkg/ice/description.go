@@ -0,0 +1,110 @@
+package ice
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ek-170/myroute/pkg/logger"
+)
+
+const (
+	ufragLength = 8
+	pwdLength   = 24
+
+	// ice-char of RFC 8839 Section 5.4
+	iceChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+)
+
+var (
+	ErrNoCredentials = errors.New("ice-ufrag and ice-pwd are required")
+)
+
+// Credentials are username fragment and password of short-term credential
+// checks are authenticated with
+type Credentials struct {
+	Ufrag string
+	Pwd   string
+}
+
+// NewCredentials returns random credentials
+func NewCredentials() Credentials {
+	return Credentials{Ufrag: randomICEChars(ufragLength), Pwd: randomICEChars(pwdLength)}
+}
+
+func randomICEChars(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	for i := range b {
+		b[i] = iceChars[int(b[i])%len(iceChars)]
+	}
+	return string(b)
+}
+
+// Description is the part of SDP an ICE agent exchanges with its peer
+type Description struct {
+	Credentials
+	// Lite is set if the agent implements ICE lite, which never sends checks
+	Lite       bool
+	Candidates []Candidate
+}
+
+// String returns the description as SDP attribute lines
+func (d Description) String() string {
+	var b strings.Builder
+	if d.Lite {
+		b.WriteString("a=ice-lite\n")
+	}
+	fmt.Fprintf(&b, "a=ice-ufrag:%s\n", d.Ufrag)
+	fmt.Fprintf(&b, "a=ice-pwd:%s\n", d.Pwd)
+	for _, c := range d.Candidates {
+		fmt.Fprintln(&b, c.SDP())
+	}
+	return b.String()
+}
+
+// ParseDescription reads ICE attributes from SDP, other lines are ignored.
+// it stops at "a=end-of-candidates" or EOF, so that a description can be pasted
+// into stdin. candidates which can not be checked, e.g. mDNS or TCP, are skipped.
+func ParseDescription(r io.Reader) (Description, error) {
+	d := Description{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "a=end-of-candidates":
+			return d, d.validate()
+		case line == "a=ice-lite":
+			d.Lite = true
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			d.Ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			d.Pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=candidate:"), strings.HasPrefix(line, "candidate:"):
+			c, err := ParseCandidate(line)
+			if err != nil {
+				logger.Warn(fmt.Sprintf("skip candidate: %s", err))
+				continue
+			}
+			if c.Protocol != transportUDP {
+				logger.Debug(fmt.Sprintf("skip %s candidate %s", c.Protocol, c.Addr))
+				continue
+			}
+			d.Candidates = append(d.Candidates, c)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return d, err
+	}
+	return d, d.validate()
+}
+
+func (d Description) validate() error {
+	if d.Ufrag == "" || d.Pwd == "" {
+		return ErrNoCredentials
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/stun"
+	"github.com/ek-170/myroute/pkg/transport"
+)
+
+const (
+	defaultGatherTimeout = 2 * time.Second
+	defaultGatherRetry   = 2
+)
+
+var (
+	ErrNoCandidate = errors.New("no candidate could be gathered")
+)
+
+type turnServer struct {
+	url      string
+	username string
+	password string
+}
+
+type gatherOptions struct {
+	stunServers []string
+	turnServers []turnServer
+	timeout     time.Duration
+	transport   transport.Transport
+}
+
+type GatherOption func(o *gatherOptions)
+
+// WithSTUNServers sets STUN servers server reflexive candidates are learned from,
+// it replaces the servers given before
+func WithSTUNServers(servers ...string) GatherOption {
+	return func(o *gatherOptions) {
+		o.stunServers = servers
+	}
+}
+
+// WithTURNServer adds TURN server relayed candidates are allocated on
+func WithTURNServer(server, username, password string) GatherOption {
+	return func(o *gatherOptions) {
+		o.turnServers = append(o.turnServers, turnServer{url: server, username: username, password: password})
+	}
+}
+
+// WithGatherTimeout sets how long to wait for each STUN or TURN transaction
+func WithGatherTimeout(d time.Duration) GatherOption {
+	return func(o *gatherOptions) {
+		o.timeout = d
+	}
+}
+
+// WithGatherTransport binds sockets of candidates with t instead of the host network stack
+func WithGatherTransport(t transport.Transport) GatherOption {
+	return func(o *gatherOptions) {
+		o.transport = t
+	}
+}
+
+// Gatherer owns sockets of gathered candidates, which must be kept open
+// while the candidates are in use
+type Gatherer struct {
+	gatherOptions
+
+	mu         sync.Mutex
+	sockets    []*socket
+	candidates []Candidate
+}
+
+// socket is a local transport address checks are sent from, host socket or TURN allocation
+type socket struct {
+	cand  Candidate
+	host  *stun.PacketClient
+	relay *stun.TURNClient
+}
+
+func NewGatherer(opts ...GatherOption) *Gatherer {
+	o := gatherOptions{timeout: defaultGatherTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Gatherer{gatherOptions: o}
+}
+
+// Gather binds a socket to each of bases, and gathers host candidate,
+// server reflexive candidates of every STUN server, and relayed candidates
+// of every TURN server of the same address family on it.
+// local preference decreases in the order of bases, so the preferred address
+// should come first. failures of servers are logged and skipped, it fails only
+// if no candidate could be gathered. candidates are sorted by priority.
+func (g *Gatherer) Gather(bases []net.IP) ([]Candidate, error) {
+	for i, base := range bases {
+		localPref := uint16(max(MaxLocalPreference-i, 0))
+		g.gatherHost(base, localPref)
+		g.gatherRelay(base, localPref)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.candidates) == 0 {
+		return nil, ErrNoCandidate
+	}
+	sort.SliceStable(g.candidates, func(i, j int) bool {
+		return g.candidates[i].Priority > g.candidates[j].Priority
+	})
+	return append([]Candidate(nil), g.candidates...), nil
+}
+
+// Candidates returns candidates gathered so far
+func (g *Gatherer) Candidates() []Candidate {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]Candidate(nil), g.candidates...)
+}
+
+// Close closes every socket and deallocates relayed candidates
+func (g *Gatherer) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var errs []error
+	for _, b := range g.sockets {
+		if b.host != nil {
+			errs = append(errs, b.host.Close())
+		} else {
+			errs = append(errs, b.relay.Close())
+		}
+	}
+	g.sockets = nil
+	return errors.Join(errs...)
+}
+
+// gatherHost binds host candidate on base, and learns server reflexive
+// candidates from its socket
+func (g *Gatherer) gatherHost(base net.IP, localPref uint16) {
+	client, err := stun.NewPacketClient(base, g.clientOptions()...)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("could not bind host candidate on %s: %s", base, err))
+		return
+	}
+	host := client.LocalAddr()
+	g.add(client, nil, Candidate{
+		Foundation: Foundation(CandidateHost, base, nil, transportUDP),
+		Component:  ComponentRTP,
+		Protocol:   transportUDP,
+		Priority:   Priority(CandidateHost, localPref, ComponentRTP),
+		Addr:       host,
+		Type:       CandidateHost,
+	})
+
+	for _, s := range g.stunServers {
+		server, err := resolve(s, base)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("skip STUN server %s for %s: %s", s, base, err))
+			continue
+		}
+		res, _, err := client.Do(stun.NewMessage(stun.BindingReq), server)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("STUN server %s did not answer from %s: %s", s, host, err))
+			continue
+		}
+		xadd := stun.XORMappedAddress{}
+		attr, ok := res.Attributes.Extract(stun.AttrXorMappedAddress)
+		if !ok || xadd.Parse(attr, res.TransactionID) != nil {
+			logger.Warn(fmt.Sprintf("STUN server %s answered without valid XOR-MAPPED-ADDRESS", s))
+			continue
+		}
+		mapped := xadd.UDPAddr()
+		// a server reflexive candidate equal to its base is redundant,
+		// as RFC 8445 Section 5.1.3 eliminates
+		if mapped.IP.Equal(host.IP) && mapped.Port == host.Port {
+			logger.Debug(fmt.Sprintf("%s is not behind NAT toward %s", host, s))
+			continue
+		}
+		g.add(nil, nil, Candidate{
+			Foundation: Foundation(CandidateServerReflexive, base, server.IP, transportUDP),
+			Component:  ComponentRTP,
+			Protocol:   transportUDP,
+			Priority:   Priority(CandidateServerReflexive, localPref, ComponentRTP),
+			Addr:       mapped,
+			Type:       CandidateServerReflexive,
+			Related:    host,
+		})
+	}
+}
+
+// gatherRelay allocates relayed candidate on every TURN server from base
+func (g *Gatherer) gatherRelay(base net.IP, localPref uint16) {
+	for _, t := range g.turnServers {
+		server, err := resolve(t.url, base)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("skip TURN server %s for %s: %s", t.url, base, err))
+			continue
+		}
+		client, err := stun.NewTURNClient(server, base, t.username, t.password, g.clientOptions()...)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("could not bind socket for TURN on %s: %s", base, err))
+			continue
+		}
+		relayed, err := client.Allocate()
+		if err != nil {
+			logger.Warn(fmt.Sprintf("could not allocate on TURN server %s from %s: %s", t.url, client.LocalAddr(), err))
+			client.Close()
+			continue
+		}
+		g.add(nil, client, Candidate{
+			Foundation: Foundation(CandidateRelay, base, server.IP, transportUDP),
+			Component:  ComponentRTP,
+			Protocol:   transportUDP,
+			Priority:   Priority(CandidateRelay, localPref, ComponentRTP),
+			Addr:       relayed,
+			Type:       CandidateRelay,
+			Related:    client.MappedAddr(),
+		})
+	}
+}
+
+func (g *Gatherer) add(host *stun.PacketClient, relay *stun.TURNClient, c Candidate) {
+	logger.Info(fmt.Sprintf("gathered %s", c))
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if host != nil || relay != nil {
+		g.sockets = append(g.sockets, &socket{cand: c, host: host, relay: relay})
+	}
+	g.candidates = append(g.candidates, c)
+}
+
+func (g *Gatherer) clientOptions() []stun.ClientOption {
+	return []stun.ClientOption{stun.WithTimeout(g.timeout), stun.WithMaxRetry(defaultGatherRetry), stun.WithTransport(g.transport)}
+}
+
+// resolve resolves server in the address family of base
+func resolve(server string, base net.IP) (*net.UDPAddr, error) {
+	u, err := stun.ParseSTUNURL(server)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if base.To4() == nil {
+		network = "udp6"
+	}
+	return net.ResolveUDPAddr(network, u.Host)
+}
@@ -0,0 +1,242 @@
+// Package natpmp implements NAT Port Mapping Protocol client.
+// see RFC 6886
+package natpmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+)
+
+const (
+	// Port is the port NAT-PMP server listens on the gateway
+	Port = 5351
+
+	version = 0
+
+	opExternalAddress uint8 = 0
+	opMapUDP          uint8 = 1
+	opMapTCP          uint8 = 2
+	opResponse        uint8 = 128
+
+	defaultInitialTimeout = 250 * time.Millisecond
+	defaultMaxRetry       = 4
+)
+
+type Protocol uint8
+
+const (
+	UDP Protocol = Protocol(opMapUDP)
+	TCP Protocol = Protocol(opMapTCP)
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case UDP:
+		return "UDP"
+	case TCP:
+		return "TCP"
+	}
+	return fmt.Sprintf("Protocol(%d)", uint8(p))
+}
+
+// ResultCode is a result code of NAT-PMP response
+type ResultCode uint16
+
+const (
+	Success            ResultCode = 0
+	UnsupportedVersion ResultCode = 1
+	NotAuthorized      ResultCode = 2
+	NetworkFailure     ResultCode = 3
+	OutOfResources     ResultCode = 4
+	UnsupportedOpcode  ResultCode = 5
+)
+
+var resultCodes = map[ResultCode]string{
+	Success:            "Success",
+	UnsupportedVersion: "Unsupported Version",
+	NotAuthorized:      "Not Authorized/Refused",
+	NetworkFailure:     "Network Failure",
+	OutOfResources:     "Out of resources",
+	UnsupportedOpcode:  "Unsupported opcode",
+}
+
+func (r ResultCode) String() string {
+	if s, ok := resultCodes[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("ResultCode(%d)", uint16(r))
+}
+
+// Error is returned when gateway responds with non Success result code
+type Error struct {
+	Code ResultCode
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("NAT-PMP gateway responded: %s", e.Code)
+}
+
+var (
+	ErrNoResponse      = errors.New("no response from NAT-PMP gateway")
+	errInvalidResponse = errors.New("invalid NAT-PMP response")
+)
+
+// ExternalAddress is a response of external address request
+type ExternalAddress struct {
+	Epoch   uint32 // seconds since start of epoch of the gateway
+	Address net.IP
+}
+
+// Mapping is a response of mapping request
+type Mapping struct {
+	Epoch        uint32
+	Protocol     Protocol
+	InternalPort uint16
+	ExternalPort uint16
+	Lifetime     time.Duration
+}
+
+type Client struct {
+	gateway        *net.UDPAddr
+	initialTimeout time.Duration
+	maxRetry       uint8
+}
+
+type ClientOption func(c *Client)
+
+// WithPort changes the port of the gateway, for example to talk to a fake gateway
+func WithPort(port int) ClientOption {
+	return func(c *Client) {
+		c.gateway.Port = port
+	}
+}
+
+// WithInitialTimeout sets the first timeout, which is doubled on each retransmission
+func WithInitialTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.initialTimeout = timeout
+	}
+}
+
+func WithMaxRetry(maxRetry uint8) ClientOption {
+	return func(c *Client) {
+		c.maxRetry = maxRetry
+	}
+}
+
+func NewClient(gateway net.IP, opts ...ClientOption) *Client {
+	c := &Client{
+		gateway:        &net.UDPAddr{IP: gateway, Port: Port},
+		initialTimeout: defaultInitialTimeout,
+		maxRetry:       defaultMaxRetry,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// ExternalAddress requests the external IPv4 address of the gateway
+func (c *Client) ExternalAddress() (ExternalAddress, error) {
+	res, err := c.do([]byte{version, opExternalAddress})
+	if err != nil {
+		return ExternalAddress{}, err
+	}
+	if len(res) < 12 {
+		return ExternalAddress{}, errInvalidResponse
+	}
+	return ExternalAddress{
+		Epoch:   binary.BigEndian.Uint32(res[4:8]),
+		Address: net.IP(append([]byte(nil), res[8:12]...)),
+	}, nil
+}
+
+// AddMapping requests a mapping from external port to internalPort of this host.
+// suggested external port is a hint, gateway may assign another one.
+func (c *Client) AddMapping(proto Protocol, internalPort, suggestedPort uint16, lifetime time.Duration) (Mapping, error) {
+	//  0                   1                   2                   3
+	//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// | Vers = 0      | OP = x        | Reserved                      |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// | Internal Port                 | Suggested External Port       |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// | Requested Port Mapping Lifetime in Seconds                    |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	req := make([]byte, 12)
+	req[0] = version
+	req[1] = uint8(proto)
+	binary.BigEndian.PutUint16(req[4:6], internalPort)
+	binary.BigEndian.PutUint16(req[6:8], suggestedPort)
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+
+	res, err := c.do(req)
+	if err != nil {
+		return Mapping{}, err
+	}
+	if len(res) < 16 {
+		return Mapping{}, errInvalidResponse
+	}
+	return Mapping{
+		Epoch:        binary.BigEndian.Uint32(res[4:8]),
+		Protocol:     proto,
+		InternalPort: binary.BigEndian.Uint16(res[8:10]),
+		ExternalPort: binary.BigEndian.Uint16(res[10:12]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(res[12:16])) * time.Second,
+	}, nil
+}
+
+// DeleteMapping deletes the mapping for internalPort.
+// internalPort 0 deletes all mappings of proto for this host.
+func (c *Client) DeleteMapping(proto Protocol, internalPort uint16) error {
+	_, err := c.AddMapping(proto, internalPort, 0, 0)
+	return err
+}
+
+// do sends request to the gateway, and retransmits it with doubled timeout
+// until the response for the opcode arrives
+func (c *Client) do(req []byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, c.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	op := req[1]
+	res := make([]byte, 16)
+	timeout := c.initialTimeout
+	for attempt := 0; attempt <= int(c.maxRetry); attempt++ {
+		logger.Debug(fmt.Sprintf("NAT-PMP request op %d to %s (attempt %d)", op, c.gateway, attempt+1))
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(res)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				return nil, err
+			}
+			if n < 8 || res[0] != version || res[1] != opResponse+op {
+				logger.Debug(fmt.Sprintf("ignore unexpected NAT-PMP packet: % X", res[:n]))
+				continue
+			}
+			if code := ResultCode(binary.BigEndian.Uint16(res[2:4])); code != Success {
+				return nil, Error{Code: code}
+			}
+			return res[:n], nil
+		}
+		timeout *= 2
+	}
+	return nil, ErrNoResponse
+}
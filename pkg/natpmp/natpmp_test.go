@@ -0,0 +1,129 @@
+package natpmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeGateway answers each request with the packets handle returns,
+// and returns a client talking to it
+func fakeGateway(t *testing.T, handle func(req []byte) [][]byte) *Client {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			for _, res := range handle(append([]byte(nil), buf[:n]...)) {
+				conn.WriteToUDP(res, from)
+			}
+		}
+	}()
+	return NewClient(net.IPv4(127, 0, 0, 1),
+		WithPort(conn.LocalAddr().(*net.UDPAddr).Port),
+		WithInitialTimeout(20*time.Millisecond),
+		WithMaxRetry(1),
+	)
+}
+
+func response(op uint8, code ResultCode, body ...byte) []byte {
+	res := []byte{version, opResponse + op, 0, 0}
+	binary.BigEndian.PutUint16(res[2:4], uint16(code))
+	return append(res, body...)
+}
+
+func TestExternalAddress(t *testing.T) {
+	c := fakeGateway(t, func(req []byte) [][]byte {
+		if !bytes.Equal(req, []byte{version, opExternalAddress}) {
+			t.Errorf("request = % X", req)
+		}
+		return [][]byte{response(opExternalAddress, Success, 0, 0, 0, 42, 203, 0, 113, 7)}
+	})
+
+	ext, err := c.ExternalAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext.Epoch != 42 || !ext.Address.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Errorf("got %+v", ext)
+	}
+}
+
+func TestAddMapping(t *testing.T) {
+	c := fakeGateway(t, func(req []byte) [][]byte {
+		want := []byte{version, opMapUDP, 0, 0, 0x13, 0x88, 0x13, 0x89, 0, 0, 0, 60}
+		if !bytes.Equal(req, want) {
+			t.Errorf("request = % X, want % X", req, want)
+		}
+		return [][]byte{response(opMapUDP, Success, 0, 0, 0, 1, 0x13, 0x88, 0x9C, 0x40, 0, 0, 0, 30)}
+	})
+
+	m, err := c.AddMapping(UDP, 5000, 5001, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Mapping{Epoch: 1, Protocol: UDP, InternalPort: 5000, ExternalPort: 40000, Lifetime: 30 * time.Second}
+	if m != want {
+		t.Errorf("got %+v, want %+v", m, want)
+	}
+}
+
+func TestResultCodeError(t *testing.T) {
+	c := fakeGateway(t, func(req []byte) [][]byte {
+		// error responses have the same size as successful ones
+		return [][]byte{response(opMapTCP, NotAuthorized, make([]byte, 12)...)}
+	})
+
+	_, err := c.AddMapping(TCP, 5000, 5000, time.Minute)
+	var perr Error
+	if !errors.As(err, &perr) || perr.Code != NotAuthorized {
+		t.Errorf("got %v, want %s", err, NotAuthorized)
+	}
+}
+
+func TestIgnoreUnexpectedPacket(t *testing.T) {
+	c := fakeGateway(t, func(req []byte) [][]byte {
+		return [][]byte{
+			{version},                         // too short
+			response(opMapUDP, Success),       // another opcode
+			{1, opResponse, 0, 0, 0, 0, 0, 0}, // another version
+			response(opExternalAddress, Success, 0, 0, 0, 0, 198, 51, 100, 1),
+		}
+	})
+
+	ext, err := c.ExternalAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ext.Address.Equal(net.IPv4(198, 51, 100, 1)) {
+		t.Errorf("got %s", ext.Address)
+	}
+}
+
+func TestNoResponse(t *testing.T) {
+	var requests atomic.Int32
+	c := fakeGateway(t, func(req []byte) [][]byte {
+		requests.Add(1)
+		return nil
+	})
+
+	if _, err := c.ExternalAddress(); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("got %v, want %v", err, ErrNoResponse)
+	}
+	// the first request and one retransmission
+	if n := requests.Load(); n != 2 {
+		t.Errorf("%d requests were sent, want 2", n)
+	}
+}
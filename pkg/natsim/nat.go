@@ -0,0 +1,289 @@
+package natsim
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+)
+
+const (
+	firstAllocatedPort = 20000
+	minRandomPort      = 1024
+)
+
+// Mapping is mapping behavior of RFC 4787 Section 4.1
+type Mapping string
+
+const (
+	EIM  Mapping = "EIM"
+	ADM  Mapping = "ADM"
+	APDM Mapping = "APDM"
+)
+
+// Filtering is filtering behavior of RFC 4787 Section 5
+type Filtering string
+
+const (
+	EIF  Filtering = "EIF"
+	ADF  Filtering = "ADF"
+	APDF Filtering = "APDF"
+)
+
+// PortAllocation is port assignment behavior of RFC 4787 Section 4.2
+type PortAllocation string
+
+const (
+	// PortPreserve keeps the internal port if it is free, sequential otherwise
+	PortPreserve   PortAllocation = "preserve"
+	PortSequential PortAllocation = "sequential"
+	PortRandom     PortAllocation = "random"
+)
+
+// Config is the behavior of a simulated NAT
+type Config struct {
+	Name           string
+	Mapping        Mapping
+	Filtering      Filtering
+	PortAllocation PortAllocation
+	// PortStep is the delta of sequential allocation, 1 if 0
+	PortStep int
+	// Hairpin loops packets to external addresses of the NAT back,
+	// with the external source address as RFC 4787 REQ-9 requires
+	Hairpin bool
+	// ArbitraryPooling assigns external IPs to mappings in turn,
+	// otherwise every mapping of an internal host has the same external IP
+	ArbitraryPooling bool
+	// BindingTimeout expires mappings idle longer than it, 0 never expires.
+	// only outbound packets refresh mappings as RFC 4787 REQ-6 requires.
+	BindingTimeout time.Duration
+}
+
+// mapping is a binding between internal and external transport address
+type mapping struct {
+	key      string
+	internal *net.UDPAddr
+	external *net.UDPAddr
+	lastUsed time.Time
+	// permitted are destinations sent to, by IP and by IP:port
+	permitted map[string]bool
+}
+
+// NAT translates packets of its private realm to the public network
+type NAT struct {
+	Config
+	network     *Network
+	externalIPs []net.IP
+	private     *realm
+
+	mu       sync.Mutex
+	mappings map[string]*mapping // by key of mapping behavior
+	external map[string]*mapping // by external transport address
+	nextPort int
+	nextIP   int
+	rand     *rand.Rand
+}
+
+// AddNAT attaches a NAT of cfg with externalIPs to the network
+func (n *Network) AddNAT(cfg Config, externalIPs ...net.IP) (*NAT, error) {
+	if len(externalIPs) == 0 {
+		return nil, fmt.Errorf("natsim: NAT %s has no external IP", cfg.Name)
+	}
+	if cfg.PortStep == 0 {
+		cfg.PortStep = 1
+	}
+	nat := &NAT{
+		Config:      cfg,
+		network:     n,
+		externalIPs: externalIPs,
+		mappings:    map[string]*mapping{},
+		external:    map[string]*mapping{},
+		nextPort:    firstAllocatedPort,
+		// fixed seed keeps random allocation reproducible
+		rand: rand.New(rand.NewPCG(uint64(len(cfg.Name)), 0x6e6174)),
+	}
+	nat.private = newRealm(nat.outbound)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, ip := range externalIPs {
+		if _, ok := n.nats[ip.String()]; ok {
+			return nil, fmt.Errorf("natsim: %w: %s", ErrAddrInUse, ip)
+		}
+	}
+	for _, ip := range externalIPs {
+		n.nats[ip.String()] = nat
+	}
+	return nat, nil
+}
+
+// ExternalIPs returns external IP addresses of the NAT
+func (nat *NAT) ExternalIPs() []net.IP {
+	return nat.externalIPs
+}
+
+// ListenPacket binds a socket of an internal host to laddr,
+// a free port is chosen if the port is 0. network is ignored.
+func (nat *NAT) ListenPacket(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	c, err := nat.private.listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// outbound translates a packet from the private realm to the public network,
+// or loops it back if it is sent to an external address of the NAT
+func (nat *NAT) outbound(b []byte, from, to *net.UDPAddr) {
+	m, err := nat.mapping(from, to)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("natsim: %s: %s", nat.Name, err))
+		return
+	}
+	if nat.isExternal(to.IP) {
+		if !nat.Hairpin {
+			logger.Debug(fmt.Sprintf("natsim: %s does not hairpin %s -> %s", nat.Name, from, to))
+			return
+		}
+		nat.inbound(b, m.external, to)
+		return
+	}
+	nat.network.route(b, m.external, to)
+}
+
+// inbound delivers a packet to an external address to the internal host
+// of the mapping if filtering admits it
+func (nat *NAT) inbound(b []byte, from, to *net.UDPAddr) {
+	nat.mu.Lock()
+	m, ok := nat.external[to.String()]
+	if ok && nat.expired(m, time.Now()) {
+		nat.remove(m)
+		ok = false
+	}
+	admitted := ok && nat.admits(m, from)
+	nat.mu.Unlock()
+	if !ok {
+		logger.Debug(fmt.Sprintf("natsim: %s has no mapping %s, drop packet from %s", nat.Name, to, from))
+		return
+	}
+	if !admitted {
+		logger.Debug(fmt.Sprintf("natsim: %s filters packet %s -> %s", nat.Name, from, to))
+		return
+	}
+	nat.private.deliver(b, from, m.internal)
+}
+
+// mapping returns the mapping of an outbound packet, which is created if missing
+func (nat *NAT) mapping(from, to *net.UDPAddr) (*mapping, error) {
+	key := from.String()
+	switch nat.Mapping {
+	case ADM:
+		key += "|" + to.IP.String()
+	case APDM:
+		key += "|" + to.String()
+	}
+
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	now := time.Now()
+	m, ok := nat.mappings[key]
+	if ok && nat.expired(m, now) {
+		logger.Debug(fmt.Sprintf("natsim: %s mapping %s -> %s expired", nat.Name, m.internal, m.external))
+		nat.remove(m)
+		ok = false
+	}
+	if !ok {
+		external, err := nat.allocate(from)
+		if err != nil {
+			return nil, err
+		}
+		m = &mapping{key: key, internal: from, external: external, permitted: map[string]bool{}}
+		nat.mappings[key] = m
+		nat.external[external.String()] = m
+		logger.Debug(fmt.Sprintf("natsim: %s mapped %s -> %s for %s", nat.Name, from, external, to))
+	}
+	m.lastUsed = now
+	m.permitted[to.IP.String()] = true
+	m.permitted[to.String()] = true
+	return m, nil
+}
+
+// allocate chooses an external address for a new mapping of internal, nat.mu must be held
+func (nat *NAT) allocate(internal *net.UDPAddr) (*net.UDPAddr, error) {
+	ip := nat.externalIPs[0]
+	if nat.ArbitraryPooling {
+		ip = nat.externalIPs[nat.nextIP%len(nat.externalIPs)]
+		nat.nextIP++
+	} else if len(nat.externalIPs) > 1 {
+		// paired pooling, the same external IP for the internal host
+		sum := 0
+		for _, b := range internal.IP {
+			sum += int(b)
+		}
+		ip = nat.externalIPs[sum%len(nat.externalIPs)]
+	}
+
+	free := func(port int) bool {
+		_, used := nat.external[(&net.UDPAddr{IP: ip, Port: port}).String()]
+		return port > 0 && port <= 65535 && !used
+	}
+	switch nat.PortAllocation {
+	case PortPreserve:
+		if free(internal.Port) {
+			return &net.UDPAddr{IP: ip, Port: internal.Port}, nil
+		}
+	case PortRandom:
+		for i := 0; i < 65535; i++ {
+			port := minRandomPort + nat.rand.IntN(65535-minRandomPort+1)
+			if free(port) {
+				return &net.UDPAddr{IP: ip, Port: port}, nil
+			}
+		}
+		return nil, ErrNoFreePort
+	}
+	for i := 0; i < 65535; i++ {
+		port := nat.nextPort
+		nat.nextPort += nat.PortStep
+		if nat.nextPort > 65535 {
+			nat.nextPort = firstAllocatedPort
+		}
+		if free(port) {
+			return &net.UDPAddr{IP: ip, Port: port}, nil
+		}
+	}
+	return nil, ErrNoFreePort
+}
+
+// admits reports whether filtering passes a packet from to m, nat.mu must be held
+func (nat *NAT) admits(m *mapping, from *net.UDPAddr) bool {
+	switch nat.Filtering {
+	case EIF:
+		return true
+	case ADF:
+		return m.permitted[from.IP.String()]
+	default:
+		return m.permitted[from.String()]
+	}
+}
+
+func (nat *NAT) expired(m *mapping, now time.Time) bool {
+	return nat.BindingTimeout > 0 && now.Sub(m.lastUsed) > nat.BindingTimeout
+}
+
+// remove deletes m, nat.mu must be held
+func (nat *NAT) remove(m *mapping) {
+	delete(nat.mappings, m.key)
+	delete(nat.external, m.external.String())
+}
+
+func (nat *NAT) isExternal(ip net.IP) bool {
+	for _, e := range nat.externalIPs {
+		if e.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
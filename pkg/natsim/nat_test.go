@@ -0,0 +1,262 @@
+package natsim
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/transport"
+)
+
+var (
+	serverX  = &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 3478}
+	serverY  = &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 3478}
+	serverY2 = &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 3479}
+	external = net.IPv4(203, 0, 113, 1)
+	internal = net.IPv4(10, 0, 0, 2)
+)
+
+func listen(t *testing.T, tr transport.Transport, addr *net.UDPAddr) net.PacketConn {
+	t.Helper()
+	c, err := tr.ListenPacket("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func newNAT(t *testing.T, cfg Config, externals ...net.IP) (*Network, *NAT) {
+	t.Helper()
+	if len(externals) == 0 {
+		externals = []net.IP{external}
+	}
+	n := NewNetwork()
+	nat, err := n.AddNAT(cfg, externals...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, nat
+}
+
+// receive returns the source of the next packet on c, nil if none arrives soon
+func receive(t *testing.T, c net.PacketConn) *net.UDPAddr {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 64)
+	_, from, err := c.ReadFrom(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return from.(*net.UDPAddr)
+}
+
+// mapped sends from host to server, and returns the source the server sees
+func mapped(t *testing.T, host, server net.PacketConn) *net.UDPAddr {
+	t.Helper()
+	if _, err := host.WriteTo([]byte("ping"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	from := receive(t, server)
+	if from == nil {
+		t.Fatalf("%s did not reach %s", host.LocalAddr(), server.LocalAddr())
+	}
+	return from
+}
+
+func TestMapping(t *testing.T) {
+	for _, tc := range []struct {
+		mapping Mapping
+		// whether the mapping toward X equals the one toward Y, and Y to the one toward Y2
+		sameXY, sameYY2 bool
+	}{
+		{EIM, true, true},
+		{ADM, false, true},
+		{APDM, false, false},
+	} {
+		t.Run(string(tc.mapping), func(t *testing.T) {
+			n, nat := newNAT(t, Config{Name: "test", Mapping: tc.mapping, Filtering: APDF, PortAllocation: PortSequential})
+			x, y, y2 := listen(t, n, serverX), listen(t, n, serverY), listen(t, n, serverY2)
+			host := listen(t, nat, &net.UDPAddr{IP: internal, Port: 5000})
+
+			mx, my, my2 := mapped(t, host, x), mapped(t, host, y), mapped(t, host, y2)
+			if !mx.IP.Equal(external) {
+				t.Errorf("mapped to %s, not the external IP", mx)
+			}
+			if got := mx.String() == my.String(); got != tc.sameXY {
+				t.Errorf("mapping toward X %s, toward Y %s", mx, my)
+			}
+			if got := my.String() == my2.String(); got != tc.sameYY2 {
+				t.Errorf("mapping toward Y %s, toward Y2 %s", my, my2)
+			}
+		})
+	}
+}
+
+func TestFiltering(t *testing.T) {
+	for _, tc := range []struct {
+		filtering Filtering
+		// whether packets from X on another port, and from another IP pass
+		otherPort, otherIP bool
+	}{
+		{EIF, true, true},
+		{ADF, true, false},
+		{APDF, false, false},
+	} {
+		t.Run(string(tc.filtering), func(t *testing.T) {
+			n, nat := newNAT(t, Config{Name: "test", Mapping: EIM, Filtering: tc.filtering})
+			x := listen(t, n, serverX)
+			xOther := listen(t, n, &net.UDPAddr{IP: serverX.IP, Port: 4000})
+			other := listen(t, n, serverY)
+			host := listen(t, nat, &net.UDPAddr{IP: internal, Port: 5000})
+			m := mapped(t, host, x)
+
+			for _, s := range []struct {
+				name   string
+				sender net.PacketConn
+				want   bool
+			}{
+				{"X", x, true},
+				{"X on another port", xOther, tc.otherPort},
+				{"another IP", other, tc.otherIP},
+			} {
+				s.sender.WriteTo([]byte("hello"), m)
+				if got := receive(t, host) != nil; got != s.want {
+					t.Errorf("packet from %s passed: %t, want %t", s.name, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPortAllocation(t *testing.T) {
+	t.Run("preserve", func(t *testing.T) {
+		n, nat := newNAT(t, Config{Name: "test", Mapping: APDM, Filtering: APDF, PortAllocation: PortPreserve})
+		x, y := listen(t, n, serverX), listen(t, n, serverY)
+		host := listen(t, nat, &net.UDPAddr{IP: internal, Port: 5000})
+		if m := mapped(t, host, x); m.Port != 5000 {
+			t.Errorf("port %d is not preserved", m.Port)
+		}
+		// the external port is taken by the first mapping
+		if m := mapped(t, host, y); m.Port != firstAllocatedPort {
+			t.Errorf("port %d is allocated, want %d in sequence", m.Port, firstAllocatedPort)
+		}
+	})
+
+	t.Run("sequential", func(t *testing.T) {
+		n, nat := newNAT(t, Config{Name: "test", Mapping: EIM, Filtering: APDF, PortAllocation: PortSequential, PortStep: 2})
+		x := listen(t, n, serverX)
+		for i := 0; i < 3; i++ {
+			host := listen(t, nat, &net.UDPAddr{IP: internal, Port: 5000 + i})
+			if m, want := mapped(t, host, x), firstAllocatedPort+2*i; m.Port != want {
+				t.Errorf("port %d is allocated, want %d", m.Port, want)
+			}
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		n, nat := newNAT(t, Config{Name: "test", Mapping: EIM, Filtering: APDF, PortAllocation: PortRandom})
+		x := listen(t, n, serverX)
+		seen := map[int]bool{}
+		contiguous := 0
+		prev := 0
+		for i := 0; i < 10; i++ {
+			host := listen(t, nat, &net.UDPAddr{IP: internal, Port: 5000 + i})
+			m := mapped(t, host, x)
+			if m.Port < minRandomPort || seen[m.Port] {
+				t.Errorf("port %d is out of range or used", m.Port)
+			}
+			if m.Port-prev == 1 {
+				contiguous++
+			}
+			seen[m.Port] = true
+			prev = m.Port
+		}
+		if contiguous > 1 {
+			t.Errorf("%d of 10 ports are contiguous", contiguous)
+		}
+	})
+}
+
+func TestBindingTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	n, nat := newNAT(t, Config{Name: "test", Mapping: EIM, Filtering: EIF, PortAllocation: PortSequential, BindingTimeout: timeout})
+	x := listen(t, n, serverX)
+	host := listen(t, nat, &net.UDPAddr{IP: internal, Port: 5000})
+	m := mapped(t, host, x)
+
+	time.Sleep(timeout * 3 / 4)
+	x.WriteTo([]byte("hello"), m)
+	if receive(t, host) == nil {
+		t.Fatal("binding expired before timeout")
+	}
+	// the inbound packet did not refresh the binding
+	time.Sleep(timeout / 2)
+	x.WriteTo([]byte("hello"), m)
+	if receive(t, host) != nil {
+		t.Error("binding was refreshed by inbound packet")
+	}
+
+	if again := mapped(t, host, x); again.String() == m.String() {
+		t.Errorf("expired mapping %s was reused", m)
+	}
+}
+
+func TestHairpin(t *testing.T) {
+	for _, hairpin := range []bool{true, false} {
+		n, nat := newNAT(t, Config{Name: "test", Mapping: EIM, Filtering: EIF, Hairpin: hairpin})
+		x := listen(t, n, serverX)
+		a := listen(t, nat, &net.UDPAddr{IP: internal, Port: 5000})
+		b := listen(t, nat, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 5000})
+		ma, mb := mapped(t, a, x), mapped(t, b, x)
+
+		b.WriteTo([]byte("hello"), ma)
+		from := receive(t, a)
+		switch {
+		case !hairpin && from != nil:
+			t.Errorf("packet was hairpinned from %s", from)
+		case hairpin && from == nil:
+			t.Error("packet was not hairpinned")
+		case hairpin && from.String() != mb.String():
+			t.Errorf("hairpinned from %s, want the external address %s", from, mb)
+		}
+	}
+}
+
+func TestPooling(t *testing.T) {
+	second := net.IPv4(203, 0, 113, 2)
+	for _, arbitrary := range []bool{false, true} {
+		n, nat := newNAT(t, Config{Name: "test", Mapping: APDM, Filtering: APDF, ArbitraryPooling: arbitrary}, external, second)
+		servers := []net.PacketConn{listen(t, n, serverX), listen(t, n, serverY), listen(t, n, serverY2)}
+		host := listen(t, nat, &net.UDPAddr{IP: internal, Port: 5000})
+
+		ips := map[string]bool{}
+		for _, s := range servers {
+			ips[mapped(t, host, s).IP.String()] = true
+		}
+		if arbitrary && len(ips) != 2 {
+			t.Errorf("arbitrary pooling used %d external IPs", len(ips))
+		}
+		if !arbitrary && len(ips) != 1 {
+			t.Errorf("paired pooling used %d external IPs", len(ips))
+		}
+	}
+}
+
+func TestAddNAT(t *testing.T) {
+	n := NewNetwork()
+	if _, err := n.AddNAT(Config{Name: "none"}); err == nil {
+		t.Error("NAT without external IP was added")
+	}
+	if _, err := n.AddNAT(Config{Name: "a"}, external); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.AddNAT(Config{Name: "b"}, external); !errors.Is(err, ErrAddrInUse) {
+		t.Errorf("got %v, want %v", err, ErrAddrInUse)
+	}
+}
@@ -0,0 +1,145 @@
+// Package natsim simulates NAT behaviors of RFC 4787 in process, so that
+// diagnosis can be run deterministically against known NAT profiles
+// without real NAT devices. Network and NAT implement transport.Transport,
+// so sockets on the simulated network can be used by stun clients and turn.NewServer.
+package natsim
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/transport"
+)
+
+const (
+	firstEphemeralPort = 50000
+)
+
+var (
+	ErrAddrInUse    = errors.New("address already in use")
+	ErrNoFreePort   = errors.New("no free port")
+	ErrIPNotOnRealm = errors.New("IP address does not belong to the realm")
+)
+
+// Network is the simulated public internet, which NATs and public hosts are attached to
+type Network struct {
+	mu sync.Mutex
+	// realm of public hosts, e.g. STUN servers
+	public *realm
+	// NATs by external IP
+	nats map[string]*NAT
+}
+
+func NewNetwork() *Network {
+	n := &Network{nats: map[string]*NAT{}}
+	n.public = newRealm(n.route)
+	return n
+}
+
+// ListenPacket binds a socket of a public host to laddr,
+// a free port is chosen if the port is 0. network is ignored.
+func (n *Network) ListenPacket(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	c, err := n.public.listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// route delivers b from a public address, or from an external address of NAT, to to
+func (n *Network) route(b []byte, from, to *net.UDPAddr) {
+	n.mu.Lock()
+	nat, ok := n.nats[to.IP.String()]
+	n.mu.Unlock()
+	if ok {
+		nat.inbound(b, from, to)
+		return
+	}
+	if !n.public.deliver(b, from, to) {
+		logger.Debug(fmt.Sprintf("natsim: no host at %s, drop packet from %s", to, from))
+	}
+}
+
+// realm is a set of sockets sharing an address space, the public internet
+// or the private side of a NAT
+type realm struct {
+	mu    sync.Mutex
+	conns map[string]*transport.Conn
+	next  map[string]int // next ephemeral port by IP
+	// send is called for packets to addresses not bound in the realm
+	send func(b []byte, from, to *net.UDPAddr)
+}
+
+func newRealm(send func(b []byte, from, to *net.UDPAddr)) *realm {
+	return &realm{conns: map[string]*transport.Conn{}, next: map[string]int{}, send: send}
+}
+
+func (r *realm) listen(laddr *net.UDPAddr) (*transport.Conn, error) {
+	if laddr == nil || laddr.IP == nil || laddr.IP.IsUnspecified() {
+		return nil, fmt.Errorf("natsim: %w: bind to a specific address", ErrIPNotOnRealm)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addr := &net.UDPAddr{IP: laddr.IP, Port: laddr.Port}
+	if addr.Port == 0 {
+		port, err := r.ephemeral(addr.IP)
+		if err != nil {
+			return nil, err
+		}
+		addr.Port = port
+	}
+	if _, ok := r.conns[addr.String()]; ok {
+		return nil, fmt.Errorf("natsim: %w: %s", ErrAddrInUse, addr)
+	}
+	key := addr.String()
+	c := transport.NewConn(addr, r.write, func() { r.remove(key) })
+	r.conns[key] = c
+	return c, nil
+}
+
+// ephemeral returns a free port of ip in sequence, r.mu must be held
+func (r *realm) ephemeral(ip net.IP) (int, error) {
+	key := ip.String()
+	if r.next[key] == 0 {
+		r.next[key] = firstEphemeralPort
+	}
+	for i := firstEphemeralPort; i <= 65535; i++ {
+		port := r.next[key]
+		r.next[key]++
+		if r.next[key] > 65535 {
+			r.next[key] = firstEphemeralPort
+		}
+		if _, ok := r.conns[(&net.UDPAddr{IP: ip, Port: port}).String()]; !ok {
+			return port, nil
+		}
+	}
+	return 0, ErrNoFreePort
+}
+
+// deliver queues b to the socket bound to to, it reports whether the socket exists
+func (r *realm) deliver(b []byte, from, to *net.UDPAddr) bool {
+	r.mu.Lock()
+	c, ok := r.conns[to.String()]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	c.Deliver(b, from)
+	return true
+}
+
+func (r *realm) write(b []byte, from, to *net.UDPAddr) {
+	if r.deliver(b, from, to) {
+		return
+	}
+	r.send(b, from, to)
+}
+
+func (r *realm) remove(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, key)
+}
@@ -0,0 +1,78 @@
+package natsim
+
+import (
+	"fmt"
+	"time"
+)
+
+// Profiles returns NAT behaviors commonly seen in the wild, named after
+// the classic STUN (RFC 3489) types where they correspond
+func Profiles() []Config {
+	return []Config{
+		{
+			Name:           "full-cone",
+			Mapping:        EIM,
+			Filtering:      EIF,
+			PortAllocation: PortPreserve,
+			Hairpin:        true,
+		},
+		{
+			Name:           "restricted-cone",
+			Mapping:        EIM,
+			Filtering:      ADF,
+			PortAllocation: PortSequential,
+			Hairpin:        true,
+		},
+		{
+			Name:           "port-restricted-cone",
+			Mapping:        EIM,
+			Filtering:      APDF,
+			PortAllocation: PortPreserve,
+			BindingTimeout: 1200 * time.Millisecond,
+		},
+		{
+			// most home routers, which hairpin as RFC 4787 REQ-9 requires
+			Name:           "home-router",
+			Mapping:        EIM,
+			Filtering:      APDF,
+			PortAllocation: PortSequential,
+			Hairpin:        true,
+		},
+		{
+			Name:           "address-dependent",
+			Mapping:        ADM,
+			Filtering:      ADF,
+			PortAllocation: PortSequential,
+		},
+		{
+			Name:           "symmetric",
+			Mapping:        APDM,
+			Filtering:      APDF,
+			PortAllocation: PortSequential,
+		},
+		{
+			Name:           "symmetric-random",
+			Mapping:        APDM,
+			Filtering:      APDF,
+			PortAllocation: PortRandom,
+		},
+		{
+			// CGN assigning any address of its pool to each mapping
+			Name:             "cgn-pool",
+			Mapping:          EIM,
+			Filtering:        APDF,
+			PortAllocation:   PortSequential,
+			ArbitraryPooling: true,
+		},
+	}
+}
+
+// Profile returns the profile of name
+func Profile(name string) (Config, error) {
+	for _, p := range Profiles() {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return Config{}, fmt.Errorf("natsim: unknown profile %q", name)
+}
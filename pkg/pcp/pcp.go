@@ -0,0 +1,401 @@
+// Package pcp implements Port Control Protocol client.
+// see RFC 6887
+package pcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+)
+
+const (
+	// Port is the port PCP server listens on
+	Port = 5351
+
+	version = 2
+
+	headerBytes   = 24
+	nonceBytes    = 12
+	mapPayload    = 36
+	peerPayload   = 56
+	responseFlag  = 0x80
+	maxPacketSize = 1100
+
+	defaultInitialTimeout = 500 * time.Millisecond
+	defaultMaxRetry       = 3
+)
+
+type Opcode uint8
+
+const (
+	OpAnnounce Opcode = 0
+	OpMap      Opcode = 1
+	OpPeer     Opcode = 2
+)
+
+// Protocol is IANA protocol number, 0 means all protocols
+type Protocol uint8
+
+const (
+	AllProtocols Protocol = 0
+	TCP          Protocol = 6
+	UDP          Protocol = 17
+)
+
+type OptionCode uint8
+
+const (
+	OptThirdParty    OptionCode = 1
+	OptPreferFailure OptionCode = 2
+	OptFilter        OptionCode = 3
+)
+
+// ResultCode is a result code of PCP response
+type ResultCode uint8
+
+const (
+	Success               ResultCode = 0
+	UnsuppVersion         ResultCode = 1
+	NotAuthorized         ResultCode = 2
+	MalformedRequest      ResultCode = 3
+	UnsuppOpcode          ResultCode = 4
+	UnsuppOption          ResultCode = 5
+	MalformedOption       ResultCode = 6
+	NetworkFailure        ResultCode = 7
+	NoResources           ResultCode = 8
+	UnsuppProtocol        ResultCode = 9
+	UserExQuota           ResultCode = 10
+	CannotProvideExternal ResultCode = 11
+	AddressMismatch       ResultCode = 12
+	ExcessiveRemotePeers  ResultCode = 13
+)
+
+var resultCodes = map[ResultCode]string{
+	Success:               "SUCCESS",
+	UnsuppVersion:         "UNSUPP_VERSION",
+	NotAuthorized:         "NOT_AUTHORIZED",
+	MalformedRequest:      "MALFORMED_REQUEST",
+	UnsuppOpcode:          "UNSUPP_OPCODE",
+	UnsuppOption:          "UNSUPP_OPTION",
+	MalformedOption:       "MALFORMED_OPTION",
+	NetworkFailure:        "NETWORK_FAILURE",
+	NoResources:           "NO_RESOURCES",
+	UnsuppProtocol:        "UNSUPP_PROTOCOL",
+	UserExQuota:           "USER_EX_QUOTA",
+	CannotProvideExternal: "CANNOT_PROVIDE_EXTERNAL",
+	AddressMismatch:       "ADDRESS_MISMATCH",
+	ExcessiveRemotePeers:  "EXCESSIVE_REMOTE_PEERS",
+}
+
+func (r ResultCode) String() string {
+	if s, ok := resultCodes[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("ResultCode(%d)", uint8(r))
+}
+
+// Error is returned when PCP server responds with non SUCCESS result code
+type Error struct {
+	Code ResultCode
+	// Version is the version of the response, 0 means the server only speaks NAT-PMP
+	Version uint8
+	// Lifetime is how long the error is expected to last
+	Lifetime time.Duration
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("PCP server responded: %s", e.Code)
+}
+
+var (
+	ErrNoResponse      = errors.New("no response from PCP server")
+	errInvalidResponse = errors.New("invalid PCP response")
+	errNonceMismatch   = errors.New("nonce of PCP response does not match")
+)
+
+type Nonce [nonceBytes]byte
+
+// MapRequest is parameters of MAP and PEER request
+type MapRequest struct {
+	// Nonce identifies the mapping, zero value generates a new one.
+	// the same nonce must be used to renew or delete the mapping.
+	Nonce         Nonce
+	Protocol      Protocol
+	InternalPort  uint16
+	SuggestedPort uint16
+	SuggestedIP   net.IP // nil means no preference
+	Lifetime      time.Duration
+
+	// ThirdParty requests the mapping for another internal host
+	ThirdParty net.IP
+	// PreferFailure asks the server to fail instead of assigning another external port
+	PreferFailure bool
+}
+
+// PeerRequest is parameters of PEER request
+type PeerRequest struct {
+	MapRequest
+	RemotePeerIP   net.IP
+	RemotePeerPort uint16
+}
+
+// Mapping is a result of MAP or PEER request
+type Mapping struct {
+	Nonce        Nonce
+	Protocol     Protocol
+	InternalPort uint16
+	ExternalPort uint16
+	ExternalIP   net.IP
+	Lifetime     time.Duration
+	Epoch        uint32
+}
+
+type Client struct {
+	server         *net.UDPAddr
+	initialTimeout time.Duration
+	maxRetry       uint8
+}
+
+type ClientOption func(c *Client)
+
+// WithPort changes the port of the server, for example to talk to a fake server
+func WithPort(port int) ClientOption {
+	return func(c *Client) {
+		c.server.Port = port
+	}
+}
+
+// WithInitialTimeout sets the first timeout, which is doubled on each retransmission
+func WithInitialTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.initialTimeout = timeout
+	}
+}
+
+func WithMaxRetry(maxRetry uint8) ClientOption {
+	return func(c *Client) {
+		c.maxRetry = maxRetry
+	}
+}
+
+func NewClient(server net.IP, opts ...ClientOption) *Client {
+	c := &Client{
+		server:         &net.UDPAddr{IP: server, Port: Port},
+		initialTimeout: defaultInitialTimeout,
+		maxRetry:       defaultMaxRetry,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Map requests MAP opcode, which creates an inbound mapping
+func (c *Client) Map(req MapRequest) (Mapping, error) {
+	if err := fillNonce(&req.Nonce); err != nil {
+		return Mapping{}, err
+	}
+	payload := encodeMapPayload(req)
+	return c.do(OpMap, req, payload)
+}
+
+// Peer requests PEER opcode, which creates or learns the mapping to a remote peer
+func (c *Client) Peer(req PeerRequest) (Mapping, error) {
+	if err := fillNonce(&req.Nonce); err != nil {
+		return Mapping{}, err
+	}
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  :               MAP payload (nonce ... suggested address)       :
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |       Remote Peer Port        |     Reserved (16 bits)        |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |               Remote Peer IP Address (128 bits)               |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	payload := encodeMapPayload(req.MapRequest)
+	peer := make([]byte, peerPayload-mapPayload)
+	binary.BigEndian.PutUint16(peer[0:2], req.RemotePeerPort)
+	copy(peer[4:20], req.RemotePeerIP.To16())
+	return c.do(OpPeer, req.MapRequest, append(payload, peer...))
+}
+
+// Delete deletes the mapping created by Map, with lifetime 0 and the same nonce
+func (c *Client) Delete(m Mapping) error {
+	_, err := c.Map(MapRequest{
+		Nonce:        m.Nonce,
+		Protocol:     m.Protocol,
+		InternalPort: m.InternalPort,
+	})
+	return err
+}
+
+func fillNonce(n *Nonce) error {
+	if *n != (Nonce{}) {
+		return nil
+	}
+	_, err := rand.Read(n[:])
+	return err
+}
+
+func encodeMapPayload(req MapRequest) []byte {
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |                 Mapping Nonce (96 bits)                       |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |   Protocol    |          Reserved (24 bits)                   |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |        Internal Port          |    Suggested External Port    |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |           Suggested External IP Address (128 bits)            |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	p := make([]byte, mapPayload)
+	copy(p[0:12], req.Nonce[:])
+	p[12] = uint8(req.Protocol)
+	binary.BigEndian.PutUint16(p[16:18], req.InternalPort)
+	binary.BigEndian.PutUint16(p[18:20], req.SuggestedPort)
+	suggested := req.SuggestedIP
+	if suggested == nil {
+		// all zero address in IPv4-mapped form means no preference
+		suggested = net.IPv4zero
+	}
+	copy(p[20:36], suggested.To16())
+	return p
+}
+
+func encodeOptions(req MapRequest) []byte {
+	buf := new(bytes.Buffer)
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |  Option Code  |  Reserved     |       Option Length           |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  :                       (optional) data                         :
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	if req.ThirdParty != nil {
+		buf.Write([]byte{uint8(OptThirdParty), 0, 0, 16})
+		buf.Write(req.ThirdParty.To16())
+	}
+	if req.PreferFailure {
+		buf.Write([]byte{uint8(OptPreferFailure), 0, 0, 0})
+	}
+	return buf.Bytes()
+}
+
+// do sends request to the server, and retransmits it with doubled timeout
+// until the response for the opcode and nonce arrives
+func (c *Client) do(op Opcode, req MapRequest, payload []byte) (Mapping, error) {
+	conn, err := net.DialUDP("udp", nil, c.server)
+	if err != nil {
+		return Mapping{}, err
+	}
+	defer conn.Close()
+
+	//  0                   1                   2                   3
+	//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |  Version = 2  |R|   Opcode    |         Reserved              |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                 Requested Lifetime (32 bits)                  |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |            PCP Client's IP Address (128 bits)                 |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// :             (optional) opcode-specific information            :
+	// :             (optional) PCP Options                            :
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	msg := make([]byte, headerBytes)
+	msg[0] = version
+	msg[1] = uint8(op)
+	binary.BigEndian.PutUint32(msg[4:8], uint32(req.Lifetime/time.Second))
+	// the client address must be the source address of this packet
+	copy(msg[8:24], conn.LocalAddr().(*net.UDPAddr).IP.To16())
+	msg = append(msg, payload...)
+	msg = append(msg, encodeOptions(req)...)
+
+	res := make([]byte, maxPacketSize)
+	timeout := c.initialTimeout
+	for attempt := 0; attempt <= int(c.maxRetry); attempt++ {
+		logger.Debug(fmt.Sprintf("PCP request op %d to %s (attempt %d)", op, c.server, attempt+1))
+		if _, err := conn.Write(msg); err != nil {
+			return Mapping{}, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return Mapping{}, err
+		}
+		for {
+			n, err := conn.Read(res)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				return Mapping{}, err
+			}
+			m, err := parseResponse(res[:n], op, req.Nonce)
+			if err != nil {
+				var perr Error
+				if errors.As(err, &perr) {
+					return Mapping{}, err
+				}
+				logger.Debug(fmt.Sprintf("ignore PCP response: %s", err))
+				continue
+			}
+			return m, nil
+		}
+		timeout *= 2
+	}
+	return Mapping{}, ErrNoResponse
+}
+
+func parseResponse(res []byte, op Opcode, nonce Nonce) (Mapping, error) {
+	//  0                   1                   2                   3
+	//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |  Version = 2  |R|   Opcode    |   Reserved    |  Result Code  |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                      Lifetime (32 bits)                       |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                     Epoch Time (32 bits)                      |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                      Reserved (96 bits)                       |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	if len(res) < 4 {
+		return Mapping{}, errInvalidResponse
+	}
+	if res[0] != version {
+		// NAT-PMP server answers PCP request with its version 0 and UNSUPP_VERSION
+		if res[1]&responseFlag != 0 {
+			return Mapping{}, Error{Code: UnsuppVersion, Version: res[0]}
+		}
+		return Mapping{}, errInvalidResponse
+	}
+	if len(res) < headerBytes || res[1] != responseFlag|uint8(op) {
+		return Mapping{}, errInvalidResponse
+	}
+	lifetime := time.Duration(binary.BigEndian.Uint32(res[4:8])) * time.Second
+	if code := ResultCode(res[3]); code != Success {
+		// error response may not carry the opcode payload
+		return Mapping{}, Error{Code: code, Version: res[0], Lifetime: lifetime}
+	}
+	if len(res) < headerBytes+mapPayload {
+		return Mapping{}, errInvalidResponse
+	}
+	p := res[headerBytes:]
+	m := Mapping{
+		Protocol:     Protocol(p[12]),
+		InternalPort: binary.BigEndian.Uint16(p[16:18]),
+		ExternalPort: binary.BigEndian.Uint16(p[18:20]),
+		ExternalIP:   net.IP(append([]byte(nil), p[20:36]...)),
+		Lifetime:     lifetime,
+		Epoch:        binary.BigEndian.Uint32(res[8:12]),
+	}
+	copy(m.Nonce[:], p[0:12])
+	if m.Nonce != nonce {
+		return Mapping{}, errNonceMismatch
+	}
+	if ip4 := m.ExternalIP.To4(); ip4 != nil {
+		m.ExternalIP = ip4
+	}
+	return m, nil
+}
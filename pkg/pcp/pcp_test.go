@@ -0,0 +1,217 @@
+package pcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers each request with the packets handle returns,
+// and returns a client talking to it
+func fakeServer(t *testing.T, handle func(req []byte) [][]byte) *Client {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			for _, res := range handle(append([]byte(nil), buf[:n]...)) {
+				conn.WriteToUDP(res, from)
+			}
+		}
+	}()
+	return NewClient(net.IPv4(127, 0, 0, 1),
+		WithPort(conn.LocalAddr().(*net.UDPAddr).Port),
+		WithInitialTimeout(20*time.Millisecond),
+		WithMaxRetry(1),
+	)
+}
+
+// mapResponse returns a successful response to req, which echoes its payload
+// with the external address
+func mapResponse(req []byte, code ResultCode, external net.IP, port uint16) []byte {
+	res := make([]byte, headerBytes)
+	res[0] = version
+	res[1] = responseFlag | req[1]
+	res[3] = uint8(code)
+	copy(res[4:8], req[4:8])
+	binary.BigEndian.PutUint32(res[8:12], 7)
+	payload := append([]byte(nil), req[headerBytes:headerBytes+mapPayload]...)
+	binary.BigEndian.PutUint16(payload[18:20], port)
+	copy(payload[20:36], external.To16())
+	return append(res, payload...)
+}
+
+func TestMap(t *testing.T) {
+	c := fakeServer(t, func(req []byte) [][]byte {
+		if len(req) != headerBytes+mapPayload {
+			t.Fatalf("request has %d bytes", len(req))
+		}
+		if req[0] != version || req[1] != uint8(OpMap) {
+			t.Errorf("header = % X", req[:4])
+		}
+		if lifetime := binary.BigEndian.Uint32(req[4:8]); lifetime != 120 {
+			t.Errorf("requested lifetime = %d", lifetime)
+		}
+		if client := net.IP(req[8:24]); !client.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("client address = %s", client)
+		}
+		p := req[headerBytes:]
+		if bytes.Equal(p[0:12], make([]byte, 12)) {
+			t.Error("nonce is not generated")
+		}
+		if p[12] != uint8(UDP) || binary.BigEndian.Uint16(p[16:18]) != 5000 || binary.BigEndian.Uint16(p[18:20]) != 5001 {
+			t.Errorf("payload = % X", p[12:20])
+		}
+		if suggested := net.IP(p[20:36]); !suggested.Equal(net.IPv4zero) {
+			t.Errorf("suggested address = %s", suggested)
+		}
+		return [][]byte{mapResponse(req, Success, net.IPv4(203, 0, 113, 9), 40000)}
+	})
+
+	m, err := c.Map(MapRequest{Protocol: UDP, InternalPort: 5000, SuggestedPort: 5001, Lifetime: 2 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.ExternalIP.Equal(net.IPv4(203, 0, 113, 9)) || len(m.ExternalIP) != net.IPv4len {
+		t.Errorf("external address = %s (%d bytes)", m.ExternalIP, len(m.ExternalIP))
+	}
+	if m.ExternalPort != 40000 || m.InternalPort != 5000 || m.Lifetime != 2*time.Minute || m.Epoch != 7 {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestNonceMismatch(t *testing.T) {
+	c := fakeServer(t, func(req []byte) [][]byte {
+		stale := mapResponse(req, Success, net.IPv4(192, 0, 2, 1), 1)
+		stale[headerBytes] ^= 0xFF
+		return [][]byte{stale, mapResponse(req, Success, net.IPv4(203, 0, 113, 9), 40000)}
+	})
+
+	m, err := c.Map(MapRequest{Protocol: UDP, InternalPort: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ExternalPort != 40000 {
+		t.Errorf("response of another nonce was accepted: %+v", m)
+	}
+}
+
+func TestNonceMismatchOnly(t *testing.T) {
+	c := fakeServer(t, func(req []byte) [][]byte {
+		stale := mapResponse(req, Success, net.IPv4(192, 0, 2, 1), 1)
+		stale[headerBytes] ^= 0xFF
+		return [][]byte{stale}
+	})
+
+	if _, err := c.Map(MapRequest{Protocol: UDP, InternalPort: 5000}); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("got %v, want %v", err, ErrNoResponse)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	c := fakeServer(t, func(req []byte) [][]byte {
+		res := make([]byte, headerBytes)
+		res[0] = version
+		res[1] = responseFlag | uint8(OpMap)
+		res[3] = uint8(NotAuthorized)
+		binary.BigEndian.PutUint32(res[4:8], 30)
+		return [][]byte{res}
+	})
+
+	_, err := c.Map(MapRequest{Protocol: UDP, InternalPort: 5000})
+	var perr Error
+	if !errors.As(err, &perr) || perr.Code != NotAuthorized || perr.Lifetime != 30*time.Second {
+		t.Errorf("got %#v", err)
+	}
+}
+
+func TestNATPMPServer(t *testing.T) {
+	c := fakeServer(t, func(req []byte) [][]byte {
+		// NAT-PMP answers with version 0 and UNSUPP_VERSION
+		return [][]byte{{0, 0x80 | uint8(OpMap), 0, 1, 0, 0, 0, 0}}
+	})
+
+	_, err := c.Map(MapRequest{Protocol: UDP, InternalPort: 5000})
+	var perr Error
+	if !errors.As(err, &perr) || perr.Code != UnsuppVersion || perr.Version != 0 {
+		t.Errorf("got %#v", err)
+	}
+}
+
+func TestPeer(t *testing.T) {
+	c := fakeServer(t, func(req []byte) [][]byte {
+		if req[1] != uint8(OpPeer) || len(req) != headerBytes+peerPayload {
+			t.Fatalf("op %d with %d bytes", req[1], len(req))
+		}
+		peer := req[headerBytes+mapPayload:]
+		if port := binary.BigEndian.Uint16(peer[0:2]); port != 3478 {
+			t.Errorf("remote peer port = %d", port)
+		}
+		if ip := net.IP(peer[4:20]); !ip.Equal(net.IPv4(198, 51, 100, 1)) {
+			t.Errorf("remote peer address = %s", ip)
+		}
+		return [][]byte{mapResponse(req, Success, net.IPv4(203, 0, 113, 9), 40001)}
+	})
+
+	m, err := c.Peer(PeerRequest{
+		MapRequest:     MapRequest{Protocol: UDP, InternalPort: 5000, Lifetime: time.Minute},
+		RemotePeerIP:   net.IPv4(198, 51, 100, 1),
+		RemotePeerPort: 3478,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ExternalPort != 40001 {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestDeleteKeepsNonce(t *testing.T) {
+	var mu sync.Mutex
+	var nonces [][]byte
+	c := fakeServer(t, func(req []byte) [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		nonces = append(nonces, req[headerBytes:headerBytes+nonceBytes])
+		if len(nonces) == 2 {
+			if lifetime := binary.BigEndian.Uint32(req[4:8]); lifetime != 0 {
+				t.Errorf("lifetime of delete = %d", lifetime)
+			}
+		}
+		return [][]byte{mapResponse(req, Success, net.IPv4(203, 0, 113, 9), 40000)}
+	})
+
+	m, err := c.Map(MapRequest{Protocol: UDP, InternalPort: 5000, Lifetime: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(m); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(nonces) != 2 || !bytes.Equal(nonces[0], nonces[1]) {
+		t.Errorf("nonces = % X", nonces)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	got := encodeOptions(MapRequest{ThirdParty: net.IPv4(192, 168, 0, 10), PreferFailure: true})
+	want := append([]byte{uint8(OptThirdParty), 0, 0, 16}, net.IPv4(192, 168, 0, 10).To16()...)
+	want = append(want, uint8(OptPreferFailure), 0, 0, 0)
+	if !bytes.Equal(got, want) {
+		t.Errorf("options = % X, want % X", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package rendezvous
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultPollInterval = 500 * time.Millisecond
+	requestTimeout      = 5 * time.Second
+)
+
+var (
+	ErrSessionNotFound = errors.New("session does not exist or expired")
+	ErrWaitTimeout     = errors.New("peer did not register in time")
+)
+
+// Client talks with rendezvous server at base URL, e.g. http://example.com:8080
+type Client struct {
+	base string
+	http *http.Client
+}
+
+func NewClient(base string) *Client {
+	return &Client{
+		base: base,
+		http: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// CreateSession creates a session with random ID
+func (c *Client) CreateSession() (Session, error) {
+	return c.do(http.MethodPost, c.base+"/sessions", nil)
+}
+
+// Join registers candidates of id in session sid, the previous registration is replaced.
+// the session is created if it does not exist.
+func (c *Client) Join(sid, id string, candidates []Candidate) (Session, error) {
+	b, err := json.Marshal(Registration{ID: id, Candidates: candidates})
+	if err != nil {
+		return Session{}, err
+	}
+	return c.do(http.MethodPut, c.sessionURL(sid)+"/peers/"+url.PathEscape(id), b)
+}
+
+// Session returns the session of sid
+func (c *Client) Session(sid string) (Session, error) {
+	return c.do(http.MethodGet, c.sessionURL(sid), nil)
+}
+
+// WaitPeer polls session sid until peer registers and punch time is scheduled,
+// or timeout elapses
+func (c *Client) WaitPeer(sid, peer string, timeout time.Duration) (Session, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		session, err := c.Session(sid)
+		if err != nil {
+			return Session{}, err
+		}
+		if _, ok := session.Peers[peer]; ok && session.PunchAt != nil {
+			return session, nil
+		}
+		if time.Now().Add(defaultPollInterval).After(deadline) {
+			return Session{}, fmt.Errorf("%w: %s", ErrWaitTimeout, peer)
+		}
+		time.Sleep(defaultPollInterval)
+	}
+}
+
+func (c *Client) do(method, u string, body []byte) (Session, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return Session{}, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return Session{}, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return Session{}, ErrSessionNotFound
+	case res.StatusCode/100 != 2:
+		msg, _ := io.ReadAll(res.Body)
+		return Session{}, fmt.Errorf("%s %s: %s %s", method, u, res.Status, bytes.TrimSpace(msg))
+	}
+	session := Session{}
+	if err := json.NewDecoder(res.Body).Decode(&session); err != nil {
+		return Session{}, err
+	}
+	session.received = time.Now()
+	return session, nil
+}
+
+func (c *Client) sessionURL(sid string) string {
+	return c.base + "/sessions/" + url.PathEscape(sid)
+}
@@ -0,0 +1,249 @@
+// Package rendezvous implements a small HTTP rendezvous service, which peers
+// register their candidates with to find each other for hole punching.
+package rendezvous
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+)
+
+const (
+	DefaultSessionTTL = 5 * time.Minute
+	DefaultPunchDelay = 2 * time.Second
+	// DefaultMaxSessions bounds memory, since any request may create a session
+	DefaultMaxSessions = 1024
+
+	peersPerSession = 2
+)
+
+// Candidate is a transport address a peer may be reached at
+type Candidate struct {
+	Type string `json:"type"` // "host", "srflx" or "relay"
+	Addr string `json:"addr"`
+}
+
+// Registration is what a peer has registered
+type Registration struct {
+	ID         string      `json:"id"`
+	Candidates []Candidate `json:"candidates"`
+}
+
+// Session is a rendezvous of two peers
+type Session struct {
+	ID      string                  `json:"id"`
+	Expires time.Time               `json:"expires"`
+	Peers   map[string]Registration `json:"peers"`
+	// PunchAt is when both peers should start punching, set once both registered
+	PunchAt *time.Time `json:"punch_at,omitempty"`
+	// PunchIn is PunchAt relative to the response in milliseconds,
+	// so that peers do not depend on their clocks being synchronized
+	PunchIn int64 `json:"punch_in_ms,omitempty"`
+
+	// received is when the client received the session
+	received time.Time
+}
+
+// LocalPunchAt returns PunchAt in the local clock, zero if not scheduled
+func (s Session) LocalPunchAt() time.Time {
+	if s.PunchAt == nil {
+		return time.Time{}
+	}
+	return s.received.Add(time.Duration(s.PunchIn) * time.Millisecond)
+}
+
+var (
+	errTooManySessions = errors.New("too many sessions")
+)
+
+type serverOptions struct {
+	ttl         time.Duration
+	delay       time.Duration
+	maxSessions int
+}
+
+type ServerOption func(o *serverOptions)
+
+// WithSessionTTL sets how long a session lives since the last registration
+func WithSessionTTL(d time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.ttl = d
+	}
+}
+
+// WithPunchDelay sets how long after the second registration peers start punching,
+// it must be longer than the polling interval of peers
+func WithPunchDelay(d time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.delay = d
+	}
+}
+
+// WithMaxSessions sets how many sessions can live at the same time,
+// requests which would create another one are answered with 503
+func WithMaxSessions(n int) ServerOption {
+	return func(o *serverOptions) {
+		o.maxSessions = n
+	}
+}
+
+// Server keeps sessions in memory
+type Server struct {
+	serverOptions
+	mu       sync.Mutex
+	sessions map[string]*Session
+	mux      *http.ServeMux
+}
+
+// NewServer returns a rendezvous server to be served by net/http
+//
+//	POST /sessions                 creates a session with random ID
+//	PUT  /sessions/{sid}/peers/{id} registers candidates of the peer, the session is created if missing
+//	GET  /sessions/{sid}           returns the session, 404 if missing or expired
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		serverOptions: serverOptions{
+			ttl:         DefaultSessionTTL,
+			delay:       DefaultPunchDelay,
+			maxSessions: DefaultMaxSessions,
+		},
+		sessions: map[string]*Session{},
+		mux:      http.NewServeMux(),
+	}
+	for _, o := range opts {
+		o(&s.serverOptions)
+	}
+	s.mux.HandleFunc("POST /sessions", s.create)
+	s.mux.HandleFunc("PUT /sessions/{sid}/peers/{id}", s.register)
+	s.mux.HandleFunc("GET /sessions/{sid}", s.lookup)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	session, err := s.session(hex.EncodeToString(b))
+	if err != nil {
+		s.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	resp := s.snapshot(session)
+	s.mu.Unlock()
+	logger.Info(fmt.Sprintf("created session %s from %s", session.ID, r.RemoteAddr))
+	writeSession(w, http.StatusCreated, resp)
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	reg := Registration{}
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reg.ID = r.PathValue("id")
+
+	s.mu.Lock()
+	session, err := s.session(r.PathValue("sid"))
+	if err != nil {
+		s.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if _, ok := session.Peers[reg.ID]; !ok && len(session.Peers) >= peersPerSession {
+		s.mu.Unlock()
+		http.Error(w, "session already has two peers", http.StatusConflict)
+		return
+	}
+	session.Peers[reg.ID] = reg
+	session.Expires = time.Now().Add(s.ttl)
+	if len(session.Peers) == peersPerSession && session.PunchAt == nil {
+		at := time.Now().Add(s.delay)
+		session.PunchAt = &at
+	}
+	resp := s.snapshot(session)
+	s.mu.Unlock()
+
+	logger.Info(fmt.Sprintf("registered %s in session %s from %s: %v", reg.ID, session.ID, r.RemoteAddr, reg.Candidates))
+	writeSession(w, http.StatusOK, resp)
+}
+
+func (s *Server) lookup(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.expire()
+	session, ok := s.sessions[r.PathValue("sid")]
+	var resp Session
+	if ok {
+		resp = s.snapshot(session)
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeSession(w, http.StatusOK, resp)
+}
+
+// session returns the session of sid, it is created if missing and the number
+// of sessions is below the limit. s.mu must be held.
+func (s *Server) session(sid string) (*Session, error) {
+	s.expire()
+	session, ok := s.sessions[sid]
+	if !ok {
+		if len(s.sessions) >= s.maxSessions {
+			logger.Warn(fmt.Sprintf("refused session %s: %d sessions live", sid, len(s.sessions)))
+			return nil, errTooManySessions
+		}
+		session = &Session{
+			ID:      sid,
+			Expires: time.Now().Add(s.ttl),
+			Peers:   map[string]Registration{},
+		}
+		s.sessions[sid] = session
+	}
+	return session, nil
+}
+
+// expire removes expired sessions, s.mu must be held
+func (s *Server) expire() {
+	now := time.Now()
+	for sid, session := range s.sessions {
+		if now.After(session.Expires) {
+			logger.Debug(fmt.Sprintf("session %s expired", sid))
+			delete(s.sessions, sid)
+		}
+	}
+}
+
+// snapshot copies session with PunchIn relative to now, s.mu must be held
+func (s *Server) snapshot(session *Session) Session {
+	resp := *session
+	resp.Peers = make(map[string]Registration, len(session.Peers))
+	for id, reg := range session.Peers {
+		resp.Peers[id] = reg
+	}
+	if session.PunchAt != nil {
+		resp.PunchIn = max(time.Until(*session.PunchAt).Milliseconds(), 0)
+	}
+	return resp
+}
+
+func writeSession(w http.ResponseWriter, status int, session Session) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(session)
+}
@@ -0,0 +1,211 @@
+package rendezvous
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, opts ...ServerOption) *Client {
+	t.Helper()
+	ts := httptest.NewServer(NewServer(opts...))
+	t.Cleanup(ts.Close)
+	return NewClient(ts.URL)
+}
+
+var (
+	candidatesA = []Candidate{{Type: "host", Addr: "192.168.0.10:5000"}, {Type: "srflx", Addr: "203.0.113.1:6000"}}
+	candidatesB = []Candidate{{Type: "srflx", Addr: "198.51.100.2:7000"}}
+)
+
+func TestSession(t *testing.T) {
+	c := newTestClient(t, WithPunchDelay(time.Second))
+
+	created, err := c.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created.ID) != 16 || len(created.Peers) != 0 || created.PunchAt != nil {
+		t.Errorf("created %+v", created)
+	}
+
+	s, err := c.Join(created.ID, "a", candidatesA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(s.Peers["a"].Candidates, candidatesA) || s.PunchAt != nil {
+		t.Errorf("after a joined: %+v", s)
+	}
+
+	s, err = c.Join(created.ID, "b", candidatesB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Peers) != 2 || s.PunchAt == nil {
+		t.Fatalf("after b joined: %+v", s)
+	}
+	if s.PunchIn <= 0 || s.PunchIn > 1000 {
+		t.Errorf("punch in %dms, want within the delay", s.PunchIn)
+	}
+	punchAt := *s.PunchAt
+
+	// registering again replaces candidates, and keeps the schedule
+	s, err = c.Join(created.ID, "a", candidatesB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(s.Peers["a"].Candidates, candidatesB) || !s.PunchAt.Equal(punchAt) {
+		t.Errorf("after a joined again: %+v", s)
+	}
+
+	s, err = c.Session(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != created.ID || len(s.Peers) != 2 || s.Peers["b"].ID != "b" {
+		t.Errorf("looked up %+v", s)
+	}
+}
+
+func TestJoinCreatesSession(t *testing.T) {
+	c := newTestClient(t)
+	if _, err := c.Join("a-b", "a", candidatesA); err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.Session("a-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Peers["a"]; !ok {
+		t.Errorf("a is not registered: %+v", s)
+	}
+}
+
+func TestThirdPeerConflicts(t *testing.T) {
+	c := newTestClient(t)
+	for _, id := range []string{"a", "b"} {
+		if _, err := c.Join("sid", id, candidatesA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := c.Join("sid", "c", candidatesA)
+	if err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("third peer got %v", err)
+	}
+}
+
+func TestSessionNotFound(t *testing.T) {
+	c := newTestClient(t)
+	if _, err := c.Session("missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	c := newTestClient(t, WithSessionTTL(50*time.Millisecond))
+	if _, err := c.Join("sid", "a", candidatesA); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.Session("sid"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expired session got %v", err)
+	}
+}
+
+func TestPunchIn(t *testing.T) {
+	c := newTestClient(t, WithPunchDelay(500*time.Millisecond))
+	c.Join("sid", "a", candidatesA)
+	joined, err := c.Join("sid", "b", candidatesB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := joined.LocalPunchAt(); got.Sub(joined.received) != time.Duration(joined.PunchIn)*time.Millisecond {
+		t.Errorf("local punch time %s is not PunchIn %dms after receipt", got, joined.PunchIn)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	later, err := c.Session("sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PunchIn counts down, while PunchAt stays
+	if later.PunchIn >= joined.PunchIn-100 || !later.PunchAt.Equal(*joined.PunchAt) {
+		t.Errorf("punch in %dms then %dms", joined.PunchIn, later.PunchIn)
+	}
+	if d := later.LocalPunchAt().Sub(joined.LocalPunchAt()); d < -50*time.Millisecond || d > 50*time.Millisecond {
+		t.Errorf("local punch time moved by %s", d)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	past, err := c.Session("sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if past.PunchIn != 0 || past.PunchAt == nil {
+		t.Errorf("after punch time: %+v", past)
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	c := newTestClient(t, WithMaxSessions(2), WithSessionTTL(100*time.Millisecond))
+	for _, sid := range []string{"s1", "s2"} {
+		if _, err := c.Join(sid, "a", candidatesA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.CreateSession(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("create over the limit got %v", err)
+	}
+	if _, err := c.Join("s3", "a", candidatesA); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("join over the limit got %v", err)
+	}
+	// live sessions are still served
+	if _, err := c.Join("s1", "b", candidatesB); err != nil {
+		t.Errorf("join a live session: %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, err := c.CreateSession(); err != nil {
+		t.Errorf("create after expiry: %v", err)
+	}
+}
+
+func TestWaitPeer(t *testing.T) {
+	c := newTestClient(t, WithPunchDelay(time.Second))
+	if _, err := c.Join("sid", "a", candidatesA); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		c.Join("sid", "b", candidatesB)
+	}()
+	s, err := c.WaitPeer("sid", "b", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(s.Peers["b"].Candidates, candidatesB) || s.PunchAt == nil {
+		t.Errorf("got %+v", s)
+	}
+
+	if _, err := c.WaitPeer("sid", "nobody", time.Second); !errors.Is(err, ErrWaitTimeout) {
+		t.Errorf("waiting for an absent peer got %v", err)
+	}
+}
+
+func TestRegisterInvalidBody(t *testing.T) {
+	ts := httptest.NewServer(NewServer())
+	defer ts.Close()
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/sessions/sid/peers/a", strings.NewReader("{"))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %s", res.Status)
+	}
+}
@@ -0,0 +1,340 @@
+// Package socks5 implements UDP ASSOCIATE of SOCKS5 client as transport.Transport,
+// so that STUN probes are relayed by the proxy and see the NAT behavior of its egress.
+// see RFC 1928 and RFC 1929
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+)
+
+const (
+	version = 5
+
+	methodNoAuth   byte = 0x00
+	methodUserPass byte = 0x02
+
+	userPassVersion = 1
+
+	cmdUDPAssociate byte = 3
+
+	atypIPv4   byte = 1
+	atypDomain byte = 3
+	atypIPv6   byte = 4
+
+	defaultTimeout = 10 * time.Second
+	maxPacketSize  = 65535
+)
+
+var (
+	ErrNoAcceptableMethod = errors.New("socks5: no acceptable authentication method")
+	ErrAuthFailed         = errors.New("socks5: username/password authentication failed")
+	ErrRequestFailed      = errors.New("socks5: UDP ASSOCIATE failed")
+	errInvalidReply       = errors.New("socks5: invalid reply from proxy")
+	errUnsupportedAddress = errors.New("socks5: unsupported address type")
+)
+
+var replyMessages = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Transport opens sockets relayed by a SOCKS5 proxy, one association for each
+type Transport struct {
+	proxy    string
+	username string
+	password string
+	timeout  time.Duration
+}
+
+type Option func(t *Transport)
+
+// WithAuth authenticates to the proxy with username and password of RFC 1929
+func WithAuth(username, password string) Option {
+	return func(t *Transport) {
+		t.username = username
+		t.password = password
+	}
+}
+
+// WithTimeout sets how long to wait for the proxy to establish an association
+func WithTimeout(d time.Duration) Option {
+	return func(t *Transport) {
+		t.timeout = d
+	}
+}
+
+// NewTransport returns a transport through proxy, "host:port" of SOCKS5 server
+func NewTransport(proxy string, opts ...Option) *Transport {
+	t := &Transport{proxy: proxy, timeout: defaultTimeout}
+	for _, o := range opts {
+		o(t)
+	}
+	return t
+}
+
+func (t *Transport) String() string {
+	return "socks5://" + t.proxy
+}
+
+// ListenPacket binds a UDP socket to laddr, and associates it with the proxy
+// over a TCP connection from the IP address of laddr. the association lasts
+// until the socket is closed, or the proxy closes the TCP connection.
+func (t *Transport) ListenPacket(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	dialer := net.Dialer{Timeout: t.timeout}
+	if laddr != nil && laddr.IP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: laddr.IP}
+	}
+	ctrl, err := dialer.Dial("tcp", t.proxy)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Now().Add(t.timeout))
+	if err := t.negotiate(ctrl); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	relay, err := associate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		conn.Close()
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		// the relay listens on the address the request was accepted
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	ctrl.SetDeadline(time.Time{})
+	logger.Debug(fmt.Sprintf("associated %s with relay %s of %s", conn.LocalAddr(), relay, t.proxy))
+
+	c := &Conn{conn: conn, ctrl: ctrl, relay: relay, buf: make([]byte, maxPacketSize)}
+	go c.watch()
+	return c, nil
+}
+
+// negotiate chooses authentication method, and authenticates if required
+func (t *Transport) negotiate(ctrl net.Conn) error {
+	methods := []byte{methodNoAuth}
+	if t.username != "" {
+		methods = append(methods, methodUserPass)
+	}
+	if _, err := ctrl.Write(append([]byte{version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	res := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, res); err != nil {
+		return err
+	}
+	if res[0] != version {
+		return errInvalidReply
+	}
+	switch res[1] {
+	case methodNoAuth:
+		return nil
+	case methodUserPass:
+		if t.username == "" {
+			return ErrNoAcceptableMethod
+		}
+		return t.authenticate(ctrl)
+	default:
+		return ErrNoAcceptableMethod
+	}
+}
+
+// authenticate sends username and password as RFC 1929
+func (t *Transport) authenticate(ctrl net.Conn) error {
+	if len(t.username) > 255 || len(t.password) > 255 {
+		return ErrAuthFailed
+	}
+	req := []byte{userPassVersion, byte(len(t.username))}
+	req = append(req, t.username...)
+	req = append(req, byte(len(t.password)))
+	req = append(req, t.password...)
+	if _, err := ctrl.Write(req); err != nil {
+		return err
+	}
+	res := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, res); err != nil {
+		return err
+	}
+	if res[1] != 0 {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// associate requests UDP ASSOCIATE, and returns the relay address in the reply.
+// the client address is sent as all zeros, since the address the proxy sees
+// may differ from the local one when the client is behind NAT.
+func associate(ctrl net.Conn) (*net.UDPAddr, error) {
+	req := []byte{version, cmdUDPAssociate, 0, atypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := ctrl.Write(req); err != nil {
+		return nil, err
+	}
+	res := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, res); err != nil {
+		return nil, err
+	}
+	if res[0] != version {
+		return nil, errInvalidReply
+	}
+	if res[1] != 0 {
+		msg, ok := replyMessages[res[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply %d", res[1])
+		}
+		return nil, fmt.Errorf("%w: %s", ErrRequestFailed, msg)
+	}
+	return readAddr(ctrl)
+}
+
+// readAddr reads ATYP, address and port
+func readAddr(r io.Reader) (*net.UDPAddr, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return nil, err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case atypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, n[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		return nil, errUnsupportedAddress
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+}
+
+// Conn is a UDP socket whose datagrams are relayed by the proxy
+type Conn struct {
+	conn  *net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+
+	// buf is used by ReadFrom only, which must not be called concurrently
+	buf []byte
+
+	closeOnce sync.Once
+}
+
+// RelayAddr returns the address of the relay on the proxy datagrams are sent to
+func (c *Conn) RelayAddr() *net.UDPAddr {
+	return c.relay
+}
+
+// watch closes the socket when the proxy terminates the association
+func (c *Conn) watch() {
+	io.Copy(io.Discard, c.ctrl)
+	logger.Debug(fmt.Sprintf("association of %s with %s terminated", c.conn.LocalAddr(), c.relay))
+	c.Close()
+}
+
+// WriteTo sends b to addr through the relay with the header of RFC 1928 Section 7
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errUnsupportedAddress
+	}
+	header := []byte{0, 0, 0}
+	if ip4 := to.IP.To4(); ip4 != nil {
+		header = append(append(header, atypIPv4), ip4...)
+	} else {
+		header = append(append(header, atypIPv6), to.IP.To16()...)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(to.Port))
+	if _, err := c.conn.WriteTo(append(header, b...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom receives a datagram relayed from a remote host, and returns the
+// address of the remote host. datagrams not from the relay and fragments are dropped.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.conn.ReadFromUDP(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			logger.Debug(fmt.Sprintf("drop datagram from %s not through the relay", from))
+			continue
+		}
+		if n < 4 || c.buf[2] != 0 {
+			logger.Debug("drop fragmented or short datagram from the relay")
+			continue
+		}
+		r := bytes.NewReader(c.buf[3:n])
+		addr, err := readAddr(r)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("drop datagram from the relay: %s", err))
+			continue
+		}
+		return copy(b, c.buf[n-r.Len():n]), addr, nil
+	}
+}
+
+// Close closes the socket and the TCP connection, which terminates the association
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = errors.Join(c.conn.Close(), c.ctrl.Close())
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,317 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProxy is a SOCKS5 server which accepts UDP ASSOCIATE, and whose relay
+// answers each datagram with "echo:" and the payload as if it came from the destination
+type fakeProxy struct {
+	t     *testing.T
+	addr  string
+	relay *net.UDPConn
+
+	// username and password are required if set
+	username string
+	password string
+	// reply is REP of UDP ASSOCIATE
+	reply byte
+	// unspecified replies BND.ADDR 0.0.0.0 with the port of the relay
+	unspecified bool
+	// terminate closes the connection right after the association
+	terminate bool
+
+	mu      sync.Mutex
+	methods []byte
+}
+
+func newFakeProxy(t *testing.T, configure func(p *fakeProxy)) *fakeProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProxy{t: t, addr: ln.Addr().String(), relay: relay}
+	if configure != nil {
+		configure(p)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		relay.Close()
+	})
+	go func() {
+		for {
+			ctrl, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(ctrl)
+		}
+	}()
+	go p.serveRelay()
+	return p
+}
+
+func (p *fakeProxy) offered() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.methods
+}
+
+func (p *fakeProxy) serve(ctrl net.Conn) {
+	defer ctrl.Close()
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, head); err != nil || head[0] != version {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(ctrl, methods); err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.methods = methods
+	p.mu.Unlock()
+
+	want := methodNoAuth
+	if p.username != "" {
+		want = methodUserPass
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		ctrl.Write([]byte{version, 0xFF})
+		return
+	}
+	ctrl.Write([]byte{version, want})
+	if want == methodUserPass {
+		user, pass, ok := readUserPass(ctrl)
+		if !ok || user != p.username || pass != p.password {
+			ctrl.Write([]byte{userPassVersion, 1})
+			return
+		}
+		ctrl.Write([]byte{userPassVersion, 0})
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, req); err != nil || req[1] != cmdUDPAssociate {
+		return
+	}
+	if _, err := readAddr(ctrl); err != nil {
+		return
+	}
+	bnd := p.relay.LocalAddr().(*net.UDPAddr)
+	ip := bnd.IP.To4()
+	if p.unspecified {
+		ip = net.IPv4zero.To4()
+	}
+	res := append([]byte{version, p.reply, 0, atypIPv4}, ip...)
+	ctrl.Write(binary.BigEndian.AppendUint16(res, uint16(bnd.Port)))
+	if p.reply != 0 || p.terminate {
+		return
+	}
+	// the association lasts until the client closes the connection
+	io.Copy(io.Discard, ctrl)
+}
+
+func readUserPass(r io.Reader) (string, string, bool) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil || b[0] != userPassVersion {
+		return "", "", false
+	}
+	user := make([]byte, b[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", "", false
+	}
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return "", "", false
+	}
+	pass := make([]byte, b[0])
+	if _, err := io.ReadFull(r, pass); err != nil {
+		return "", "", false
+	}
+	return string(user), string(pass), true
+}
+
+// serveRelay echoes datagrams back to the client with the destination as the
+// source. "frag" is preceded by a fragment, which the client must drop.
+func (p *fakeProxy) serveRelay() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := p.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 4 || buf[0] != 0 || buf[1] != 0 || buf[2] != 0 {
+			p.t.Errorf("invalid UDP request header % x", buf[:min(n, 4)])
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		if _, err := readAddr(r); err != nil {
+			p.t.Errorf("invalid destination: %s", err)
+			continue
+		}
+		payload := buf[n-r.Len() : n]
+		header := append([]byte(nil), buf[:n-r.Len()]...)
+		if string(payload) == "frag" {
+			header[2] = 1
+			p.relay.WriteToUDP(append(header, "fragment"...), from)
+			header[2] = 0
+		}
+		p.relay.WriteToUDP(append(header, append([]byte("echo:"), payload...)...), from)
+	}
+}
+
+func listen(t *testing.T, p *fakeProxy, opts ...Option) *Conn {
+	t.Helper()
+	pc, err := NewTransport(p.addr, append(opts, WithTimeout(time.Second))...).ListenPacket("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc.(*Conn)
+}
+
+// roundTrip sends payload to dst through the relay, and returns the answer
+func roundTrip(t *testing.T, c *Conn, payload string, dst *net.UDPAddr) (string, net.Addr) {
+	t.Helper()
+	if n, err := c.WriteTo([]byte(payload), dst); err != nil || n != len(payload) {
+		t.Fatalf("WriteTo: %d, %v", n, err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n]), from
+}
+
+func TestNoAuth(t *testing.T) {
+	p := newFakeProxy(t, nil)
+	c := listen(t, p)
+
+	if got := p.offered(); !bytes.Equal(got, []byte{methodNoAuth}) {
+		t.Errorf("offered methods % x", got)
+	}
+	if c.RelayAddr().String() != p.relay.LocalAddr().String() {
+		t.Errorf("relay is %s, want %s", c.RelayAddr(), p.relay.LocalAddr())
+	}
+	for _, dst := range []*net.UDPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 3478},
+		{IP: net.ParseIP("2001:db8::1"), Port: 19302},
+	} {
+		data, from := roundTrip(t, c, "ping", dst)
+		if data != "echo:ping" || from.String() != dst.String() {
+			t.Errorf("got %q from %s, want from %s", data, from, dst)
+		}
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	p := newFakeProxy(t, nil)
+	pc, err := NewTransport(p.addr, WithTimeout(time.Second)).ListenPacket("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	// "udp" would bind the IPv6 wildcard address
+	if addr := pc.LocalAddr().(*net.UDPAddr); addr.IP.To4() == nil {
+		t.Errorf("udp4 socket is bound to %s", addr)
+	}
+}
+
+func TestUserPass(t *testing.T) {
+	p := newFakeProxy(t, func(p *fakeProxy) { p.username, p.password = "alice", "secret" })
+	c := listen(t, p, WithAuth("alice", "secret"))
+
+	if got := p.offered(); !bytes.Equal(got, []byte{methodNoAuth, methodUserPass}) {
+		t.Errorf("offered methods % x", got)
+	}
+	dst := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	if data, _ := roundTrip(t, c, "ping", dst); data != "echo:ping" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestNegotiationFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want error
+	}{
+		{"wrong password", []Option{WithAuth("alice", "wrong")}, ErrAuthFailed},
+		{"no credential", nil, ErrNoAcceptableMethod},
+	}
+	p := newFakeProxy(t, func(p *fakeProxy) { p.username, p.password = "alice", "secret" })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTransport(p.addr, append(tt.opts, WithTimeout(time.Second))...).ListenPacket("udp4", nil)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssociateErrorReply(t *testing.T) {
+	p := newFakeProxy(t, func(p *fakeProxy) { p.reply = 2 })
+	_, err := NewTransport(p.addr, WithTimeout(time.Second)).ListenPacket("udp4", nil)
+	if !errors.Is(err, ErrRequestFailed) || !strings.Contains(err.Error(), "connection not allowed by ruleset") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestUnspecifiedRelayAddress(t *testing.T) {
+	p := newFakeProxy(t, func(p *fakeProxy) { p.unspecified = true })
+	c := listen(t, p)
+
+	// the relay is on the address the TCP connection was accepted
+	if c.RelayAddr().String() != p.relay.LocalAddr().String() {
+		t.Errorf("relay is %s, want %s", c.RelayAddr(), p.relay.LocalAddr())
+	}
+	dst := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	if data, _ := roundTrip(t, c, "ping", dst); data != "echo:ping" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestReadFromDropsInvalidDatagrams(t *testing.T) {
+	p := newFakeProxy(t, nil)
+	c := listen(t, p)
+
+	stranger, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	// a datagram with a valid header, but not through the relay
+	header := []byte{0, 0, 0, atypIPv4, 192, 0, 2, 1, 0x0D, 0x96}
+	if _, err := stranger.WriteTo(append(header, "stranger"...), c.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	if data, _ := roundTrip(t, c, "frag", dst); data != "echo:frag" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestProxyTerminatesAssociation(t *testing.T) {
+	p := newFakeProxy(t, func(p *fakeProxy) { p.terminate = true })
+	c := listen(t, p)
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := c.ReadFrom(make([]byte, 1500)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom after termination: %v", err)
+	}
+}
@@ -40,30 +40,80 @@ const (
 	AttrUnknownAttributes AttributeType = 0x000A
 	// 0x000B: Reserved; was REFLECTED-FROM prior to [RFC5389]
 	AttrReflectedFrom AttributeType = 0x000B
+	// 0x000C: CHANNEL-NUMBER [RFC8656]
+	AttrChannelNumber AttributeType = 0x000C
+	// 0x000D: LIFETIME [RFC8656]
+	AttrLifetime AttributeType = 0x000D
+	// 0x0012: XOR-PEER-ADDRESS [RFC8656]
+	AttrXorPeerAddress AttributeType = 0x0012
+	// 0x0013: DATA [RFC8656]
+	AttrData AttributeType = 0x0013
 	// 0x0014: REALM
 	AttrRealm AttributeType = 0x0014
 	// 0x0015: NONCE
 	AttrNonce AttributeType = 0x0015
+	// 0x0016: XOR-RELAYED-ADDRESS [RFC8656]
+	AttrXorRelayedAddress AttributeType = 0x0016
+	// 0x0019: REQUESTED-TRANSPORT [RFC8656]
+	AttrRequestedTransport AttributeType = 0x0019
 	// 0x0020: XOR-MAPPED-ADDRESS
 	AttrXorMappedAddress AttributeType = 0x0020
+	// 0x0024: PRIORITY [RFC8445]
+	AttrPriority AttributeType = 0x0024
+	// 0x0025: USE-CANDIDATE [RFC8445]
+	AttrUseCandidate AttributeType = 0x0025
+	// 0x0026: PADDING [RFC5780]
+	AttrPadding AttributeType = 0x0026
+	// 0x0027: RESPONSE-PORT [RFC5780]
+	AttrResponsePort AttributeType = 0x0027
+
+	// Comprehension-optional range (0x8000-0xFFFF)
+	// 0x802B: RESPONSE-ORIGIN [RFC5780]
+	AttrResponseOrigin AttributeType = 0x802B
+	// 0x802C: OTHER-ADDRESS [RFC5780]
+	AttrOtherAddress AttributeType = 0x802C
+	// 0x8022: SOFTWARE
+	AttrSoftware AttributeType = 0x8022
+	// 0x8028: FINGERPRINT
+	AttrFingerprint AttributeType = 0x8028
+	// 0x8029: ICE-CONTROLLED [RFC8445]
+	AttrICEControlled AttributeType = 0x8029
+	// 0x802A: ICE-CONTROLLING [RFC8445]
+	AttrICEControlling AttributeType = 0x802A
 )
 
 var attrTypes map[AttributeType]string = map[AttributeType]string{
-	AttrReserved:          "Reserved",
-	AttrMappedAddress:     "MAPPED-ADDRESS",
-	AttrResponseAddress:   "RESPONSE-ADDRESS",
-	AttrCahngeRequest:     "CHANGE-REQUEST",
-	AttrSourceAddress:     "SOURCE-ADDRESS",
-	AttrChangedAddress:    "CHANGED-ADDRESS",
-	AttrUsername:          "USERNAME",
-	AttrPassword:          "PASSWORD",
-	AttrMessageIntegrity:  "MESSAGE-INTEGRITY",
-	AttrErrorCode:         "ERROR-CODE",
-	AttrUnknownAttributes: "UNKNOWN-ATTRIBUTES",
-	AttrReflectedFrom:     "REFLECTED-FROM",
-	AttrRealm:             "REALM",
-	AttrNonce:             "NONCE",
-	AttrXorMappedAddress:  "XOR-MAPPED-ADDRESS",
+	AttrReserved:           "Reserved",
+	AttrMappedAddress:      "MAPPED-ADDRESS",
+	AttrResponseAddress:    "RESPONSE-ADDRESS",
+	AttrCahngeRequest:      "CHANGE-REQUEST",
+	AttrSourceAddress:      "SOURCE-ADDRESS",
+	AttrChangedAddress:     "CHANGED-ADDRESS",
+	AttrUsername:           "USERNAME",
+	AttrPassword:           "PASSWORD",
+	AttrMessageIntegrity:   "MESSAGE-INTEGRITY",
+	AttrErrorCode:          "ERROR-CODE",
+	AttrUnknownAttributes:  "UNKNOWN-ATTRIBUTES",
+	AttrReflectedFrom:      "REFLECTED-FROM",
+	AttrChannelNumber:      "CHANNEL-NUMBER",
+	AttrLifetime:           "LIFETIME",
+	AttrXorPeerAddress:     "XOR-PEER-ADDRESS",
+	AttrData:               "DATA",
+	AttrRealm:              "REALM",
+	AttrNonce:              "NONCE",
+	AttrXorRelayedAddress:  "XOR-RELAYED-ADDRESS",
+	AttrRequestedTransport: "REQUESTED-TRANSPORT",
+	AttrXorMappedAddress:   "XOR-MAPPED-ADDRESS",
+	AttrPriority:           "PRIORITY",
+	AttrUseCandidate:       "USE-CANDIDATE",
+	AttrPadding:            "PADDING",
+	AttrResponsePort:       "RESPONSE-PORT",
+	AttrResponseOrigin:     "RESPONSE-ORIGIN",
+	AttrOtherAddress:       "OTHER-ADDRESS",
+	AttrSoftware:           "SOFTWARE",
+	AttrFingerprint:        "FINGERPRINT",
+	AttrICEControlled:      "ICE-CONTROLLED",
+	AttrICEControlling:     "ICE-CONTROLLING",
 }
 
 type TypedValue interface {
@@ -86,15 +136,28 @@ type Attribute struct {
 	Value  []byte
 }
 
-func (atts Attributes) Add(t AttributeType, v []byte) {
+func (atts *Attributes) Add(t AttributeType, v []byte) {
 	a := Attribute{
 		Type:   t,
 		Length: uint16(len(v)),
 		Value:  v,
 	}
-	atts = append(atts, a)
+	*atts = append(*atts, a)
+}
+
+// encodedLength returns the byte length of encoded attributes including padding
+func (atts Attributes) encodedLength() uint16 {
+	var l uint16
+	for _, a := range atts {
+		l += 4 + a.Length // Type and Length
+		if a.Length%AttrBoundaryByte != 0 {
+			l += AttrBoundaryByte - (a.Length % AttrBoundaryByte)
+		}
+	}
+	return l
 }
 
+// Extract returns the first attribute of attrType
 func (atts Attributes) Extract(attrType AttributeType) (attr Attribute, exist bool) {
 	if len(atts) > 0 {
 		for _, v := range atts {
@@ -111,6 +174,27 @@ const (
 	ipv6 = 0x02
 )
 
+// checkAddressLength checks the value of an address attribute is long enough
+// for its family, the value is untrusted input from the peer
+func checkAddressLength(v []byte) error {
+	if len(v) < 4 {
+		return errors.New("is too short")
+	}
+	var want int
+	switch v[1] {
+	case ipv4:
+		want = 8
+	case ipv6:
+		want = 20
+	default:
+		return fmt.Errorf("has unknown family %#x", v[1])
+	}
+	if len(v) < want {
+		return fmt.Errorf("is too short for family %#x: %d bytes", v[1], len(v))
+	}
+	return nil
+}
+
 type MappedAddress struct {
 
 	// 	0                   1                   2                   3
@@ -132,6 +216,9 @@ func (ma MappedAddress) Parse(attr Attribute) error {
 	if attr.Type != AttrMappedAddress {
 		return errors.New("type is not MAPPED-ADDRESS")
 	}
+	if err := checkAddressLength(attr.Value); err != nil {
+		return fmt.Errorf("MAPPED-ADDRESS %w", err)
+	}
 	index := 1 // except Reserved area
 	ma.Family = attr.Value[index]
 	logger.Info(fmt.Sprintf("MAPPED-ADDRESS Family: %X\n", ma.Family))
@@ -170,10 +257,15 @@ type XORMappedAddress struct {
 	Port    uint16
 }
 
+// Parse parses XOR-MAPPED-ADDRESS, or XOR-PEER-ADDRESS and XOR-RELAYED-ADDRESS
+// of TURN which have the same format
 func (xa *XORMappedAddress) Parse(attr Attribute, tid TransactionID) error {
-	if attr.Type != AttrXorMappedAddress {
+	if attr.Type != AttrXorMappedAddress && attr.Type != AttrXorPeerAddress && attr.Type != AttrXorRelayedAddress {
 		return errors.New("type is not XOR-MAPPED-ADDRESS")
 	}
+	if err := checkAddressLength(attr.Value); err != nil {
+		return fmt.Errorf("XOR-MAPPED-ADDRESS %w", err)
+	}
 	index := 1 // except Reserved area
 	xa.Family = attr.Value[index]
 	logger.Info(fmt.Sprintf("XOR-MAPPED-ADDRESS Family: %X\n", xa.Family))
@@ -207,6 +299,31 @@ func (xa *XORMappedAddress) Parse(attr Attribute, tid TransactionID) error {
 	return nil
 }
 
+// Encode returns value of XOR-MAPPED-ADDRESS, the family is chosen from Address
+func (xa XORMappedAddress) Encode(tid TransactionID) []byte {
+	var v []byte
+	if ip4 := xa.Address.To4(); ip4 != nil {
+		v = make([]byte, 8)
+		v[1] = ipv4
+		binary.BigEndian.PutUint32(v[4:], binary.BigEndian.Uint32(ip4)^MagicCookie)
+	} else {
+		v = make([]byte, 20)
+		v[1] = ipv6
+		var comparison [16]byte
+		binary.BigEndian.PutUint32(comparison[:4], MagicCookie)
+		copy(comparison[4:], tid[:])
+		addr := xor128(([16]byte)(xa.Address.To16()), comparison)
+		copy(v[4:], addr[:])
+	}
+	binary.BigEndian.PutUint16(v[2:4], xa.Port^uint16(MagicCookie>>16))
+	return v
+}
+
+// UDPAddr returns the address and port as net.UDPAddr
+func (xa XORMappedAddress) UDPAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: xa.Address, Port: int(xa.Port)}
+}
+
 // xor128 performs XOR operation on two 128-bit values represented as [16]byte
 func xor128(a, b [16]byte) [16]byte {
 	var result [16]byte
@@ -215,3 +332,238 @@ func xor128(a, b [16]byte) [16]byte {
 	}
 	return result
 }
+
+type ResponsePort struct {
+
+	// 	0                   1                   2                   3
+	// 	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |             Port              |          Padding              |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	Port uint16
+}
+
+// Encode returns value of RESPONSE-PORT attribute
+func (rp ResponsePort) Encode() []byte {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint16(v[:2], rp.Port)
+	return v
+}
+
+func (rp *ResponsePort) Parse(attr Attribute) error {
+	if attr.Type != AttrResponsePort {
+		return errors.New("type is not RESPONSE-PORT")
+	}
+	if len(attr.Value) < 2 {
+		return errors.New("RESPONSE-PORT is too short")
+	}
+	rp.Port = binary.BigEndian.Uint16(attr.Value[:2])
+	return nil
+}
+
+// ErrorCode is ERROR-CODE attribute, it is also returned as error
+// when the server answered with error response
+type ErrorCode struct {
+
+	// 	0                   1                   2                   3
+	// 	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |           Reserved, should be 0         |Class|     Number    |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |      Reason Phrase (variable)                                ..
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	Code   int
+	Reason string
+}
+
+const (
+	CodeTryAlternate                 = 300
+	CodeBadRequest                   = 400
+	CodeUnauthorized                 = 401
+	CodeForbidden                    = 403
+	CodeUnknownAttribute             = 420
+	CodeAllocationMismatch           = 437
+	CodeStaleNonce                   = 438
+	CodeAddressFamilyNotSupported    = 440
+	CodeWrongCredentials             = 441
+	CodeUnsupportedTransportProtocol = 442
+	CodeAllocationQuotaReached       = 486
+	CodeRoleConflict                 = 487
+	CodeServerError                  = 500
+	CodeInsufficientCapacity         = 508
+)
+
+func (ec ErrorCode) Error() string {
+	return fmt.Sprintf("STUN error %d %s", ec.Code, ec.Reason)
+}
+
+// Encode returns value of ERROR-CODE attribute
+func (ec ErrorCode) Encode() []byte {
+	v := make([]byte, 4, 4+len(ec.Reason))
+	v[2] = byte(ec.Code / 100)
+	v[3] = byte(ec.Code % 100)
+	return append(v, ec.Reason...)
+}
+
+func (ec *ErrorCode) Parse(attr Attribute) error {
+	if attr.Type != AttrErrorCode {
+		return errors.New("type is not ERROR-CODE")
+	}
+	if len(attr.Value) < 4 {
+		return errors.New("ERROR-CODE is too short")
+	}
+	ec.Code = int(attr.Value[2]&0x07)*100 + int(attr.Value[3])
+	ec.Reason = string(attr.Value[4:])
+	return nil
+}
+
+// Lifetime is LIFETIME attribute of TURN in seconds
+type Lifetime struct {
+	Seconds uint32
+}
+
+// Encode returns value of LIFETIME attribute
+func (l Lifetime) Encode() []byte {
+	return binary.BigEndian.AppendUint32(nil, l.Seconds)
+}
+
+func (l *Lifetime) Parse(attr Attribute) error {
+	if attr.Type != AttrLifetime {
+		return errors.New("type is not LIFETIME")
+	}
+	if len(attr.Value) < 4 {
+		return errors.New("LIFETIME is too short")
+	}
+	l.Seconds = binary.BigEndian.Uint32(attr.Value)
+	return nil
+}
+
+// protocol numbers of REQUESTED-TRANSPORT
+const (
+	TransportUDP uint8 = 17
+)
+
+// RequestedTransport is REQUESTED-TRANSPORT attribute of TURN
+type RequestedTransport struct {
+
+	// 	0                   1                   2                   3
+	// 	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |    Protocol   |                    RFFU                       |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	Protocol uint8
+}
+
+// Encode returns value of REQUESTED-TRANSPORT attribute
+func (rt RequestedTransport) Encode() []byte {
+	return []byte{rt.Protocol, 0, 0, 0}
+}
+
+func (rt *RequestedTransport) Parse(attr Attribute) error {
+	if attr.Type != AttrRequestedTransport {
+		return errors.New("type is not REQUESTED-TRANSPORT")
+	}
+	if len(attr.Value) < 1 {
+		return errors.New("REQUESTED-TRANSPORT is too short")
+	}
+	rt.Protocol = attr.Value[0]
+	return nil
+}
+
+// ChannelNumber is CHANNEL-NUMBER attribute of TURN
+type ChannelNumber struct {
+
+	// 	0                   1                   2                   3
+	// 	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	//  |        Channel Number         |         RFFU = 0              |
+	//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	Number uint16
+}
+
+// Encode returns value of CHANNEL-NUMBER attribute
+func (cn ChannelNumber) Encode() []byte {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint16(v[:2], cn.Number)
+	return v
+}
+
+func (cn *ChannelNumber) Parse(attr Attribute) error {
+	if attr.Type != AttrChannelNumber {
+		return errors.New("type is not CHANNEL-NUMBER")
+	}
+	if len(attr.Value) < 2 {
+		return errors.New("CHANNEL-NUMBER is too short")
+	}
+	cn.Number = binary.BigEndian.Uint16(attr.Value[:2])
+	return nil
+}
+
+// Priority is PRIORITY attribute of ICE, the priority a peer reflexive
+// candidate discovered by the check would have
+type Priority struct {
+	Value uint32
+}
+
+// Encode returns value of PRIORITY attribute
+func (p Priority) Encode() []byte {
+	return binary.BigEndian.AppendUint32(nil, p.Value)
+}
+
+func (p *Priority) Parse(attr Attribute) error {
+	if attr.Type != AttrPriority {
+		return errors.New("type is not PRIORITY")
+	}
+	if len(attr.Value) < 4 {
+		return errors.New("PRIORITY is too short")
+	}
+	p.Value = binary.BigEndian.Uint32(attr.Value)
+	return nil
+}
+
+// ICEControl is ICE-CONTROLLING or ICE-CONTROLLED attribute,
+// which carries the role of the sender and its tie-breaker
+type ICEControl struct {
+	Controlling bool
+	TieBreaker  uint64
+}
+
+// Type returns ICE-CONTROLLING or ICE-CONTROLLED depending on the role
+func (c ICEControl) Type() AttributeType {
+	if c.Controlling {
+		return AttrICEControlling
+	}
+	return AttrICEControlled
+}
+
+// Encode returns value of the attribute
+func (c ICEControl) Encode() []byte {
+	return binary.BigEndian.AppendUint64(nil, c.TieBreaker)
+}
+
+func (c *ICEControl) Parse(attr Attribute) error {
+	if attr.Type != AttrICEControlling && attr.Type != AttrICEControlled {
+		return errors.New("type is not ICE-CONTROLLING nor ICE-CONTROLLED")
+	}
+	if len(attr.Value) < 8 {
+		return errors.New("ICE-CONTROLLING/ICE-CONTROLLED is too short")
+	}
+	c.Controlling = attr.Type == AttrICEControlling
+	c.TieBreaker = binary.BigEndian.Uint64(attr.Value)
+	return nil
+}
+
+// ExtractICEControl returns ICE-CONTROLLING or ICE-CONTROLLED of atts
+func (atts Attributes) ExtractICEControl() (ICEControl, bool) {
+	c := ICEControl{}
+	for _, t := range []AttributeType{AttrICEControlling, AttrICEControlled} {
+		if attr, ok := atts.Extract(t); ok {
+			return c, c.Parse(attr) == nil
+		}
+	}
+	return c, false
+}
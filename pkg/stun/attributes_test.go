@@ -0,0 +1,51 @@
+package stun_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ek-170/myroute/pkg/stun"
+)
+
+func TestXORMappedAddressRoundTrip(t *testing.T) {
+	tid := stun.TransactionID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	for _, ip := range []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")} {
+		in := stun.XORMappedAddress{Address: ip, Port: 54321}
+		v := in.Encode(tid)
+		var out stun.XORMappedAddress
+		if err := out.Parse(stun.Attribute{Type: stun.AttrXorMappedAddress, Length: uint16(len(v)), Value: v}, tid); err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		if !out.Address.Equal(ip) || out.Port != in.Port {
+			t.Errorf("got %s:%d, want %s:%d", out.Address, out.Port, ip, in.Port)
+		}
+	}
+}
+
+func TestXORMappedAddressParseInvalid(t *testing.T) {
+	// a longer backing array must not be read past the value
+	buf := make([]byte, 64)
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{"empty", nil},
+		{"header only", []byte{0, 0x01, 0, 0}},
+		{"ipv4 truncated", []byte{0, 0x01, 0, 0, 1, 2, 3}},
+		{"ipv6 with ipv4 length", []byte{0, 0x02, 0, 0, 1, 2, 3, 4}},
+		{"ipv6 truncated", make([]byte, 19)},
+		{"ipv6 truncated with capacity", append(buf[:0], 0, 0x02, 0, 0, 1, 2, 3, 4)},
+		{"unknown family", []byte{0, 0x03, 0, 0, 1, 2, 3, 4}},
+		{"zero family", make([]byte, 20)},
+	}
+	tests[4].value[1] = 0x02
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var xa stun.XORMappedAddress
+			attr := stun.Attribute{Type: stun.AttrXorPeerAddress, Length: uint16(len(tt.value)), Value: tt.value}
+			if err := xa.Parse(attr, stun.TransactionID{}); err == nil {
+				t.Errorf("Parse(%x) succeeded with %s:%d", tt.value, xa.Address, xa.Port)
+			}
+		})
+	}
+}
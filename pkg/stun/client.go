@@ -6,6 +6,8 @@ import (
 	"net"
 	"net/url"
 	"time"
+
+	"github.com/ek-170/myroute/pkg/transport"
 )
 
 const (
@@ -14,9 +16,29 @@ const (
 )
 
 type Client struct {
-	conn     net.Conn
+	conn  net.PacketConn
+	laddr *net.UDPAddr
+	raddr *net.UDPAddr
+	clientOptions
+}
+
+type clientOptions struct {
+	lport    int
 	maxRetry uint8
 	timeout  time.Duration
+	// transport opens sockets, transport.UDP if nil
+	transport transport.Transport
+}
+
+func defaultClientOptions(opts []ClientOption) clientOptions {
+	o := clientOptions{
+		maxRetry: defaultMaxRetry,
+		timeout:  defaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
 
 var (
@@ -27,9 +49,13 @@ func NewClient(url url.URL, lip net.IP, opts ...ClientOption) (Client, error) {
 	// TODO add support ipv6
 	const network = "udp4"
 
+	c := Client{
+		clientOptions: defaultClientOptions(opts),
+	}
+
 	laddr := &net.UDPAddr{
 		IP:   lip,
-		Port: 0,
+		Port: c.lport,
 	}
 
 	raddr, err := net.ResolveUDPAddr(network, url.Host)
@@ -37,40 +63,52 @@ func NewClient(url url.URL, lip net.IP, opts ...ClientOption) (Client, error) {
 		return Client{}, err
 	}
 
-	fmt.Println("start to STUN request")
-	fmt.Printf("%s:%d -> %s\n", laddr.IP, laddr.Port, url.Host)
-
-	conn, err := net.DialUDP(network, laddr, raddr)
+	conn, local, err := transport.Listen(c.transport, network, laddr)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{
-		conn:     conn,
-		maxRetry: defaultMaxRetry,
-		timeout:  defaultTimeout,
-	}
-	if len(opts) > 0 {
-		for _, o := range opts {
-			o(&c)
-		}
-	}
+	c.conn, c.laddr = conn, local
+	c.raddr = raddr
+
+	fmt.Println("start to STUN request")
+	fmt.Printf("%s -> %s\n", conn.LocalAddr(), url.Host)
 	return c, nil
 }
 
-type ClientOption func(c *Client)
+type ClientOption func(c *clientOptions)
 
 func WithMaxRetry(maxRetry uint8) ClientOption {
-	return func(c *Client) {
+	return func(c *clientOptions) {
 		c.maxRetry = maxRetry
 	}
 }
 
 func WithTimeout(timeout time.Duration) ClientOption {
-	return func(c *Client) {
+	return func(c *clientOptions) {
 		c.timeout = timeout
 	}
 }
 
+// WithTransport opens the socket of the client with t instead of the host network stack
+func WithTransport(t transport.Transport) ClientOption {
+	return func(c *clientOptions) {
+		c.transport = t
+	}
+}
+
+// WithLocalPort binds the client to the specified local port.
+// 0 means the port is chosen by OS.
+func WithLocalPort(port int) ClientOption {
+	return func(c *clientOptions) {
+		c.lport = port
+	}
+}
+
+// LocalAddr returns the local address the client is bound to
+func (c Client) LocalAddr() *net.UDPAddr {
+	return c.laddr
+}
+
 // Do send STUN request, and wait for recieving response
 func (c Client) Do(msg *Message) (*Message, error) {
 	req, err := msg.Encode()
@@ -81,7 +119,7 @@ func (c Client) Do(msg *Message) (*Message, error) {
 	writeRetry := 0
 	for {
 		c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.timeout)))
-		_, err = c.conn.Write(req)
+		_, err = c.conn.WriteTo(req, c.raddr)
 		if err != nil {
 			if writeRetry < int(c.maxRetry) {
 				return nil, err
@@ -97,7 +135,12 @@ func (c Client) Do(msg *Message) (*Message, error) {
 	readRetry := 0
 	for {
 		c.conn.SetReadDeadline(time.Now().Add(time.Duration(c.timeout)))
-		_, err = c.conn.Read(packet)
+		var from net.Addr
+		_, from, err = c.conn.ReadFrom(packet)
+		if err == nil && from.String() != c.raddr.String() {
+			// the socket is not connected, packets from others are ignored
+			continue
+		}
 		if err != nil {
 			if readRetry < int(c.maxRetry) {
 				return nil, err
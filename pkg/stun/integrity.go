@@ -0,0 +1,101 @@
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+const (
+	messageIntegrityByte = 20
+	fingerprintByte      = 4
+	fingerprintXOR       = 0x5354554e
+)
+
+var (
+	ErrIntegrityMismatch   = errors.New("MESSAGE-INTEGRITY does not match")
+	ErrFingerprintMismatch = errors.New("FINGERPRINT does not match")
+	errNoIntegrity         = errors.New("MESSAGE-INTEGRITY is not found")
+	errNoFingerprint       = errors.New("FINGERPRINT is not found")
+)
+
+// LongTermKey returns the key of long-term credential mechanism,
+// MD5(username ":" realm ":" password) of RFC 8489 Section 9.2.2
+func LongTermKey(username, realm, password string) []byte {
+	h := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return h[:]
+}
+
+// AddIntegrity appends MESSAGE-INTEGRITY computed with key.
+// it must be the last attribute added to the message.
+func (m *Message) AddIntegrity(key []byte) error {
+	b, err := m.Encode()
+	if err != nil {
+		return err
+	}
+	// the length covers MESSAGE-INTEGRITY itself when HMAC is computed
+	binary.BigEndian.PutUint16(b[2:4], m.Length+4+messageIntegrityByte)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(b)
+	m.Attributes.Add(AttrMessageIntegrity, mac.Sum(nil))
+	return nil
+}
+
+// CheckIntegrity verifies MESSAGE-INTEGRITY of the decoded message with key.
+// attributes after MESSAGE-INTEGRITY, e.g. FINGERPRINT, are not covered.
+func (m *Message) CheckIntegrity(key []byte) error {
+	if len(m.raw) < HeaderByte {
+		return errNoIntegrity
+	}
+	index := HeaderByte
+	for index+4 <= len(m.raw) {
+		t := AttributeType(binary.BigEndian.Uint16(m.raw[index : index+2]))
+		l := int(binary.BigEndian.Uint16(m.raw[index+2 : index+4]))
+		if t != AttrMessageIntegrity {
+			index += 4 + l + (AttrBoundaryByte-l%AttrBoundaryByte)%AttrBoundaryByte
+			continue
+		}
+		if l != messageIntegrityByte || index+4+l > len(m.raw) {
+			return ErrIntegrityMismatch
+		}
+		covered := append([]byte(nil), m.raw[:index]...)
+		binary.BigEndian.PutUint16(covered[2:4], uint16(index-HeaderByte+4+messageIntegrityByte))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(covered)
+		if !hmac.Equal(mac.Sum(nil), m.raw[index+4:index+4+l]) {
+			return ErrIntegrityMismatch
+		}
+		return nil
+	}
+	return errNoIntegrity
+}
+
+// AddFingerprint appends FINGERPRINT of RFC 8489 Section 14.7,
+// it must be added after MESSAGE-INTEGRITY
+func (m *Message) AddFingerprint() error {
+	b, err := m.Encode()
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(b[2:4], m.Length+4+fingerprintByte)
+	m.Attributes.Add(AttrFingerprint, binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(b)^fingerprintXOR))
+	return nil
+}
+
+// CheckFingerprint verifies FINGERPRINT of the decoded message,
+// which must be the last attribute
+func (m *Message) CheckFingerprint() error {
+	index := len(m.raw) - 4 - fingerprintByte
+	if index < HeaderByte || AttributeType(binary.BigEndian.Uint16(m.raw[index:index+2])) != AttrFingerprint {
+		return errNoFingerprint
+	}
+	covered := append([]byte(nil), m.raw[:index]...)
+	binary.BigEndian.PutUint16(covered[2:4], uint16(index-HeaderByte+4+fingerprintByte))
+	if binary.BigEndian.Uint32(m.raw[index+4:]) != crc32.ChecksumIEEE(covered)^fingerprintXOR {
+		return ErrFingerprintMismatch
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/transport"
+)
+
+var (
+	ErrNoResponse = errors.New("no response from STUN server")
+)
+
+// PacketClient is a STUN client bound to a single local socket.
+// unlike Client, it is not connected to any server, and sends requests to
+// multiple destinations via WriteTo, so that every request shares the same
+// internal transport address as RFC 4787 mapping tests require.
+type PacketClient struct {
+	conn  net.PacketConn
+	laddr *net.UDPAddr
+	clientOptions
+}
+
+// NewPacketClient binds a UDP socket to lip and the port given by WithLocalPort.
+// if the port is not specified, it is chosen by OS, or by the transport given by WithTransport.
+func NewPacketClient(lip net.IP, opts ...ClientOption) (*PacketClient, error) {
+	network := "udp4"
+	if lip != nil && lip.To4() == nil {
+		network = "udp6"
+	}
+
+	c := &PacketClient{
+		clientOptions: defaultClientOptions(opts),
+	}
+	laddr := &net.UDPAddr{
+		IP:   lip,
+		Port: c.lport,
+	}
+	conn, local, err := transport.Listen(c.transport, network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	c.conn, c.laddr = conn, local
+	logger.Debug(fmt.Sprintf("bound local socket: %s", conn.LocalAddr()))
+	return c, nil
+}
+
+// LocalAddr returns the local address the client is bound to
+func (c *PacketClient) LocalAddr() *net.UDPAddr {
+	return c.laddr
+}
+
+// Do sends STUN request to raddr, and waits for the response which has the
+// same transaction ID. the request is retransmitted on each timeout up to maxRetry.
+// it returns the response and the address the response came from.
+func (c *PacketClient) Do(msg *Message, raddr net.Addr) (*Message, net.Addr, error) {
+	req, err := msg.Encode()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger.Debug(fmt.Sprintf("start to STUN request %s -> %s", c.conn.LocalAddr(), raddr))
+
+	packet := make([]byte, 1500)
+	for attempt := 0; attempt <= int(c.maxRetry); attempt++ {
+		if attempt > 0 {
+			logger.Debug(fmt.Sprintf("retransmit request to %s (%d/%d)", raddr, attempt, c.maxRetry))
+		}
+		if err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+			return nil, nil, err
+		}
+		if _, err := c.conn.WriteTo(req, raddr); err != nil {
+			return nil, nil, err
+		}
+
+		deadline := time.Now().Add(c.timeout)
+		if err := c.conn.SetReadDeadline(deadline); err != nil {
+			return nil, nil, err
+		}
+		for {
+			n, from, err := c.conn.ReadFrom(packet)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				return nil, nil, err
+			}
+			res := Message{}
+			if err := res.Decode(packet[:n]); err != nil {
+				logger.Debug(fmt.Sprintf("ignore non STUN packet from %s: %s", from, err))
+				continue
+			}
+			if res.TransactionID != msg.TransactionID {
+				logger.Debug(fmt.Sprintf("ignore STUN message of another transaction from %s", from))
+				continue
+			}
+			return &res, from, nil
+		}
+	}
+	return nil, nil, ErrNoResponse
+}
+
+// Send sends STUN message to raddr without waiting for any response
+func (c *PacketClient) Send(msg *Message, raddr net.Addr) error {
+	b, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	_, err = c.conn.WriteTo(b, raddr)
+	return err
+}
+
+// Receive waits for the next STUN message until timeout elapses,
+// and returns it with the address it came from. non STUN packets are ignored.
+func (c *PacketClient) Receive(timeout time.Duration) (*Message, net.Addr, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, err
+	}
+	packet := make([]byte, 1500)
+	for {
+		n, from, err := c.conn.ReadFrom(packet)
+		if err != nil {
+			return nil, nil, err
+		}
+		msg := Message{}
+		if err := msg.Decode(packet[:n]); err != nil {
+			logger.Debug(fmt.Sprintf("ignore non STUN packet from %s: %s", from, err))
+			continue
+		}
+		return &msg, from, nil
+	}
+}
+
+func (c *PacketClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,100 @@
+package stun_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/stun"
+	"github.com/ek-170/myroute/pkg/transport"
+	"github.com/ek-170/myroute/pkg/turn"
+)
+
+var (
+	clientAddr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	serverAddr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 3478}
+)
+
+// pipeClient returns a client on one end of transport.Pipe, and the other end
+func pipeClient(t *testing.T, opts ...stun.ClientOption) (*stun.PacketClient, *transport.Conn) {
+	t.Helper()
+	client, peer := transport.Pipe(clientAddr, serverAddr)
+	c, err := stun.NewPacketClient(nil, append(opts, stun.WithTransport(transport.Func(func(string, *net.UDPAddr) (net.PacketConn, error) {
+		return client, nil
+	})))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, peer
+}
+
+func TestPacketClientDo(t *testing.T) {
+	c, peer := pipeClient(t)
+	server := turn.NewServer(peer)
+	go server.Serve()
+	defer server.Close()
+
+	if c.LocalAddr().String() != clientAddr.String() {
+		t.Errorf("local address = %s", c.LocalAddr())
+	}
+	res, from, err := c.Do(stun.NewMessage(stun.BindingReq), serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Type != stun.BindingRes || from.String() != serverAddr.String() {
+		t.Errorf("got %04X from %s", uint16(res.Type), from)
+	}
+	attr, ok := res.Attributes.Extract(stun.AttrXorMappedAddress)
+	if !ok {
+		t.Fatal("XOR-MAPPED-ADDRESS is missing")
+	}
+	mapped := stun.XORMappedAddress{}
+	if err := mapped.Parse(attr, res.TransactionID); err != nil {
+		t.Fatal(err)
+	}
+	if mapped.UDPAddr().String() != clientAddr.String() {
+		t.Errorf("mapped to %s, want %s", mapped.UDPAddr(), clientAddr)
+	}
+}
+
+func TestPacketClientIgnoresOtherTransactions(t *testing.T) {
+	c, peer := pipeClient(t, stun.WithTimeout(100*time.Millisecond), stun.WithMaxRetry(0))
+	go func() {
+		buf := make([]byte, 1500)
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := peer.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := stun.Message{}
+		if err := req.Decode(buf[:n]); err != nil {
+			return
+		}
+		// garbage and a response of another transaction come first
+		peer.WriteTo([]byte("not STUN"), from)
+		other, _ := stun.NewMessage(stun.BindingRes).Encode()
+		peer.WriteTo(other, from)
+		res := stun.NewMessage(stun.BindingRes)
+		res.TransactionID = req.TransactionID
+		b, _ := res.Encode()
+		peer.WriteTo(b, from)
+	}()
+
+	req := stun.NewMessage(stun.BindingReq)
+	res, _, err := c.Do(req, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.TransactionID != req.TransactionID {
+		t.Error("response of another transaction was returned")
+	}
+}
+
+func TestPacketClientNoResponse(t *testing.T) {
+	c, _ := pipeClient(t, stun.WithTimeout(20*time.Millisecond), stun.WithMaxRetry(1))
+	if _, _, err := c.Do(stun.NewMessage(stun.BindingReq), serverAddr); !errors.Is(err, stun.ErrNoResponse) {
+		t.Errorf("got %v, want %v", err, stun.ErrNoResponse)
+	}
+}
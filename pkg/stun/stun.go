@@ -46,8 +46,41 @@ const (
 
 	BindingReq STUNRequest = 0x0001
 	BindingRes STUNRequest = 0x0101
+	BindingErr STUNRequest = 0x0111
+
+	// TURN methods of RFC 8656
+	AllocateReq         STUNRequest = 0x0003
+	AllocateRes         STUNRequest = 0x0103
+	AllocateErr         STUNRequest = 0x0113
+	RefreshReq          STUNRequest = 0x0004
+	RefreshRes          STUNRequest = 0x0104
+	RefreshErr          STUNRequest = 0x0114
+	SendInd             STUNRequest = 0x0016
+	DataInd             STUNRequest = 0x0017
+	CreatePermissionReq STUNRequest = 0x0008
+	CreatePermissionRes STUNRequest = 0x0108
+	CreatePermissionErr STUNRequest = 0x0118
+	ChannelBindReq      STUNRequest = 0x0009
+	ChannelBindRes      STUNRequest = 0x0109
+	ChannelBindErr      STUNRequest = 0x0119
 )
 
+const (
+	classMask    STUNRequest = 0x0110
+	classSuccess STUNRequest = 0x0100
+	classError   STUNRequest = 0x0110
+)
+
+// IsSuccess reports whether t is success response of any method
+func (t STUNRequest) IsSuccess() bool {
+	return t&classMask == classSuccess
+}
+
+// IsError reports whether t is error response of any method
+func (t STUNRequest) IsError() bool {
+	return t&classMask == classError
+}
+
 // Message represents STUN message
 // see more detail: https://tex2e.github.io/rfc-translater/html/rfc8489.html#5--STUN-Message-Structure
 type Message struct {
@@ -69,6 +102,9 @@ type Message struct {
 	Cookie        uint32        // must be fixed value: 0x2112A442
 	TransactionID TransactionID // created by crypto/rand
 	Attributes    Attributes
+
+	// raw is the decoded message, kept to verify MESSAGE-INTEGRITY
+	raw []byte
 }
 
 func NewMessage(req STUNRequest) *Message {
@@ -86,6 +122,7 @@ func NewMessage(req STUNRequest) *Message {
 // Encode encodes a STUN message into binary format.
 func (m *Message) Encode() ([]byte, error) {
 	logger.Info("-- encode --")
+	m.Length = m.Attributes.encodedLength()
 	buf := new(bytes.Buffer)
 	if err := binary.Write(buf, binary.BigEndian, m.Type); err != nil {
 		return nil, err
@@ -138,6 +175,9 @@ func (m *Message) Decode(data []byte) error {
 	m.Length = binary.BigEndian.Uint16(mlen)
 	logger.Info(fmt.Sprintf("Message length: %d\n", m.Length))
 	logger.Info(hex.Dump(mlen))
+	if len(data) < HeaderByte+int(m.Length) {
+		return errors.New("message is shorter than message length")
+	}
 
 	cookie := data[4:8]
 	logger.Info("magic cookie")
@@ -153,14 +193,18 @@ func (m *Message) Decode(data []byte) error {
 	m.TransactionID = tid
 
 	// decode Attribnutes
-	// if duplicate attribute types are displayed, only the first value is valid
+	// repeated attribute types are kept in order, e.g. XOR-PEER-ADDRESS of
+	// CreatePermission, Extract returns the first one
+	m.raw = append([]byte(nil), data[:HeaderByte+int(m.Length)]...)
 	if m.Length > 0 {
-		attrs := make(Attributes, 1)
+		attrs := make(Attributes, 0)
 		index := 0
-		attrsByte := data[HeaderByte:]
-		dup := make(map[AttributeType]bool, 1)
+		attrsByte := data[HeaderByte : HeaderByte+int(m.Length)]
 		for index < int(m.Length) {
 			attr := Attribute{}
+			if index+4 > len(attrsByte) {
+				return errors.New("attribute header is truncated")
+			}
 
 			aType := AttributeType(binary.BigEndian.Uint16(attrsByte[index : index+2]))
 			attr.Type = aType
@@ -182,19 +226,15 @@ func (m *Message) Decode(data []byte) error {
 			}
 			index += 2
 
+			if index+int(aLen) > len(attrsByte) {
+				return errors.New("attribute value is truncated")
+			}
 			val := attrsByte[index : index+int(aLen)]
 			attr.Value = val
 			logger.Info("Attribute value")
 			logger.Info(hex.Dump(val))
 			index += (int(aLen) + pad)
 
-			if _, ok := dup[attr.Type]; ok {
-				logger.Info(fmt.Sprintf("Attribute type %s has already parsed", attrTypes[attr.Type]))
-				continue
-			}
-
-			dup[aType] = true
-
 			attrs = append(attrs, attr)
 		}
 
@@ -269,6 +309,7 @@ func validatePort(port string) error {
 	return nil
 }
 
+// isSTUNScheme also accepts TURN URI of RFC 7065, which has the same format
 func isSTUNScheme(scheme string) bool {
-	return scheme == "stun" || scheme == "stuns"
+	return scheme == "stun" || scheme == "stuns" || scheme == "turn" || scheme == "turns"
 }
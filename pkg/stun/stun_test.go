@@ -0,0 +1,41 @@
+package stun_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ek-170/myroute/pkg/stun"
+)
+
+func TestDecodeKeepsRepeatedAttributes(t *testing.T) {
+	m := stun.NewMessage(stun.CreatePermissionReq)
+	peers := []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3)}
+	for _, p := range peers {
+		m.Attributes.Add(stun.AttrXorPeerAddress, stun.XORMappedAddress{Address: p}.Encode(m.TransactionID))
+	}
+	b, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := stun.Message{}
+	if err := got.Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Attributes) != len(peers) {
+		t.Fatalf("decoded %d attributes, want %d", len(got.Attributes), len(peers))
+	}
+	for i, attr := range got.Attributes {
+		xa := stun.XORMappedAddress{}
+		if err := xa.Parse(attr, got.TransactionID); err != nil {
+			t.Fatal(err)
+		}
+		if !xa.Address.Equal(peers[i]) {
+			t.Errorf("attribute %d is %s, want %s", i, xa.Address, peers[i])
+		}
+	}
+	first, ok := got.Attributes.Extract(stun.AttrXorPeerAddress)
+	if !ok || &first.Value[0] != &got.Attributes[0].Value[0] {
+		t.Error("Extract does not return the first attribute")
+	}
+}
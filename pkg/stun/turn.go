@@ -0,0 +1,529 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/transport"
+)
+
+const (
+	dataQueueSize = 64
+)
+
+var (
+	ErrNoAllocation     = errors.New("TURN allocation does not exist")
+	ErrChannelExhausted = errors.New("no channel number is available")
+	errTURNClosed       = errors.New("TURN client is closed")
+)
+
+// Datagram is application data relayed from a peer
+type Datagram struct {
+	Peer *net.UDPAddr
+	Data []byte
+	// Channel is the channel number it came through, 0 for Data indication
+	Channel uint16
+}
+
+// TURNClient is a TURN client of RFC 8656 over UDP.
+// a goroutine reads the socket, and dispatches responses to the waiting
+// transaction and relayed data to Receive.
+type TURNClient struct {
+	conn     net.PacketConn
+	laddr    *net.UDPAddr
+	server   *net.UDPAddr
+	username string
+	password string
+	clientOptions
+
+	mu       sync.Mutex
+	realm    string
+	nonce    []byte
+	key      []byte
+	pending  map[TransactionID]chan *Message
+	channels map[uint16]*net.UDPAddr
+	next     uint16
+
+	relayed  *net.UDPAddr
+	mapped   *net.UDPAddr
+	lifetime time.Duration
+
+	data   chan Datagram
+	closed chan struct{}
+}
+
+// NewTURNClient binds a UDP socket to lip to talk with TURN server.
+// username and password are used for long-term credential mechanism
+// when the server challenges with 401.
+func NewTURNClient(server *net.UDPAddr, lip net.IP, username, password string, opts ...ClientOption) (*TURNClient, error) {
+	network := "udp4"
+	if server.IP.To4() == nil {
+		network = "udp6"
+	}
+	c := &TURNClient{
+		server:        server,
+		username:      username,
+		password:      password,
+		clientOptions: defaultClientOptions(opts),
+		pending:       make(map[TransactionID]chan *Message),
+		channels:      make(map[uint16]*net.UDPAddr),
+		next:          MinChannelNumber,
+		data:          make(chan Datagram, dataQueueSize),
+		closed:        make(chan struct{}),
+	}
+	conn, local, err := transport.Listen(c.transport, network, &net.UDPAddr{IP: lip, Port: c.lport})
+	if err != nil {
+		return nil, err
+	}
+	c.conn, c.laddr = conn, local
+	logger.Debug(fmt.Sprintf("bound local socket for TURN: %s", conn.LocalAddr()))
+	go c.readLoop()
+	return c, nil
+}
+
+// LocalAddr returns the local address the client is bound to
+func (c *TURNClient) LocalAddr() *net.UDPAddr {
+	return c.laddr
+}
+
+// RelayedAddr returns the relayed transport address of the allocation
+func (c *TURNClient) RelayedAddr() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.relayed
+}
+
+// MappedAddr returns the server reflexive address seen by TURN server
+func (c *TURNClient) MappedAddr() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mapped
+}
+
+// Lifetime returns the lifetime of the allocation granted last time
+func (c *TURNClient) Lifetime() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lifetime
+}
+
+// Allocate requests a UDP relayed transport address, and returns it
+func (c *TURNClient) Allocate() (*net.UDPAddr, error) {
+	res, err := c.do(func() *Message {
+		m := NewMessage(AllocateReq)
+		m.Attributes.Add(AttrRequestedTransport, RequestedTransport{Protocol: TransportUDP}.Encode())
+		return m
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	relayed := XORMappedAddress{}
+	attr, ok := res.Attributes.Extract(AttrXorRelayedAddress)
+	if !ok {
+		return nil, errors.New("XOR-RELAYED-ADDRESS is not found in Allocate response")
+	}
+	if err := relayed.Parse(attr, res.TransactionID); err != nil {
+		return nil, err
+	}
+	mapped := XORMappedAddress{}
+	if attr, ok := res.Attributes.Extract(AttrXorMappedAddress); ok {
+		if err := mapped.Parse(attr, res.TransactionID); err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.relayed = relayed.UDPAddr()
+	if mapped.Address != nil {
+		c.mapped = mapped.UDPAddr()
+	}
+	c.lifetime = lifetimeOf(res)
+	logger.Debug(fmt.Sprintf("allocated %s for %s, mapped %s", c.relayed, c.lifetime, c.mapped))
+	return c.relayed, nil
+}
+
+// Refresh extends the allocation by lifetime, and returns the lifetime granted.
+// lifetime 0 deletes the allocation.
+func (c *TURNClient) Refresh(lifetime time.Duration) (time.Duration, error) {
+	res, err := c.do(func() *Message {
+		m := NewMessage(RefreshReq)
+		m.Attributes.Add(AttrLifetime, Lifetime{Seconds: uint32(lifetime / time.Second)}.Encode())
+		return m
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lifetime = lifetimeOf(res)
+	if lifetime == 0 {
+		c.relayed = nil
+	}
+	return c.lifetime, nil
+}
+
+// CreatePermission installs permissions for peers, so that the relay accepts
+// data from them. only IP addresses matter, ports are ignored by the server.
+func (c *TURNClient) CreatePermission(peers ...net.IP) error {
+	_, err := c.do(func() *Message {
+		m := NewMessage(CreatePermissionReq)
+		for _, p := range peers {
+			m.Attributes.Add(AttrXorPeerAddress, XORMappedAddress{Address: p}.Encode(m.TransactionID))
+		}
+		return m
+	})
+	return err
+}
+
+// ChannelBind binds a new channel to peer, and returns the channel number.
+// it is refreshed with the same number if peer is already bound.
+func (c *TURNClient) ChannelBind(peer *net.UDPAddr) (uint16, error) {
+	c.mu.Lock()
+	number, bound := c.channelOf(peer)
+	if !bound {
+		if c.next > MaxChannelNumber {
+			c.mu.Unlock()
+			return 0, ErrChannelExhausted
+		}
+		number = c.next
+		c.next++
+	}
+	c.mu.Unlock()
+
+	_, err := c.do(func() *Message {
+		m := NewMessage(ChannelBindReq)
+		m.Attributes.Add(AttrChannelNumber, ChannelNumber{Number: number}.Encode())
+		m.Attributes.Add(AttrXorPeerAddress, XORMappedAddress{Address: peer.IP, Port: uint16(peer.Port)}.Encode(m.TransactionID))
+		return m
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.channels[number] = peer
+	c.mu.Unlock()
+	return number, nil
+}
+
+// channelOf returns the channel bound to peer, c.mu must be held
+func (c *TURNClient) channelOf(peer *net.UDPAddr) (uint16, bool) {
+	for n, p := range c.channels {
+		if p.IP.Equal(peer.IP) && p.Port == peer.Port {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// SendIndication sends data to peer through the relay with Send indication
+func (c *TURNClient) SendIndication(peer *net.UDPAddr, data []byte) error {
+	m := NewMessage(SendInd)
+	m.Attributes.Add(AttrXorPeerAddress, XORMappedAddress{Address: peer.IP, Port: uint16(peer.Port)}.Encode(m.TransactionID))
+	m.Attributes.Add(AttrData, data)
+	b, err := m.Encode()
+	if err != nil {
+		return err
+	}
+	return c.write(b)
+}
+
+// WriteTo sends data to peer through the relay, with ChannelData if a channel
+// is bound to peer, otherwise with Send indication
+func (c *TURNClient) WriteTo(data []byte, peer *net.UDPAddr) error {
+	c.mu.Lock()
+	number, bound := c.channelOf(peer)
+	c.mu.Unlock()
+	if !bound {
+		return c.SendIndication(peer, data)
+	}
+	return c.write(EncodeChannelData(number, data))
+}
+
+// Receive waits for data relayed from a peer until timeout elapses
+func (c *TURNClient) Receive(timeout time.Duration) (Datagram, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case d := <-c.data:
+		return d, nil
+	case <-c.closed:
+		return Datagram{}, errTURNClosed
+	case <-timer.C:
+		return Datagram{}, os.ErrDeadlineExceeded
+	}
+}
+
+// Close deletes the allocation if exists, and closes the socket
+func (c *TURNClient) Close() error {
+	if c.RelayedAddr() != nil {
+		if _, err := c.Refresh(0); err != nil {
+			logger.Warn(fmt.Sprintf("could not delete TURN allocation: %s", err))
+		}
+	}
+	return c.conn.Close()
+}
+
+func (c *TURNClient) write(b []byte) error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.WriteTo(b, c.server)
+	return err
+}
+
+// do sends the request built by build, and waits for the response.
+// when the server challenges with 401, or 438 for stale nonce, the request
+// is built again and sent with long-term credential.
+func (c *TURNClient) do(build func() *Message) (*Message, error) {
+	for attempt := 0; ; attempt++ {
+		msg := build()
+		if err := c.authenticate(msg); err != nil {
+			return nil, err
+		}
+		res, err := c.transact(msg)
+		if err != nil {
+			return nil, err
+		}
+		if !res.Type.IsError() {
+			return res, nil
+		}
+
+		ec := ErrorCode{}
+		attr, ok := res.Attributes.Extract(AttrErrorCode)
+		if !ok {
+			return nil, errors.New("ERROR-CODE is not found in error response")
+		}
+		if err := ec.Parse(attr); err != nil {
+			return nil, err
+		}
+		if attempt > 0 || (ec.Code != CodeUnauthorized && ec.Code != CodeStaleNonce) {
+			return nil, ec
+		}
+		if err := c.updateNonce(res); err != nil {
+			return nil, err
+		}
+		logger.Debug(fmt.Sprintf("retry with credential after %s", ec))
+	}
+}
+
+// authenticate adds USERNAME, REALM, NONCE and MESSAGE-INTEGRITY once realm is known
+func (c *TURNClient) authenticate(msg *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.key == nil {
+		return nil
+	}
+	msg.Attributes.Add(AttrUsername, []byte(c.username))
+	msg.Attributes.Add(AttrRealm, []byte(c.realm))
+	msg.Attributes.Add(AttrNonce, c.nonce)
+	return msg.AddIntegrity(c.key)
+}
+
+// updateNonce takes REALM and NONCE from 401 or 438 response
+func (c *TURNClient) updateNonce(res *Message) error {
+	nonce, ok := res.Attributes.Extract(AttrNonce)
+	if !ok {
+		return errors.New("NONCE is not found in error response")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if realm, ok := res.Attributes.Extract(AttrRealm); ok {
+		c.realm = string(realm.Value)
+	}
+	c.nonce = bytes.Clone(nonce.Value)
+	c.key = LongTermKey(c.username, c.realm, c.password)
+	return nil
+}
+
+// transact sends msg to the server, and waits for the response which has the
+// same transaction ID. the request is retransmitted on each timeout up to maxRetry.
+func (c *TURNClient) transact(msg *Message) (*Message, error) {
+	b, err := msg.Encode()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *Message, 1)
+	c.mu.Lock()
+	c.pending[msg.TransactionID] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, msg.TransactionID)
+		c.mu.Unlock()
+	}()
+
+	for attempt := 0; attempt <= int(c.maxRetry); attempt++ {
+		if attempt > 0 {
+			logger.Debug(fmt.Sprintf("retransmit request to %s (%d/%d)", c.server, attempt, c.maxRetry))
+		}
+		if err := c.write(b); err != nil {
+			return nil, err
+		}
+		timer := time.NewTimer(c.timeout)
+		select {
+		case res := <-ch:
+			timer.Stop()
+			c.mu.Lock()
+			key := c.key
+			c.mu.Unlock()
+			if key != nil && !res.Type.IsError() {
+				if err := res.CheckIntegrity(key); err != nil {
+					return nil, err
+				}
+			}
+			return res, nil
+		case <-c.closed:
+			timer.Stop()
+			return nil, errTURNClosed
+		case <-timer.C:
+		}
+	}
+	return nil, ErrNoResponse
+}
+
+// readLoop reads the socket until it is closed
+func (c *TURNClient) readLoop() {
+	defer close(c.closed)
+	packet := make([]byte, 65536)
+	for {
+		n, from, err := c.conn.ReadFrom(packet)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("TURN client stopped reading: %s", err))
+			return
+		}
+		if addr, ok := from.(*net.UDPAddr); !ok || !addr.IP.Equal(c.server.IP) || addr.Port != c.server.Port {
+			logger.Debug(fmt.Sprintf("ignore packet from %s which is not TURN server", from))
+			continue
+		}
+		c.dispatch(packet[:n])
+	}
+}
+
+func (c *TURNClient) dispatch(b []byte) {
+	if IsChannelData(b) {
+		number, data, err := DecodeChannelData(b)
+		if err != nil {
+			logger.Debug(err.Error())
+			return
+		}
+		c.mu.Lock()
+		peer, ok := c.channels[number]
+		c.mu.Unlock()
+		if !ok {
+			logger.Debug(fmt.Sprintf("ignore ChannelData of unbound channel %#04x", number))
+			return
+		}
+		c.deliver(Datagram{Peer: peer, Data: data, Channel: number})
+		return
+	}
+
+	// attribute values refer to the buffer, which readLoop reuses
+	// while the message is handed over to transact
+	msg := &Message{}
+	if err := msg.Decode(bytes.Clone(b)); err != nil {
+		logger.Debug(fmt.Sprintf("ignore non STUN packet: %s", err))
+		return
+	}
+	if msg.Type == DataInd {
+		peer := XORMappedAddress{}
+		attr, ok := msg.Attributes.Extract(AttrXorPeerAddress)
+		if !ok || peer.Parse(attr, msg.TransactionID) != nil {
+			logger.Debug("ignore Data indication without XOR-PEER-ADDRESS")
+			return
+		}
+		data, ok := msg.Attributes.Extract(AttrData)
+		if !ok {
+			logger.Debug("ignore Data indication without DATA")
+			return
+		}
+		c.deliver(Datagram{Peer: peer.UDPAddr(), Data: bytes.Clone(data.Value)})
+		return
+	}
+
+	c.mu.Lock()
+	ch, ok := c.pending[msg.TransactionID]
+	c.mu.Unlock()
+	if !ok {
+		logger.Debug(fmt.Sprintf("ignore STUN message %04X of unknown transaction", uint16(msg.Type)))
+		return
+	}
+	select {
+	case ch <- msg:
+	default:
+		// duplicated response for retransmission
+	}
+}
+
+func (c *TURNClient) deliver(d Datagram) {
+	select {
+	case c.data <- d:
+	default:
+		logger.Warn(fmt.Sprintf("drop relayed data from %s, receive queue is full", d.Peer))
+	}
+}
+
+func lifetimeOf(res *Message) time.Duration {
+	l := Lifetime{}
+	attr, ok := res.Attributes.Extract(AttrLifetime)
+	if !ok || l.Parse(attr) != nil {
+		return 0
+	}
+	return time.Duration(l.Seconds) * time.Second
+}
+
+// channel numbers which can be bound, RFC 8656 Section 12
+const (
+	MinChannelNumber uint16 = 0x4000
+	MaxChannelNumber uint16 = 0x4FFF
+
+	channelDataHeaderByte = 4
+)
+
+// IsChannelData reports whether b is ChannelData message, not STUN message.
+// the first two bits are 0b01 for ChannelData, 0b00 for STUN.
+func IsChannelData(b []byte) bool {
+	return len(b) >= channelDataHeaderByte && b[0]&0xC0 == 0x40
+}
+
+// EncodeChannelData frames data with channel number of TURN.
+// data is padded to 4 bytes boundary, which is required over TCP and allowed over UDP.
+//
+//	0                   1                   2                   3
+//	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|         Channel Number        |            Length             |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                                                               |
+//	/                       Application Data                        /
+//	/                                                               /
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+func EncodeChannelData(channel uint16, data []byte) []byte {
+	pad := (AttrBoundaryByte - len(data)%AttrBoundaryByte) % AttrBoundaryByte
+	b := make([]byte, channelDataHeaderByte, channelDataHeaderByte+len(data)+pad)
+	binary.BigEndian.PutUint16(b[0:2], channel)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(data)))
+	b = append(b, data...)
+	return append(b, make([]byte, pad)...)
+}
+
+// DecodeChannelData returns channel number and application data of ChannelData
+func DecodeChannelData(b []byte) (uint16, []byte, error) {
+	if !IsChannelData(b) {
+		return 0, nil, errors.New("not ChannelData message")
+	}
+	channel := binary.BigEndian.Uint16(b[0:2])
+	l := int(binary.BigEndian.Uint16(b[2:4]))
+	if len(b) < channelDataHeaderByte+l {
+		return 0, nil, errors.New("ChannelData is shorter than length")
+	}
+	return channel, bytes.Clone(b[channelDataHeaderByte : channelDataHeaderByte+l]), nil
+}
@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+)
+
+const queueSize = 256
+
+// Conn is an in-memory packet socket. packets written to it are handed to send,
+// and packets are received once Deliver queues them.
+type Conn struct {
+	addr    *net.UDPAddr
+	send    func(b []byte, from, to *net.UDPAddr)
+	onClose func()
+	queue   chan packet
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	// deadlineChanged is closed and replaced when the read deadline is set,
+	// so that blocked ReadFrom follows the new deadline
+	deadlineChanged chan struct{}
+	closed          chan struct{}
+}
+
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// NewConn returns a socket bound to addr, onClose is called once on Close if not nil
+func NewConn(addr *net.UDPAddr, send func(b []byte, from, to *net.UDPAddr), onClose func()) *Conn {
+	return &Conn{
+		addr:    addr,
+		send:    send,
+		onClose: onClose,
+		queue:   make(chan packet, queueSize),
+		closed:  make(chan struct{}),
+
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// Pipe returns a pair of connected sockets bound to a and b,
+// packets written to either are received by the other whatever the destination is
+func Pipe(a, b *net.UDPAddr) (*Conn, *Conn) {
+	var ca, cb *Conn
+	ca = NewConn(a, func(p []byte, from, _ *net.UDPAddr) { cb.Deliver(p, from) }, nil)
+	cb = NewConn(b, func(p []byte, from, _ *net.UDPAddr) { ca.Deliver(p, from) }, nil)
+	return ca, cb
+}
+
+// Deliver queues a copy of b from from, it never blocks and drops b if the queue is full
+func (c *Conn) Deliver(b []byte, from *net.UDPAddr) {
+	select {
+	case c.queue <- packet{data: append([]byte(nil), b...), from: from}:
+	case <-c.closed:
+	default:
+		logger.Debug(fmt.Sprintf("queue of %s is full, drop packet from %s", c.addr, from))
+	}
+}
+
+// ReadFrom waits for a packet until the read deadline, which may be changed
+// while waiting. os.ErrDeadlineExceeded is returned on timeout as net.UDPConn does
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.readDeadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case p := <-c.queue:
+			stop(timer)
+			return copy(b, p.data), p.from, nil
+		case <-c.closed:
+			stop(timer)
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			stop(timer)
+		}
+	}
+}
+
+func stop(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// WriteTo sends b to addr, it never blocks
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, ErrNotUDPAddr
+	}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.send(b, c.addr, to)
+	return len(b), nil
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, since WriteTo never blocks
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var (
+	addrA = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	addrB = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000}
+)
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe(addrA, addrB)
+	defer a.Close()
+	defer b.Close()
+
+	msg := []byte("hello")
+	if _, err := a.WriteTo(msg, addrB); err != nil {
+		t.Fatal(err)
+	}
+	// the packet is a copy, changes after WriteTo are not seen
+	msg[0] = 'j'
+
+	buf := make([]byte, 16)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" || from.String() != addrA.String() {
+		t.Errorf("got %q from %s", buf[:n], from)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	a, _ := Pipe(addrA, addrB)
+	defer a.Close()
+
+	a.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := a.ReadFrom(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	a.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, _, err := a.ReadFrom(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v with past deadline", err)
+	}
+}
+
+func TestSetReadDeadlineWhileReading(t *testing.T) {
+	a, _ := Pipe(addrA, addrB)
+	defer a.Close()
+	a.SetReadDeadline(time.Time{})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := a.ReadFrom(make([]byte, 16))
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// shortening the deadline must wake the blocked read
+	a.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked ReadFrom did not follow the new deadline")
+	}
+}
+
+func TestClose(t *testing.T) {
+	closed := 0
+	c := NewConn(addrA, func([]byte, *net.UDPAddr, *net.UDPAddr) {}, func() { closed++ })
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadFrom(make([]byte, 16))
+		errc <- err
+	}()
+	c.Close()
+	c.Close()
+
+	if err := <-errc; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom got %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := c.WriteTo([]byte("x"), addrB); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("WriteTo got %v, want %v", err, net.ErrClosed)
+	}
+	if closed != 1 {
+		t.Errorf("onClose was called %d times", closed)
+	}
+	// delivering to a closed socket must not block
+	c.Deliver([]byte("x"), addrB)
+}
+
+func TestWriteToNotUDPAddr(t *testing.T) {
+	a, _ := Pipe(addrA, addrB)
+	defer a.Close()
+	if _, err := a.WriteTo([]byte("x"), &net.TCPAddr{IP: addrB.IP, Port: addrB.Port}); !errors.Is(err, ErrNotUDPAddr) {
+		t.Errorf("got %v, want %v", err, ErrNotUDPAddr)
+	}
+}
@@ -0,0 +1,67 @@
+// Package transport abstracts packet sockets STUN and TURN run over, so that
+// clients, diagnosis and servers work over the host network stack, in-memory
+// pipes, a simulated NAT or a proxy without changes of the protocol logic.
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	ErrNotUDPAddr = errors.New("address is not *net.UDPAddr")
+)
+
+// Transport opens packet sockets. LocalAddr of the sockets, and source addresses
+// returned by ReadFrom, must be *net.UDPAddr as net.UDPConn returns.
+// sockets opened by Listen are checked, and sources are checked where they are read.
+type Transport interface {
+	// ListenPacket opens a socket bound to laddr, network is "udp", "udp4" or "udp6".
+	// the port is chosen by the transport if it is 0.
+	ListenPacket(network string, laddr *net.UDPAddr) (net.PacketConn, error)
+}
+
+// Func adapts a function to Transport
+type Func func(network string, laddr *net.UDPAddr) (net.PacketConn, error)
+
+func (f Func) ListenPacket(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	return f(network, laddr)
+}
+
+// UDP opens UDP sockets of the host network stack
+var UDP Transport = udp{}
+
+type udp struct{}
+
+func (udp) ListenPacket(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Listen opens a socket with t, or UDP if t is nil, and returns it with its local
+// address. the socket is closed and ErrNotUDPAddr is returned if the local
+// address is not *net.UDPAddr.
+func Listen(t Transport, network string, laddr *net.UDPAddr) (net.PacketConn, *net.UDPAddr, error) {
+	conn, err := Or(t).ListenPacket(network, laddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		conn.Close()
+		return nil, nil, fmt.Errorf("%w: local address %s of %T", ErrNotUDPAddr, conn.LocalAddr(), conn)
+	}
+	return conn, local, nil
+}
+
+// Or returns t, or UDP if t is nil
+func Or(t Transport) Transport {
+	if t == nil {
+		return UDP
+	}
+	return t
+}
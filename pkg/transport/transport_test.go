@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// tcpAddrConn reports a local address which is not *net.UDPAddr
+type tcpAddrConn struct {
+	*Conn
+	closed bool
+}
+
+func (c *tcpAddrConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: addrA.IP, Port: addrA.Port}
+}
+
+func (c *tcpAddrConn) Close() error {
+	c.closed = true
+	return c.Conn.Close()
+}
+
+func TestListen(t *testing.T) {
+	a, _ := Pipe(addrA, addrB)
+	conn, local, err := Listen(Func(func(string, *net.UDPAddr) (net.PacketConn, error) {
+		return a, nil
+	}), "udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if local.String() != addrA.String() {
+		t.Errorf("local address = %s", local)
+	}
+}
+
+func TestListenNotUDPAddr(t *testing.T) {
+	a, _ := Pipe(addrA, addrB)
+	bad := &tcpAddrConn{Conn: a}
+	_, _, err := Listen(Func(func(string, *net.UDPAddr) (net.PacketConn, error) {
+		return bad, nil
+	}), "udp4", nil)
+	if !errors.Is(err, ErrNotUDPAddr) {
+		t.Errorf("got %v, want %v", err, ErrNotUDPAddr)
+	}
+	if !bad.closed {
+		t.Error("rejected socket was not closed")
+	}
+}
@@ -0,0 +1,326 @@
+package turn
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/stun"
+	"github.com/ek-170/myroute/pkg/transport"
+)
+
+// allocation is a relayed transport address of a client, see RFC 8656 Section 2.2
+type allocation struct {
+	client   *net.UDPAddr
+	username string
+	relay    net.PacketConn
+	relayed  *net.UDPAddr
+	expires  time.Time
+	// tid is the transaction which created the allocation,
+	// a retransmitted Allocate request is answered with success again
+	tid stun.TransactionID
+
+	permissions map[string]time.Time // by peer IP
+	channels    map[uint16]*channel
+}
+
+type channel struct {
+	peer    *net.UDPAddr
+	expires time.Time
+}
+
+// expire removes expired permissions and channels, s.mu must be held
+func (a *allocation) expire(now time.Time) {
+	for ip, expires := range a.permissions {
+		if now.After(expires) {
+			delete(a.permissions, ip)
+		}
+	}
+	for n, ch := range a.channels {
+		if now.After(ch.expires) {
+			delete(a.channels, n)
+		}
+	}
+}
+
+// permitted reports whether data from or to peer is allowed, s.mu must be held
+func (a *allocation) permitted(peer net.IP) bool {
+	expires, ok := a.permissions[peer.String()]
+	return ok && time.Now().Before(expires)
+}
+
+// channelOf returns the channel bound to peer, s.mu must be held
+func (a *allocation) channelOf(peer *net.UDPAddr) (uint16, bool) {
+	for n, ch := range a.channels {
+		if ch.peer.IP.Equal(peer.IP) && ch.peer.Port == peer.Port {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) handleTURN(req *stun.Message, from *net.UDPAddr, key []byte) {
+	s.mu.Lock()
+	a := s.allocations[from.String()]
+	s.mu.Unlock()
+
+	if req.Type == stun.AllocateReq {
+		s.handleAllocate(req, from, key, a)
+		return
+	}
+	if a == nil {
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeAllocationMismatch, Reason: "Allocation Mismatch"}, key)
+		return
+	}
+	if username, _ := req.Attributes.Extract(stun.AttrUsername); string(username.Value) != a.username {
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeWrongCredentials, Reason: "Wrong Credentials"}, key)
+		return
+	}
+	switch req.Type {
+	case stun.RefreshReq:
+		s.handleRefresh(req, from, key, a)
+	case stun.CreatePermissionReq:
+		s.handleCreatePermission(req, from, key, a)
+	case stun.ChannelBindReq:
+		s.handleChannelBind(req, from, key, a)
+	}
+}
+
+func (s *Server) handleAllocate(req *stun.Message, from *net.UDPAddr, key []byte, a *allocation) {
+	if a != nil {
+		if a.tid == req.TransactionID {
+			s.allocated(req, from, key, a)
+			return
+		}
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeAllocationMismatch, Reason: "Allocation Mismatch"}, key)
+		return
+	}
+
+	attr, ok := req.Attributes.Extract(stun.AttrRequestedTransport)
+	if !ok {
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeBadRequest, Reason: "REQUESTED-TRANSPORT is required"}, key)
+		return
+	}
+	rt := stun.RequestedTransport{}
+	if err := rt.Parse(attr); err != nil || rt.Protocol != stun.TransportUDP {
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeUnsupportedTransportProtocol, Reason: "Unsupported Transport Protocol"}, key)
+		return
+	}
+
+	relay, relayed, err := transport.Listen(s.transport, "udp", &net.UDPAddr{IP: s.relayIP})
+	if err != nil {
+		logger.Warn(fmt.Sprintf("could not allocate relayed address: %s", err))
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeInsufficientCapacity, Reason: "Insufficient Capacity"}, key)
+		return
+	}
+	username, _ := req.Attributes.Extract(stun.AttrUsername)
+	a = &allocation{
+		client:      from,
+		username:    string(username.Value),
+		relay:       relay,
+		relayed:     relayed,
+		expires:     time.Now().Add(max(requestedLifetime(req), defaultLifetime)),
+		tid:         req.TransactionID,
+		permissions: map[string]time.Time{},
+		channels:    map[uint16]*channel{},
+	}
+	s.mu.Lock()
+	s.allocations[from.String()] = a
+	s.mu.Unlock()
+	logger.Info(fmt.Sprintf("allocated %s for %s", relay.LocalAddr(), from))
+
+	go s.relayLoop(a)
+	s.allocated(req, from, key, a)
+}
+
+// allocated answers Allocate with the relayed and mapped address
+func (s *Server) allocated(req *stun.Message, from *net.UDPAddr, key []byte, a *allocation) {
+	res := response(req, stun.AllocateRes)
+	res.Attributes.Add(stun.AttrXorRelayedAddress, xorAddr(a.relayed, res.TransactionID))
+	res.Attributes.Add(stun.AttrLifetime, stun.Lifetime{Seconds: uint32(time.Until(a.expires).Round(time.Second) / time.Second)}.Encode())
+	res.Attributes.Add(stun.AttrXorMappedAddress, xorAddr(from, res.TransactionID))
+	s.send(res, from, key)
+}
+
+func (s *Server) handleRefresh(req *stun.Message, from *net.UDPAddr, key []byte, a *allocation) {
+	lifetime := requestedLifetime(req)
+	s.mu.Lock()
+	if lifetime == 0 {
+		a.relay.Close()
+		delete(s.allocations, from.String())
+		logger.Info(fmt.Sprintf("deleted allocation %s of %s", a.relay.LocalAddr(), from))
+	} else {
+		a.expires = time.Now().Add(lifetime)
+	}
+	s.mu.Unlock()
+
+	res := response(req, successType(req.Type))
+	res.Attributes.Add(stun.AttrLifetime, stun.Lifetime{Seconds: uint32(lifetime / time.Second)}.Encode())
+	s.send(res, from, key)
+}
+
+func (s *Server) handleCreatePermission(req *stun.Message, from *net.UDPAddr, key []byte, a *allocation) {
+	var peers []net.IP
+	for _, attr := range req.Attributes {
+		if attr.Type != stun.AttrXorPeerAddress {
+			continue
+		}
+		peer := stun.XORMappedAddress{}
+		if err := peer.Parse(attr, req.TransactionID); err != nil {
+			s.reject(req, from, stun.ErrorCode{Code: stun.CodeBadRequest, Reason: err.Error()}, key)
+			return
+		}
+		peers = append(peers, peer.Address)
+	}
+	if len(peers) == 0 {
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeBadRequest, Reason: "XOR-PEER-ADDRESS is required"}, key)
+		return
+	}
+
+	s.mu.Lock()
+	for _, p := range peers {
+		a.permissions[p.String()] = time.Now().Add(permissionTimeout)
+	}
+	s.mu.Unlock()
+	logger.Debug(fmt.Sprintf("installed permission for %v on %s", peers, a.relay.LocalAddr()))
+	s.send(response(req, successType(req.Type)), from, key)
+}
+
+func (s *Server) handleChannelBind(req *stun.Message, from *net.UDPAddr, key []byte, a *allocation) {
+	cn := stun.ChannelNumber{}
+	attr, ok := req.Attributes.Extract(stun.AttrChannelNumber)
+	if !ok || cn.Parse(attr) != nil || cn.Number < stun.MinChannelNumber || cn.Number > stun.MaxChannelNumber {
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeBadRequest, Reason: "invalid CHANNEL-NUMBER"}, key)
+		return
+	}
+	peer := stun.XORMappedAddress{}
+	attr, ok = req.Attributes.Extract(stun.AttrXorPeerAddress)
+	if !ok || peer.Parse(attr, req.TransactionID) != nil {
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeBadRequest, Reason: "invalid XOR-PEER-ADDRESS"}, key)
+		return
+	}
+	addr := peer.UDPAddr()
+
+	s.mu.Lock()
+	// a channel is bound to only one peer, and vice versa
+	bound, ok := a.channels[cn.Number]
+	conflict := ok && (!bound.peer.IP.Equal(addr.IP) || bound.peer.Port != addr.Port)
+	if n, ok := a.channelOf(addr); ok && n != cn.Number {
+		conflict = true
+	}
+	if !conflict {
+		a.channels[cn.Number] = &channel{peer: addr, expires: time.Now().Add(channelTimeout)}
+		a.permissions[addr.IP.String()] = time.Now().Add(permissionTimeout)
+	}
+	s.mu.Unlock()
+
+	if conflict {
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeBadRequest, Reason: "channel is bound to another peer"}, key)
+		return
+	}
+	logger.Debug(fmt.Sprintf("bound channel %#04x to %s on %s", cn.Number, addr, a.relay.LocalAddr()))
+	s.send(response(req, successType(req.Type)), from, key)
+}
+
+// handleSend relays data of Send indication to the peer permitted
+func (s *Server) handleSend(req *stun.Message, from *net.UDPAddr) {
+	peer := stun.XORMappedAddress{}
+	attr, ok := req.Attributes.Extract(stun.AttrXorPeerAddress)
+	if !ok || peer.Parse(attr, req.TransactionID) != nil {
+		return
+	}
+	data, ok := req.Attributes.Extract(stun.AttrData)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	a := s.allocations[from.String()]
+	permitted := a != nil && a.permitted(peer.Address)
+	s.mu.Unlock()
+	if !permitted {
+		logger.Debug(fmt.Sprintf("drop Send indication from %s to %s without permission", from, peer.UDPAddr()))
+		return
+	}
+	if _, err := a.relay.WriteTo(data.Value, peer.UDPAddr()); err != nil {
+		logger.Debug(fmt.Sprintf("could not relay to %s: %s", peer.UDPAddr(), err))
+	}
+}
+
+// handleChannelData relays ChannelData to the peer bound to the channel
+func (s *Server) handleChannelData(b []byte, from *net.UDPAddr) {
+	number, data, err := stun.DecodeChannelData(b)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	a := s.allocations[from.String()]
+	var peer *net.UDPAddr
+	if a != nil {
+		if ch, ok := a.channels[number]; ok && a.permitted(ch.peer.IP) {
+			peer = ch.peer
+		}
+	}
+	s.mu.Unlock()
+	if peer == nil {
+		logger.Debug(fmt.Sprintf("drop ChannelData of unbound channel %#04x from %s", number, from))
+		return
+	}
+	if _, err := a.relay.WriteTo(data, peer); err != nil {
+		logger.Debug(fmt.Sprintf("could not relay to %s: %s", peer, err))
+	}
+}
+
+// relayLoop relays data from permitted peers to the client until the allocation is closed,
+// with ChannelData if a channel is bound to the peer, otherwise with Data indication
+func (s *Server) relayLoop(a *allocation) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := a.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		peer, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		s.mu.Lock()
+		permitted := a.permitted(peer.IP)
+		number, bound := a.channelOf(peer)
+		s.mu.Unlock()
+		if !permitted {
+			logger.Debug(fmt.Sprintf("drop data from %s to %s without permission", peer, a.relay.LocalAddr()))
+			continue
+		}
+
+		if bound {
+			if _, err := s.conn.WriteTo(stun.EncodeChannelData(number, buf[:n]), a.client); err != nil {
+				logger.Debug(fmt.Sprintf("could not send to %s: %s", a.client, err))
+			}
+			continue
+		}
+		ind := stun.NewMessage(stun.DataInd)
+		ind.Attributes.Add(stun.AttrXorPeerAddress, xorAddr(peer, ind.TransactionID))
+		ind.Attributes.Add(stun.AttrData, buf[:n])
+		s.send(ind, a.client, nil)
+	}
+}
+
+// requestedLifetime returns LIFETIME of req between the default and the maximum,
+// or the default if it is not specified. 0 is kept to delete the allocation.
+func requestedLifetime(req *stun.Message) time.Duration {
+	attr, ok := req.Attributes.Extract(stun.AttrLifetime)
+	if !ok {
+		return defaultLifetime
+	}
+	l := stun.Lifetime{}
+	if err := l.Parse(attr); err != nil {
+		return defaultLifetime
+	}
+	if l.Seconds == 0 {
+		return 0
+	}
+	return min(max(time.Duration(l.Seconds)*time.Second, defaultLifetime), maxLifetime)
+}
@@ -0,0 +1,362 @@
+// Package turn implements a minimal STUN and TURN server over UDP
+// for local relay testing.
+// see RFC 8489 and RFC 8656
+package turn
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/stun"
+	"github.com/ek-170/myroute/pkg/transport"
+)
+
+const (
+	DefaultRealm = "mynat"
+
+	defaultLifetime   = 10 * time.Minute
+	maxLifetime       = time.Hour
+	permissionTimeout = 5 * time.Minute
+	channelTimeout    = 10 * time.Minute
+	nonceTimeout      = time.Hour
+	sweepInterval     = time.Second
+
+	maxPacketSize = 65536
+)
+
+var (
+	ErrServerClosed = errors.New("server is closed")
+)
+
+type serverOptions struct {
+	realm   string
+	users   map[string]string
+	relayIP net.IP
+	// transport opens relay sockets and the listening socket of ListenAndServe
+	transport transport.Transport
+}
+
+type ServerOption func(o *serverOptions)
+
+// WithRealm sets the realm of long-term credential, DefaultRealm if not specified
+func WithRealm(realm string) ServerOption {
+	return func(o *serverOptions) {
+		o.realm = realm
+	}
+}
+
+// WithUser adds a user of long-term credential. TURN is enabled only
+// when any user is added, otherwise the server works as a STUN server.
+func WithUser(username, password string) ServerOption {
+	return func(o *serverOptions) {
+		o.users[username] = password
+	}
+}
+
+// WithRelayIP sets the address relayed transport addresses are allocated on.
+// the address of the listening socket is used if not specified, or loopback
+// address if it is unspecified.
+func WithRelayIP(ip net.IP) ServerOption {
+	return func(o *serverOptions) {
+		o.relayIP = ip
+	}
+}
+
+// WithTransport opens relay sockets with t instead of the host network stack,
+// e.g. so that relayed addresses are allocated on a simulated network
+func WithTransport(t transport.Transport) ServerOption {
+	return func(o *serverOptions) {
+		o.transport = t
+	}
+}
+
+// Server is a STUN server which answers Binding-Request, and a TURN server
+// which relays UDP for authenticated users
+type Server struct {
+	conn net.PacketConn
+	serverOptions
+
+	mu          sync.Mutex
+	allocations map[string]*allocation // by client transport address
+	nonces      map[string]time.Time
+
+	closed chan struct{}
+}
+
+// NewServer returns a server which serves on conn until Close is called.
+// conn may be any packet listener, e.g. net.ListenPacket("udp4", "127.0.0.1:0") in tests.
+func NewServer(conn net.PacketConn, opts ...ServerOption) *Server {
+	o := serverOptions{
+		realm: DefaultRealm,
+		users: map[string]string{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.relayIP == nil {
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+			o.relayIP = addr.IP
+		} else {
+			o.relayIP = net.IPv4(127, 0, 0, 1)
+		}
+	}
+	return &Server{
+		conn:          conn,
+		serverOptions: o,
+		allocations:   map[string]*allocation{},
+		nonces:        map[string]time.Time{},
+		closed:        make(chan struct{}),
+	}
+}
+
+// ListenAndServe listens on addr, e.g. ":3478", and serves until an error occurs
+func ListenAndServe(addr string, opts ...ServerOption) error {
+	o := serverOptions{users: map[string]string{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := transport.Or(o.transport).ListenPacket("udp", laddr)
+	if err != nil {
+		return err
+	}
+	return NewServer(conn, opts...).Serve()
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// TURNEnabled reports whether any user is configured for TURN
+func (s *Server) TURNEnabled() bool {
+	return len(s.users) > 0
+}
+
+// Serve reads requests until the server is closed.
+// it returns ErrServerClosed after Close.
+func (s *Server) Serve() error {
+	go s.sweep()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return ErrServerClosed
+			default:
+			}
+			return err
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		s.handle(buf[:n], addr)
+	}
+}
+
+// Close closes the listening socket and every allocation
+func (s *Server) Close() error {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil
+	default:
+	}
+	close(s.closed)
+	for key, a := range s.allocations {
+		a.relay.Close()
+		delete(s.allocations, key)
+	}
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// sweep removes expired allocations, permissions, channels and nonces
+func (s *Server) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, a := range s.allocations {
+				if now.After(a.expires) {
+					logger.Debug(fmt.Sprintf("allocation %s of %s expired", a.relay.LocalAddr(), key))
+					a.relay.Close()
+					delete(s.allocations, key)
+					continue
+				}
+				a.expire(now)
+			}
+			for nonce, expires := range s.nonces {
+				if now.After(expires) {
+					delete(s.nonces, nonce)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Server) handle(b []byte, from *net.UDPAddr) {
+	if stun.IsChannelData(b) {
+		s.handleChannelData(b, from)
+		return
+	}
+	req := &stun.Message{}
+	if err := req.Decode(b); err != nil || req.Cookie != stun.MagicCookie {
+		logger.Debug(fmt.Sprintf("ignore non STUN packet from %s", from))
+		return
+	}
+
+	switch req.Type {
+	case stun.BindingReq:
+		s.handleBinding(req, from)
+	case stun.SendInd:
+		s.handleSend(req, from)
+	case stun.AllocateReq, stun.RefreshReq, stun.CreatePermissionReq, stun.ChannelBindReq:
+		if !s.TURNEnabled() {
+			s.reject(req, from, stun.ErrorCode{Code: stun.CodeBadRequest, Reason: "TURN is not enabled"}, nil)
+			return
+		}
+		key, ok := s.authenticate(req, from)
+		if !ok {
+			return
+		}
+		s.handleTURN(req, from, key)
+	default:
+		logger.Debug(fmt.Sprintf("ignore STUN message %04X from %s", uint16(req.Type), from))
+	}
+}
+
+// handleBinding answers with XOR-MAPPED-ADDRESS. the response is sent to
+// the port in RESPONSE-PORT of RFC 5780 if present.
+func (s *Server) handleBinding(req *stun.Message, from *net.UDPAddr) {
+	res := response(req, stun.BindingRes)
+	res.Attributes.Add(stun.AttrXorMappedAddress, xorAddr(from, res.TransactionID))
+	if local, ok := s.conn.LocalAddr().(*net.UDPAddr); ok {
+		res.Attributes.Add(stun.AttrResponseOrigin, xorAddr(local, res.TransactionID))
+	}
+
+	dest := from
+	if attr, ok := req.Attributes.Extract(stun.AttrResponsePort); ok {
+		rp := stun.ResponsePort{}
+		if err := rp.Parse(attr); err != nil {
+			s.reject(req, from, stun.ErrorCode{Code: stun.CodeBadRequest, Reason: err.Error()}, nil)
+			return
+		}
+		dest = &net.UDPAddr{IP: from.IP, Port: int(rp.Port)}
+	}
+	s.send(res, dest, nil)
+}
+
+// authenticate verifies long-term credential of req, and answers with 401 or 438
+// if it is missing or invalid. it returns the key of the user.
+func (s *Server) authenticate(req *stun.Message, from *net.UDPAddr) ([]byte, bool) {
+	username, hasUser := req.Attributes.Extract(stun.AttrUsername)
+	nonce, hasNonce := req.Attributes.Extract(stun.AttrNonce)
+	_, hasIntegrity := req.Attributes.Extract(stun.AttrMessageIntegrity)
+	if !hasIntegrity {
+		s.challenge(req, from, stun.CodeUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	if !hasUser || !hasNonce {
+		s.reject(req, from, stun.ErrorCode{Code: stun.CodeBadRequest, Reason: "USERNAME and NONCE are required"}, nil)
+		return nil, false
+	}
+
+	s.mu.Lock()
+	expires, ok := s.nonces[string(nonce.Value)]
+	s.mu.Unlock()
+	if !ok || time.Now().After(expires) {
+		s.challenge(req, from, stun.CodeStaleNonce, "Stale Nonce")
+		return nil, false
+	}
+	password, ok := s.users[string(username.Value)]
+	if !ok {
+		s.challenge(req, from, stun.CodeUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	key := stun.LongTermKey(string(username.Value), s.realm, password)
+	if err := req.CheckIntegrity(key); err != nil {
+		logger.Debug(fmt.Sprintf("%s from %s: %s", username.Value, from, err))
+		s.challenge(req, from, stun.CodeUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	return key, true
+}
+
+// challenge answers with REALM and a new NONCE
+func (s *Server) challenge(req *stun.Message, from *net.UDPAddr, code int, reason string) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	s.mu.Lock()
+	s.nonces[nonce] = time.Now().Add(nonceTimeout)
+	s.mu.Unlock()
+
+	res := response(req, errorType(req.Type))
+	res.Attributes.Add(stun.AttrErrorCode, stun.ErrorCode{Code: code, Reason: reason}.Encode())
+	res.Attributes.Add(stun.AttrRealm, []byte(s.realm))
+	res.Attributes.Add(stun.AttrNonce, []byte(nonce))
+	s.send(res, from, nil)
+}
+
+// reject answers with error response, key is nil for unauthenticated request
+func (s *Server) reject(req *stun.Message, from *net.UDPAddr, ec stun.ErrorCode, key []byte) {
+	logger.Debug(fmt.Sprintf("reject %04X from %s: %s", uint16(req.Type), from, ec))
+	res := response(req, errorType(req.Type))
+	res.Attributes.Add(stun.AttrErrorCode, ec.Encode())
+	s.send(res, from, key)
+}
+
+// send encodes msg with MESSAGE-INTEGRITY if key is given, and sends it to dest
+func (s *Server) send(msg *stun.Message, dest net.Addr, key []byte) {
+	if key != nil {
+		if err := msg.AddIntegrity(key); err != nil {
+			logger.Warn(err.Error())
+			return
+		}
+	}
+	b, err := msg.Encode()
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	if _, err := s.conn.WriteTo(b, dest); err != nil {
+		logger.Debug(fmt.Sprintf("could not send to %s: %s", dest, err))
+	}
+}
+
+// response returns a message of typ which has the same transaction ID as req
+func response(req *stun.Message, typ stun.STUNRequest) *stun.Message {
+	res := stun.NewMessage(typ)
+	res.TransactionID = req.TransactionID
+	return res
+}
+
+func errorType(req stun.STUNRequest) stun.STUNRequest {
+	return req | 0x0110
+}
+
+func successType(req stun.STUNRequest) stun.STUNRequest {
+	return req | 0x0100
+}
+
+func xorAddr(addr *net.UDPAddr, tid stun.TransactionID) []byte {
+	return stun.XORMappedAddress{Address: addr.IP, Port: uint16(addr.Port)}.Encode(tid)
+}
@@ -0,0 +1,302 @@
+package turn_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/stun"
+	"github.com/ek-170/myroute/pkg/turn"
+)
+
+const (
+	testUser     = "user"
+	testPassword = "password"
+	testTimeout  = time.Second
+)
+
+// newServer serves TURN on loopback until the test ends
+func newServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := turn.NewServer(conn, turn.WithUser(testUser, testPassword))
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().(*net.UDPAddr)
+}
+
+func newClient(t *testing.T, server *net.UDPAddr) *stun.TURNClient {
+	t.Helper()
+	c, err := stun.NewTURNClient(server, net.IPv4(127, 0, 0, 1), testUser, testPassword,
+		stun.WithTimeout(200*time.Millisecond), stun.WithMaxRetry(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// newPeer binds a peer socket on ip, any address of 127.0.0.0/8 is routed to loopback
+func newPeer(t *testing.T, ip net.IP) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// receive returns the first relayed datagram, or fails the test on timeout
+func receive(t *testing.T, c *stun.TURNClient) stun.Datagram {
+	t.Helper()
+	d, err := c.Receive(testTimeout)
+	if err != nil {
+		t.Fatalf("no relayed data: %s", err)
+	}
+	return d
+}
+
+func TestCreatePermissionForEveryPeer(t *testing.T) {
+	c := newClient(t, newServer(t))
+	relayed, err := c.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := []*net.UDPConn{newPeer(t, net.IPv4(127, 0, 0, 1)), newPeer(t, net.IPv4(127, 0, 0, 2))}
+	if err := c.CreatePermission(net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range peers {
+		if _, err := p.WriteTo([]byte("hello"), relayed); err != nil {
+			t.Fatal(err)
+		}
+		d := receive(t, c)
+		if d.Peer.String() != p.LocalAddr().String() || string(d.Data) != "hello" {
+			t.Errorf("got %q from %s, want from %s", d.Data, d.Peer, p.LocalAddr())
+		}
+	}
+}
+
+// read returns a datagram the peer received, or fails the test on timeout
+func read(t *testing.T, conn *net.UDPConn) (string, net.Addr) {
+	t.Helper()
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("peer %s received nothing: %s", conn.LocalAddr(), err)
+	}
+	return string(buf[:n]), from
+}
+
+func TestRelay(t *testing.T) {
+	c := newClient(t, newServer(t))
+	relayed, err := c.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !relayed.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("relayed address is %s", relayed)
+	}
+	if c.MappedAddr().String() != c.LocalAddr().String() {
+		t.Errorf("mapped address is %s, want %s", c.MappedAddr(), c.LocalAddr())
+	}
+	if c.Lifetime() <= 0 {
+		t.Errorf("lifetime is %s", c.Lifetime())
+	}
+
+	p1, p2 := newPeer(t, net.IPv4(127, 0, 0, 1)), newPeer(t, net.IPv4(127, 0, 0, 2))
+	stranger := newPeer(t, net.IPv4(127, 0, 0, 3))
+	if err := c.CreatePermission(net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send and Data indication
+	p1Addr := p1.LocalAddr().(*net.UDPAddr)
+	if err := c.SendIndication(p1Addr, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if data, from := read(t, p1); data != "ping" || from.String() != relayed.String() {
+		t.Errorf("peer received %q from %s, want from %s", data, from, relayed)
+	}
+	// the relay drops data from a peer without permission, which comes first
+	stranger.WriteTo([]byte("intrusion"), relayed)
+	p1.WriteTo([]byte("pong"), relayed)
+	if d := receive(t, c); string(d.Data) != "pong" || d.Peer.String() != p1Addr.String() || d.Channel != 0 {
+		t.Errorf("got %q from %s on channel %#04x", d.Data, d.Peer, d.Channel)
+	}
+
+	// ChannelBind and ChannelData
+	p2Addr := p2.LocalAddr().(*net.UDPAddr)
+	number, err := c.ChannelBind(p2Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number < stun.MinChannelNumber || number > stun.MaxChannelNumber {
+		t.Errorf("channel number %#04x is out of range", number)
+	}
+	if err := c.WriteTo([]byte("over channel"), p2Addr); err != nil {
+		t.Fatal(err)
+	}
+	if data, from := read(t, p2); data != "over channel" || from.String() != relayed.String() {
+		t.Errorf("peer received %q from %s, want from %s", data, from, relayed)
+	}
+	p2.WriteTo([]byte("back"), relayed)
+	if d := receive(t, c); string(d.Data) != "back" || d.Peer.String() != p2Addr.String() || d.Channel != number {
+		t.Errorf("got %q from %s on channel %#04x, want %#04x", d.Data, d.Peer, d.Channel, number)
+	}
+	// binding again refreshes the same channel
+	if again, err := c.ChannelBind(p2Addr); err != nil || again != number {
+		t.Errorf("rebinding got channel %#04x, %v", again, err)
+	}
+
+	// Refresh and deletion
+	lifetime, err := c.Refresh(20 * time.Minute)
+	if err != nil || lifetime != 20*time.Minute {
+		t.Errorf("refreshed for %s, %v", lifetime, err)
+	}
+	if lifetime, err := c.Refresh(0); err != nil || lifetime != 0 {
+		t.Fatalf("deleting got lifetime %s, %v", lifetime, err)
+	}
+	if c.RelayedAddr() != nil {
+		t.Errorf("relayed address %s remains after deletion", c.RelayedAddr())
+	}
+	if err := c.CreatePermission(net.IPv4(127, 0, 0, 1)); errorCode(err) != stun.CodeAllocationMismatch {
+		t.Errorf("CreatePermission after deletion: %v", err)
+	}
+}
+
+func TestAllocationMismatch(t *testing.T) {
+	c := newClient(t, newServer(t))
+	if _, err := c.Refresh(time.Minute); errorCode(err) != stun.CodeAllocationMismatch {
+		t.Errorf("Refresh without allocation: %v", err)
+	}
+	if _, err := c.Allocate(); err != nil {
+		t.Fatal(err)
+	}
+	// another Allocate transaction for the same 5-tuple
+	if _, err := c.Allocate(); errorCode(err) != stun.CodeAllocationMismatch {
+		t.Errorf("second Allocate: %v", err)
+	}
+}
+
+func TestChallengeAndStaleNonce(t *testing.T) {
+	server := newServer(t)
+	conn := newPeer(t, net.IPv4(127, 0, 0, 1))
+
+	req := allocateRequest()
+	res := roundTrip(t, conn, server, req)
+	if code := responseCode(t, res); code != stun.CodeUnauthorized {
+		t.Fatalf("unauthenticated Allocate got %d, want 401", code)
+	}
+	realm, ok := res.Attributes.Extract(stun.AttrRealm)
+	if !ok || string(realm.Value) != turn.DefaultRealm {
+		t.Errorf("REALM is %q", realm.Value)
+	}
+	nonce, ok := res.Attributes.Extract(stun.AttrNonce)
+	if !ok || len(nonce.Value) == 0 {
+		t.Fatal("NONCE is missing in 401")
+	}
+	key := stun.LongTermKey(testUser, turn.DefaultRealm, testPassword)
+
+	// a nonce the server did not issue
+	req = allocateRequest()
+	authenticate(t, req, key, []byte("stale"))
+	res = roundTrip(t, conn, server, req)
+	if code := responseCode(t, res); code != stun.CodeStaleNonce {
+		t.Fatalf("Allocate with stale nonce got %d, want 438", code)
+	}
+	fresh, ok := res.Attributes.Extract(stun.AttrNonce)
+	if !ok || string(fresh.Value) == string(nonce.Value) {
+		t.Fatalf("438 has no new NONCE: %q", fresh.Value)
+	}
+
+	req = allocateRequest()
+	authenticate(t, req, key, fresh.Value)
+	res = roundTrip(t, conn, server, req)
+	if code := responseCode(t, res); code != 0 {
+		t.Fatalf("Allocate with the new nonce got %d", code)
+	}
+	if err := res.CheckIntegrity(key); err != nil {
+		t.Errorf("response integrity: %s", err)
+	}
+
+	// wrong password is challenged again
+	req = allocateRequest()
+	authenticate(t, req, stun.LongTermKey(testUser, turn.DefaultRealm, "wrong"), fresh.Value)
+	if code := responseCode(t, roundTrip(t, conn, server, req)); code != stun.CodeUnauthorized {
+		t.Errorf("Allocate with wrong password got %d, want 401", code)
+	}
+}
+
+func allocateRequest() *stun.Message {
+	m := stun.NewMessage(stun.AllocateReq)
+	m.Attributes.Add(stun.AttrRequestedTransport, stun.RequestedTransport{Protocol: stun.TransportUDP}.Encode())
+	return m
+}
+
+func authenticate(t *testing.T, m *stun.Message, key, nonce []byte) {
+	t.Helper()
+	m.Attributes.Add(stun.AttrUsername, []byte(testUser))
+	m.Attributes.Add(stun.AttrRealm, []byte(turn.DefaultRealm))
+	m.Attributes.Add(stun.AttrNonce, nonce)
+	if err := m.AddIntegrity(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// roundTrip sends req from conn, and returns the response of the transaction
+func roundTrip(t *testing.T, conn *net.UDPConn, server *net.UDPAddr, req *stun.Message) *stun.Message {
+	t.Helper()
+	b, err := req.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(b, server); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no response: %s", err)
+		}
+		res := &stun.Message{}
+		if err := res.Decode(buf[:n]); err == nil && res.TransactionID == req.TransactionID {
+			return res
+		}
+	}
+}
+
+// responseCode returns the code of ERROR-CODE, 0 for success response
+func responseCode(t *testing.T, res *stun.Message) int {
+	t.Helper()
+	if !res.Type.IsError() {
+		return 0
+	}
+	attr, ok := res.Attributes.Extract(stun.AttrErrorCode)
+	if !ok {
+		t.Fatal("ERROR-CODE is missing in error response")
+	}
+	ec := stun.ErrorCode{}
+	if err := ec.Parse(attr); err != nil {
+		t.Fatal(err)
+	}
+	return ec.Code
+}
+
+// errorCode returns the code of err if it is ERROR-CODE of the server
+func errorCode(err error) int {
+	var ec stun.ErrorCode
+	if errors.As(err, &ec) {
+		return ec.Code
+	}
+	return 0
+}
@@ -0,0 +1,300 @@
+package upnp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHTTPTimeout = 5 * time.Second
+)
+
+// WAN connection services which provide port mapping, in preferred order
+var wanServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+var (
+	errNoWANService = errors.New("device has no WAN connection service")
+)
+
+// error codes of UPnP error in SOAP fault
+const (
+	// CodeOnlyPermanentLeasesSupported is returned by IGD v1 devices which
+	// accept only lease duration 0 in AddPortMapping
+	CodeOnlyPermanentLeasesSupported = 725
+)
+
+// Error is UPnP error returned in SOAP fault
+type Error struct {
+	Code        int
+	Description string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// Client is SOAP client of WANIPConnection or WANPPPConnection service
+type Client struct {
+	// Location is the URL of device description, empty if not discovered
+	Location     string
+	FriendlyName string
+	ServiceType  string
+	ControlURL   string
+	http         *http.Client
+}
+
+// NewClient returns client for the service at controlURL
+func NewClient(controlURL, serviceType string) *Client {
+	return &Client{
+		ServiceType: serviceType,
+		ControlURL:  controlURL,
+		http:        &http.Client{Timeout: defaultHTTPTimeout},
+	}
+}
+
+type deviceDesc struct {
+	URLBase string `xml:"URLBase"`
+	Device  device `xml:"device"`
+}
+
+type device struct {
+	FriendlyName string    `xml:"friendlyName"`
+	Services     []service `xml:"serviceList>service"`
+	Devices      []device  `xml:"deviceList>device"`
+}
+
+type service struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// NewClientFromLocation fetches device description at location,
+// and returns client of the most preferred WAN connection service in it
+func NewClientFromLocation(location string) (*Client, error) {
+	httpClient := &http.Client{Timeout: defaultHTTPTimeout}
+	res, err := httpClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get device description: %s", res.Status)
+	}
+
+	desc := deviceDesc{}
+	if err := xml.NewDecoder(res.Body).Decode(&desc); err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if desc.URLBase != "" {
+		if b, err := url.Parse(desc.URLBase); err == nil {
+			base = b
+		}
+	}
+
+	for _, st := range wanServiceTypes {
+		name, svc, ok := findService(desc.Device, st)
+		if !ok {
+			continue
+		}
+		ctrl, err := base.Parse(strings.TrimSpace(svc.ControlURL))
+		if err != nil {
+			return nil, err
+		}
+		// st is the service type without whitespace around it in the description
+		c := NewClient(ctrl.String(), st)
+		c.Location = location
+		c.FriendlyName = name
+		c.http = httpClient
+		return c, nil
+	}
+	return nil, errNoWANService
+}
+
+// findService searches device tree for serviceType, and returns the device name with it
+func findService(d device, serviceType string) (string, service, bool) {
+	for _, s := range d.Services {
+		if strings.TrimSpace(s.ServiceType) == serviceType {
+			return d.FriendlyName, s, true
+		}
+	}
+	for _, child := range d.Devices {
+		if name, s, ok := findService(child, serviceType); ok {
+			return name, s, true
+		}
+	}
+	return "", service{}, false
+}
+
+// GetExternalIPAddress returns the external address of the WAN connection
+func (c *Client) GetExternalIPAddress() (net.IP, error) {
+	res, err := c.call("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(res["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid external address: %q", res["NewExternalIPAddress"])
+	}
+	return ip, nil
+}
+
+// PortMapping is arguments of AddPortMapping
+type PortMapping struct {
+	RemoteHost     string // empty means any remote host
+	ExternalPort   uint16
+	Protocol       string // "UDP" or "TCP"
+	InternalPort   uint16
+	InternalClient net.IP
+	Description    string
+	LeaseDuration  time.Duration // 0 means permanent for v1
+}
+
+// AddPortMapping creates a port mapping on the gateway
+func (c *Client) AddPortMapping(m PortMapping) error {
+	_, err := c.call("AddPortMapping", []arg{
+		{"NewRemoteHost", m.RemoteHost},
+		{"NewExternalPort", strconv.Itoa(int(m.ExternalPort))},
+		{"NewProtocol", m.Protocol},
+		{"NewInternalPort", strconv.Itoa(int(m.InternalPort))},
+		{"NewInternalClient", m.InternalClient.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", m.Description},
+		{"NewLeaseDuration", strconv.Itoa(int(m.LeaseDuration / time.Second))},
+	})
+	return err
+}
+
+// AddPortMappingOrPermanent creates a port mapping like AddPortMapping, and
+// retries with a permanent lease if the gateway supports only permanent leases.
+// it returns the lease duration of the mapping created, 0 for permanent.
+func (c *Client) AddPortMappingOrPermanent(m PortMapping) (time.Duration, error) {
+	err := c.AddPortMapping(m)
+	var uerr Error
+	if m.LeaseDuration == 0 || !errors.As(err, &uerr) || uerr.Code != CodeOnlyPermanentLeasesSupported {
+		return m.LeaseDuration, err
+	}
+	m.LeaseDuration = 0
+	return 0, c.AddPortMapping(m)
+}
+
+// DeletePortMapping deletes the port mapping of externalPort
+func (c *Client) DeletePortMapping(remoteHost string, externalPort uint16, protocol string) error {
+	_, err := c.call("DeletePortMapping", []arg{
+		{"NewRemoteHost", remoteHost},
+		{"NewExternalPort", strconv.Itoa(int(externalPort))},
+		{"NewProtocol", protocol},
+	})
+	return err
+}
+
+type arg struct {
+	name  string
+	value string
+}
+
+// call invokes action with SOAP, and returns out arguments of the response
+func (c *Client) call(action string, args []arg) (map[string]string, error) {
+	body := new(bytes.Buffer)
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(body, `<u:%s xmlns:u="%s">`, action, c.ServiceType)
+	for _, a := range args {
+		fmt.Fprintf(body, "<%s>", a.name)
+		if err := xml.EscapeText(body, []byte(a.value)); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(body, "</%s>", a.name)
+	}
+	fmt.Fprintf(body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest(http.MethodPost, c.ControlURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, c.ServiceType, action))
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		if uerr, ok := parseFault(raw); ok {
+			return nil, uerr
+		}
+		return nil, fmt.Errorf("%s failed: %s", action, res.Status)
+	}
+	return parseOutArgs(raw, action+"Response")
+}
+
+// parseOutArgs returns child elements of the response element as name-value pairs
+func parseOutArgs(raw []byte, element string) (map[string]string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(raw))
+	out := map[string]string{}
+	inResponse := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local == element {
+			inResponse = true
+			continue
+		}
+		if !inResponse {
+			continue
+		}
+		var v string
+		if err := dec.DecodeElement(&v, &start); err != nil {
+			return nil, err
+		}
+		out[start.Name.Local] = strings.TrimSpace(v)
+	}
+	if !inResponse {
+		return nil, fmt.Errorf("%s was not found in SOAP response", element)
+	}
+	return out, nil
+}
+
+// parseFault extracts UPnPError from SOAP fault
+func parseFault(raw []byte) (Error, bool) {
+	var fault struct {
+		Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+		Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+	}
+	if err := xml.Unmarshal(raw, &fault); err != nil || fault.Code == 0 {
+		return Error{}, false
+	}
+	return Error{Code: fault.Code, Description: fault.Description}, true
+}
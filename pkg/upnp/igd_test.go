@@ -0,0 +1,266 @@
+package upnp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rootDesc has WANPPPConnection before WANIPConnection, nested as a real IGD v1
+const rootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <friendlyName>Home Router</friendlyName>
+    <serviceList>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+        <controlURL>/ctl/L3F</controlURL>
+      </service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <friendlyName>WANDevice</friendlyName>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <friendlyName>WANConnectionDevice</friendlyName>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANPPPConnection:1</serviceType>
+                <controlURL>/ctl/PPPConn</controlURL>
+              </service>
+              <service>
+                <serviceType>
+                  urn:schemas-upnp-org:service:WANIPConnection:1
+                </serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+func serveDesc(t *testing.T, desc string) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rootDesc.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, desc)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestNewClientFromLocation(t *testing.T) {
+	s := serveDesc(t, rootDesc)
+
+	c, err := NewClientFromLocation(s.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ServiceType != "urn:schemas-upnp-org:service:WANIPConnection:1" {
+		t.Errorf("service type = %q", c.ServiceType)
+	}
+	if c.ControlURL != s.URL+"/ctl/IPConn" {
+		t.Errorf("control URL = %q", c.ControlURL)
+	}
+	if c.FriendlyName != "WANConnectionDevice" {
+		t.Errorf("friendly name = %q", c.FriendlyName)
+	}
+}
+
+func TestNewClientFromLocationURLBase(t *testing.T) {
+	desc := strings.Replace(rootDesc, `<device>`, `<URLBase>http://192.168.0.1:49152/</URLBase><device>`, 1)
+	s := serveDesc(t, desc)
+
+	c, err := NewClientFromLocation(s.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ControlURL != "http://192.168.0.1:49152/ctl/IPConn" {
+		t.Errorf("control URL = %q", c.ControlURL)
+	}
+}
+
+func TestNewClientFromLocationNoWANService(t *testing.T) {
+	desc := strings.NewReplacer("WANPPPConnection", "Other", "WANIPConnection", "Other").Replace(rootDesc)
+	s := serveDesc(t, desc)
+
+	if _, err := NewClientFromLocation(s.URL + "/rootDesc.xml"); !errors.Is(err, errNoWANService) {
+		t.Errorf("got %v, want %v", err, errNoWANService)
+	}
+	if _, err := NewClientFromLocation(s.URL + "/missing.xml"); err == nil {
+		t.Error("missing description was accepted")
+	}
+}
+
+const serviceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+// fakeIGD answers SOAP actions with handle, which returns out arguments or a UPnP error
+func fakeIGD(t *testing.T, handle func(action string, args map[string]string) (map[string]string, *Error)) *Client {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+		st, action, ok := strings.Cut(soapAction, "#")
+		if r.Method != http.MethodPost || !ok || st != serviceType {
+			t.Errorf("%s with SOAPAction %q", r.Method, soapAction)
+		}
+		raw, _ := io.ReadAll(r.Body)
+		args, err := parseOutArgs(raw, action)
+		if err != nil {
+			t.Errorf("invalid request of %s: %s", action, err)
+		}
+
+		out, uerr := handle(action, args)
+		if uerr != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>
+<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+<errorCode>%d</errorCode><errorDescription>%s</errorDescription>
+</UPnPError></detail></s:Fault></s:Body></s:Envelope>`, uerr.Code, uerr.Description)
+			return
+		}
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="%s">`, action, serviceType)
+		for k, v := range out {
+			fmt.Fprintf(w, "<%s>%s</%s>", k, v, k)
+		}
+		fmt.Fprintf(w, "</u:%sResponse></s:Body></s:Envelope>", action)
+	}))
+	t.Cleanup(s.Close)
+	return NewClient(s.URL+"/ctl/IPConn", serviceType)
+}
+
+func TestGetExternalIPAddress(t *testing.T) {
+	c := fakeIGD(t, func(action string, args map[string]string) (map[string]string, *Error) {
+		if action != "GetExternalIPAddress" || len(args) != 0 {
+			t.Errorf("%s with %v", action, args)
+		}
+		return map[string]string{"NewExternalIPAddress": " 100.64.1.2 "}, nil
+	})
+
+	ip, err := c.GetExternalIPAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(100, 64, 1, 2)) {
+		t.Errorf("got %s", ip)
+	}
+}
+
+func TestAddPortMapping(t *testing.T) {
+	c := fakeIGD(t, func(action string, args map[string]string) (map[string]string, *Error) {
+		want := map[string]string{
+			"NewRemoteHost":             "",
+			"NewExternalPort":           "5000",
+			"NewProtocol":               "UDP",
+			"NewInternalPort":           "5001",
+			"NewInternalClient":         "192.168.0.10",
+			"NewEnabled":                "1",
+			"NewPortMappingDescription": "a <test> & more",
+			"NewLeaseDuration":          "60",
+		}
+		if action != "AddPortMapping" {
+			t.Errorf("action = %s", action)
+		}
+		for k, v := range want {
+			if args[k] != v {
+				t.Errorf("%s = %q, want %q", k, args[k], v)
+			}
+		}
+		return nil, nil
+	})
+
+	err := c.AddPortMapping(PortMapping{
+		ExternalPort:   5000,
+		Protocol:       "UDP",
+		InternalPort:   5001,
+		InternalClient: net.IPv4(192, 168, 0, 10),
+		Description:    "a <test> & more",
+		LeaseDuration:  time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSOAPFault(t *testing.T) {
+	c := fakeIGD(t, func(action string, args map[string]string) (map[string]string, *Error) {
+		return nil, &Error{Code: 714, Description: "NoSuchEntryInArray"}
+	})
+
+	err := c.DeletePortMapping("", 5000, "UDP")
+	var uerr Error
+	if !errors.As(err, &uerr) || uerr.Code != 714 || uerr.Description != "NoSuchEntryInArray" {
+		t.Errorf("got %#v", err)
+	}
+}
+
+func TestAddPortMappingOnlyPermanentLeases(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		leases []string
+	)
+	c := fakeIGD(t, func(action string, args map[string]string) (map[string]string, *Error) {
+		mu.Lock()
+		leases = append(leases, args["NewLeaseDuration"])
+		mu.Unlock()
+		if args["NewLeaseDuration"] != "0" {
+			return nil, &Error{Code: CodeOnlyPermanentLeasesSupported, Description: "OnlyPermanentLeasesSupported"}
+		}
+		return nil, nil
+	})
+	m := PortMapping{ExternalPort: 5000, Protocol: "UDP", InternalPort: 5000, InternalClient: net.IPv4(192, 168, 0, 10), LeaseDuration: time.Minute}
+
+	var uerr Error
+	if err := c.AddPortMapping(m); !errors.As(err, &uerr) || uerr.Code != CodeOnlyPermanentLeasesSupported {
+		t.Errorf("AddPortMapping got %v", err)
+	}
+	mu.Lock()
+	leases = nil
+	mu.Unlock()
+	lease, err := c.AddPortMappingOrPermanent(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if lease != 0 || !slices.Equal(leases, []string{"60", "0"}) {
+		t.Errorf("got lease %s after requests with %v", lease, leases)
+	}
+}
+
+func TestAddPortMappingOrPermanentOtherError(t *testing.T) {
+	var calls atomic.Int32
+	c := fakeIGD(t, func(action string, args map[string]string) (map[string]string, *Error) {
+		calls.Add(1)
+		return nil, &Error{Code: 718, Description: "ConflictInMappingEntry"}
+	})
+
+	lease, err := c.AddPortMappingOrPermanent(PortMapping{ExternalPort: 5000, Protocol: "UDP", InternalClient: net.IPv4(192, 168, 0, 10), LeaseDuration: time.Minute})
+	var uerr Error
+	if !errors.As(err, &uerr) || uerr.Code != 718 {
+		t.Errorf("got %v", err)
+	}
+	if calls.Load() != 1 || lease != time.Minute {
+		t.Errorf("%d requests, lease %s", calls.Load(), lease)
+	}
+}
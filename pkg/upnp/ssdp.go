@@ -0,0 +1,127 @@
+// Package upnp implements SSDP discovery and UPnP Internet Gateway Device
+// client for WANIPConnection and WANPPPConnection services.
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+)
+
+const (
+	ssdpAddr = "239.255.255.250:1900"
+	// seconds devices may delay the response
+	ssdpMX = 2
+)
+
+// search targets of M-SEARCH, WANIPConnection is preferred to WANPPPConnection
+var searchTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+var (
+	ErrNoDevice = errors.New("no UPnP Internet Gateway Device was found")
+)
+
+// Discover multicasts M-SEARCH from lip, and returns clients of every
+// WAN connection service found until timeout elapses.
+// lip may be nil to let OS choose the interface.
+func Discover(lip net.IP, timeout time.Duration) ([]*Client, error) {
+	locations, err := searchLocations(lip, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []*Client
+	for _, loc := range locations {
+		c, err := NewClientFromLocation(loc)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("skip UPnP device %s: %s", loc, err))
+			continue
+		}
+		clients = append(clients, c)
+	}
+	if len(clients) == 0 {
+		return nil, ErrNoDevice
+	}
+	return clients, nil
+}
+
+// searchLocations returns distinct LOCATION headers of M-SEARCH responses
+func searchLocations(lip net.IP, timeout time.Duration) ([]string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: lip})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range searchTargets {
+		req := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\n"+
+			"HOST: %s\r\n"+
+			"MAN: \"ssdp:discover\"\r\n"+
+			"MX: %d\r\n"+
+			"ST: %s\r\n\r\n", ssdpAddr, ssdpMX, st)
+		if _, err := conn.WriteTo([]byte(req), dst); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	return readLocations(conn)
+}
+
+// readLocations reads M-SEARCH responses from conn until the read deadline,
+// and returns distinct LOCATION headers in arrival order
+func readLocations(conn net.PacketConn) ([]string, error) {
+	seen := map[string]bool{}
+	var locations []string
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			return nil, err
+		}
+		loc, st, err := parseSearchResponse(buf[:n])
+		if err != nil {
+			logger.Debug(fmt.Sprintf("ignore invalid SSDP response from %s: %s", from, err))
+			continue
+		}
+		logger.Debug(fmt.Sprintf("SSDP response from %s: ST=%s LOCATION=%s", from, st, loc))
+		if loc == "" || seen[loc] {
+			continue
+		}
+		seen[loc] = true
+		locations = append(locations, loc)
+	}
+	return locations, nil
+}
+
+// parseSearchResponse returns LOCATION and ST headers of M-SEARCH response
+func parseSearchResponse(b []byte) (location, st string, err error) {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return "", "", err
+	}
+	res.Body.Close()
+	return res.Header.Get("Location"), res.Header.Get("St"), nil
+}
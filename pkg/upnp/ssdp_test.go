@@ -0,0 +1,70 @@
+package upnp
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+const searchResponse = "HTTP/1.1 200 OK\r\n" +
+	"CACHE-CONTROL: max-age=120\r\n" +
+	"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+	"USN: uuid:1234::urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+	"EXT:\r\n" +
+	"SERVER: test UPnP/1.1\r\n" +
+	"LOCATION: http://192.168.0.1:5000/rootDesc.xml\r\n" +
+	"\r\n"
+
+func TestParseSearchResponse(t *testing.T) {
+	loc, st, err := parseSearchResponse([]byte(searchResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc != "http://192.168.0.1:5000/rootDesc.xml" {
+		t.Errorf("location = %q", loc)
+	}
+	if st != "urn:schemas-upnp-org:device:InternetGatewayDevice:1" {
+		t.Errorf("st = %q", st)
+	}
+
+	if _, _, err := parseSearchResponse([]byte("NOTIFY * HTTP/1.1\r\n\r\n")); err == nil {
+		t.Error("notification was parsed as response")
+	}
+}
+
+func TestReadLocations(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	device, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	other := "HTTP/1.1 200 OK\r\nST: urn:schemas-upnp-org:service:WANIPConnection:1\r\nLOCATION: http://192.168.0.2/desc.xml\r\n\r\n"
+	for _, res := range []string{
+		searchResponse,
+		"garbage",
+		searchResponse, // a device answers every search target
+		"HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\n\r\n",
+		other,
+	} {
+		if _, err := device.Write([]byte(res)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	locations, err := readLocations(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://192.168.0.1:5000/rootDesc.xml", "http://192.168.0.2/desc.xml"}
+	if !slices.Equal(locations, want) {
+		t.Errorf("locations = %q, want %q", locations, want)
+	}
+}
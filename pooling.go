@@ -0,0 +1,120 @@
+package mynat
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/stun"
+)
+
+const (
+	defaultPoolingSockets = 4
+	defaultPoolingServers = 3
+)
+
+// PoolingResult is IP address pooling behavior of NAT
+// see RFC 4787 Section 4.1 and REQ-2
+type PoolingResult struct {
+	// Probes are mappings grouped by local socket
+	Probes [][]MappingProbe
+}
+
+// ExternalIPs returns distinct external IP addresses in the order they were seen
+func (r PoolingResult) ExternalIPs() []net.IP {
+	var ips []net.IP
+	for _, probes := range r.Probes {
+		for _, p := range probes {
+			if !containIP(ips, p.Mapped.IP) {
+				ips = append(ips, p.Mapped.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// Paired reports whether every session of the internal host is mapped to the same external IP.
+// all sockets are bound to the same internal address, so any variation means arbitrary pooling.
+func (r PoolingResult) Paired() bool {
+	return len(r.ExternalIPs()) == 1
+}
+
+func (r PoolingResult) String() string {
+	ips := r.ExternalIPs()
+	if len(ips) == 0 {
+		return "could not determine"
+	}
+	if r.Paired() {
+		return fmt.Sprintf("paired, single external address %s", ips[0])
+	}
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return fmt.Sprintf("arbitrary, %d external addresses used (%s)", len(ips), strings.Join(s, ", "))
+}
+
+// Detail returns probes as lines grouped by local socket
+func (r PoolingResult) Detail() string {
+	var b strings.Builder
+	for i, probes := range r.Probes {
+		for _, p := range probes {
+			fmt.Fprintf(&b, "  socket#%d %s\n", i+1, p)
+		}
+	}
+	return b.String()
+}
+
+// probePooling opens sockets local sockets, and sends Binding-Request to
+// every server from each socket to compare external IP addresses assigned.
+// servers which do not respond are skipped.
+func probePooling(lip net.IP, servers []stunServer, sockets int, opts ...stun.ClientOption) (PoolingResult, error) {
+	result := PoolingResult{}
+	for i := 0; i < sockets; i++ {
+		c, err := stun.NewPacketClient(lip, opts...)
+		if err != nil {
+			return PoolingResult{}, err
+		}
+		defer c.Close()
+
+		var probes []MappingProbe
+		for _, s := range servers {
+			p, err := probeMapping(c, s)
+			if err != nil {
+				logger.Warn(fmt.Sprintf("skip %s for pooling test: %s", s.name, err))
+				continue
+			}
+			probes = append(probes, p)
+		}
+		result.Probes = append(result.Probes, probes)
+	}
+	return result, nil
+}
+
+// distinctServers resolves candidates in order for network, and returns
+// up to n servers which have distinct IP addresses
+func distinctServers(candidates []string, network string, n int) []stunServer {
+	var servers []stunServer
+	for _, c := range candidates {
+		if len(servers) >= n {
+			break
+		}
+		s, err := resolveServer(c, network)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("skip STUN server %s: %s", c, err))
+			continue
+		}
+		dup := false
+		for _, other := range servers {
+			if other.addr.IP.Equal(s.addr.IP) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
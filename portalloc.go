@@ -0,0 +1,145 @@
+package mynat
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ek-170/myroute/pkg/stun"
+)
+
+const (
+	defaultPortSamples = 10
+
+	// delta which appears in more than this ratio of samples is dominant
+	dominantDeltaRatio = 0.8
+)
+
+// PortSample is a pair of local port and external port assigned for it
+type PortSample struct {
+	Local  *net.UDPAddr
+	Mapped *net.UDPAddr
+}
+
+// PortAllocation is port assignment behavior of NAT
+// see RFC 4787 Section 4.2
+type PortAllocation struct {
+	Samples []PortSample
+
+	// Preserved is the number of samples whose external port equals local port
+	Preserved int
+	// ParityPreserved is the number of samples whose external port has the same parity as local port
+	ParityPreserved int
+	// Delta is the dominant difference between successive external ports, 0 if there is not
+	Delta int
+	// DeltaCount is the number of successive pairs whose difference equals Delta
+	DeltaCount int
+}
+
+// PortPreservation reports whether NAT keeps local port as external port
+func (pa PortAllocation) PortPreservation() bool {
+	return len(pa.Samples) > 0 && pa.Preserved == len(pa.Samples)
+}
+
+// ParityPreservation reports whether NAT keeps parity of local port
+func (pa PortAllocation) ParityPreservation() bool {
+	return len(pa.Samples) > 0 && pa.ParityPreserved == len(pa.Samples)
+}
+
+// Contiguous reports whether NAT assigns external ports with a constant delta
+func (pa PortAllocation) Contiguous() bool {
+	pairs := len(pa.Samples) - 1
+	return pairs > 0 && pa.Delta != 0 && float64(pa.DeltaCount) >= float64(pairs)*dominantDeltaRatio
+}
+
+// Randomized reports whether external ports are neither preserved nor contiguous
+func (pa PortAllocation) Randomized() bool {
+	return len(pa.Samples) > 1 && !pa.PortPreservation() && !pa.Contiguous()
+}
+
+func (pa PortAllocation) String() string {
+	var behavior string
+	switch {
+	case pa.PortPreservation():
+		behavior = "port preservation"
+	case pa.Contiguous():
+		behavior = fmt.Sprintf("port contiguity (delta %+d)", pa.Delta)
+	case pa.Randomized():
+		behavior = "randomized"
+	default:
+		behavior = "could not determine"
+	}
+	parity := "not preserved"
+	if pa.ParityPreservation() {
+		parity = "preserved"
+	}
+	return fmt.Sprintf("%s, parity %s (%d samples)", behavior, parity, len(pa.Samples))
+}
+
+// Ports returns external ports in the order they were assigned
+func (pa PortAllocation) Ports() []int {
+	ports := make([]int, len(pa.Samples))
+	for i, s := range pa.Samples {
+		ports[i] = s.Mapped.Port
+	}
+	return ports
+}
+
+// Detail returns samples as lines of "local -> mapped"
+func (pa PortAllocation) Detail() string {
+	var b strings.Builder
+	for i, s := range pa.Samples {
+		fmt.Fprintf(&b, "  #%02d %s -> %s\n", i+1, s.Local, s.Mapped)
+	}
+	return b.String()
+}
+
+// probePortAllocation opens n local sockets in sequence, and records
+// the external port assigned for each by sending Binding-Request to server.
+// sockets are kept open until all samples are taken, so that local ports are not reused.
+func probePortAllocation(lip net.IP, server stunServer, n int, opts ...stun.ClientOption) (PortAllocation, error) {
+	samples := make([]PortSample, 0, n)
+	for i := 0; i < n; i++ {
+		c, err := stun.NewPacketClient(lip, opts...)
+		if err != nil {
+			return PortAllocation{}, err
+		}
+		defer c.Close()
+
+		p, err := probeMapping(c, server)
+		if err != nil {
+			return PortAllocation{}, err
+		}
+		samples = append(samples, PortSample{Local: p.Local, Mapped: p.Mapped})
+	}
+	return analyzePortAllocation(samples), nil
+}
+
+// analyzePortAllocation classifies port assignment from samples in assigned order
+func analyzePortAllocation(samples []PortSample) PortAllocation {
+	pa := PortAllocation{Samples: samples}
+	deltas := map[int]int{}
+	for i, s := range samples {
+		if s.Mapped.Port == s.Local.Port {
+			pa.Preserved++
+		}
+		if s.Mapped.Port%2 == s.Local.Port%2 {
+			pa.ParityPreserved++
+		}
+		if i > 0 {
+			deltas[wrapDelta(s.Mapped.Port-samples[i-1].Mapped.Port)]++
+		}
+	}
+	for d, count := range deltas {
+		if d == 0 || count < pa.DeltaCount {
+			continue
+		}
+		// ties go to the smallest |d|, then to the positive one, independent of map order
+		if count == pa.DeltaCount && (abs(d) > abs(pa.Delta) || (abs(d) == abs(pa.Delta) && d < pa.Delta)) {
+			continue
+		}
+		pa.Delta = d
+		pa.DeltaCount = count
+	}
+	return pa
+}
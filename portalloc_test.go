@@ -0,0 +1,128 @@
+package mynat
+
+import (
+	"net"
+	"testing"
+)
+
+// portSamples pairs local and mapped ports in order
+func portSamples(local, mapped []int) []PortSample {
+	samples := make([]PortSample, len(mapped))
+	for i := range mapped {
+		samples[i] = PortSample{
+			Local:  &net.UDPAddr{IP: net.IPv4(192, 168, 0, 10), Port: local[i]},
+			Mapped: &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: mapped[i]},
+		}
+	}
+	return samples
+}
+
+func TestAnalyzePortAllocation(t *testing.T) {
+	local := []int{40001, 40003, 40005, 40007, 40009, 40011}
+	tests := []struct {
+		name     string
+		local    []int
+		mapped   []int
+		behavior string
+		delta    int
+		count    int
+		parity   bool
+	}{
+		{
+			name:     "preserved",
+			local:    local,
+			mapped:   local,
+			behavior: "preservation",
+			delta:    2, count: 5, parity: true,
+		},
+		{
+			name:     "sequential",
+			local:    local,
+			mapped:   []int{6000, 6001, 6002, 6003, 6004, 6005},
+			behavior: "contiguous",
+			delta:    1, count: 5,
+		},
+		{
+			name:     "strided",
+			local:    local,
+			mapped:   []int{6001, 6003, 6005, 6007, 6009, 6011},
+			behavior: "contiguous",
+			delta:    2, count: 5, parity: true,
+		},
+		{
+			name:     "strided with a port taken by another host",
+			local:    local,
+			mapped:   []int{6000, 6002, 6004, 6010, 6012, 6014},
+			behavior: "contiguous",
+			delta:    2, count: 4,
+		},
+		{
+			name:     "sequential wrapping around past 65535",
+			local:    local,
+			mapped:   []int{65532, 65533, 65534, 65535, 1024, 1025},
+			behavior: "contiguous",
+			delta:    1, count: 5,
+		},
+		{
+			name:     "random",
+			local:    local,
+			mapped:   []int{31547, 60233, 2219, 48810, 17765, 9342},
+			behavior: "random",
+			delta:    6498, count: 1,
+		},
+		{
+			name:     "tie goes to the smallest delta",
+			local:    local[:5],
+			mapped:   []int{6000, 6003, 6004, 6007, 6008},
+			behavior: "random",
+			delta:    1, count: 2,
+		},
+		{
+			name:     "tie goes to the positive delta",
+			local:    local[:5],
+			mapped:   []int{6000, 6002, 6000, 6002, 6000},
+			behavior: "random",
+			delta:    2, count: 2,
+		},
+		{
+			name:     "same port for every socket",
+			local:    local[:3],
+			mapped:   []int{6000, 6000, 6000},
+			behavior: "random",
+		},
+		{
+			name:     "single sample",
+			local:    local[:1],
+			mapped:   []int{6000},
+			behavior: "undetermined",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// map iteration order must not change the dominant delta
+			for range 20 {
+				pa := analyzePortAllocation(portSamples(tt.local, tt.mapped))
+				if pa.Delta != tt.delta || pa.DeltaCount != tt.count {
+					t.Fatalf("delta %+d x%d, want %+d x%d", pa.Delta, pa.DeltaCount, tt.delta, tt.count)
+				}
+				var behavior string
+				switch {
+				case pa.PortPreservation():
+					behavior = "preservation"
+				case pa.Contiguous():
+					behavior = "contiguous"
+				case pa.Randomized():
+					behavior = "random"
+				default:
+					behavior = "undetermined"
+				}
+				if behavior != tt.behavior {
+					t.Fatalf("classified as %s, want %s: %s", behavior, tt.behavior, pa)
+				}
+				if pa.ParityPreservation() != tt.parity {
+					t.Fatalf("parity preservation = %t", pa.ParityPreservation())
+				}
+			}
+		})
+	}
+}
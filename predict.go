@@ -0,0 +1,244 @@
+package mynat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// deltas within this distance from the median delta are treated as
+	// the same allocation step, other hosts behind NAT may consume ports in between
+	deltaJitterTolerance = 10
+
+	// ports both peers open for birthday-style hole punching
+	defaultBirthdayProbes = 256
+
+	linearConfidenceThreshold  = 0.6
+	birthdaySuccessThreshold   = 0.5
+	minPortPredictionSamples   = 3
+	maxPortNumber              = 65535
+	minDynamicPortNumber       = 1024
+	linearPredictionCandidates = 5
+
+	// NAT wraps sequential allocation around past the highest port,
+	// typically to the bottom of the dynamic range
+	dynamicPortRange = maxPortNumber - minDynamicPortNumber + 1
+)
+
+var (
+	ErrTooFewPortSamples = errors.New("too few port samples to predict")
+)
+
+type PredictionMethod string
+
+const (
+	PredictLinear PredictionMethod = "linear"
+	PredictRandom PredictionMethod = "random"
+)
+
+// PortPrediction is an estimation of the next external port NAT assigns
+type PortPrediction struct {
+	Method PredictionMethod
+	// Next is the most likely next external port
+	Next int
+	// WindowLow and WindowHigh are the range the next port is expected in
+	WindowLow  int
+	WindowHigh int
+	// Step is the estimated delta between successive ports, 0 for random
+	Step int
+	// Confidence is a score between 0 and 1 that Next (or the window) is right
+	Confidence float64
+}
+
+// WindowSize returns the number of ports in the predicted window
+func (p PortPrediction) WindowSize() int {
+	return p.WindowHigh - p.WindowLow + 1
+}
+
+// Candidates returns up to n ports to try in order of likelihood
+func (p PortPrediction) Candidates(n int) []int {
+	ports := make([]int, 0, n)
+	seen := map[int]bool{}
+	add := func(port, low, high int) {
+		if port >= low && port <= high && !seen[port] && len(ports) < n {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	add(p.Next, p.WindowLow, p.WindowHigh)
+	if p.Method == PredictLinear {
+		// the following assignments of the same step come next,
+		// other sessions may take the predicted port first
+		for k := 1; k < linearPredictionCandidates; k++ {
+			add(p.Next+k*p.Step, 1, maxPortNumber)
+		}
+	}
+	for d := 1; len(ports) < n && d <= p.WindowSize(); d++ {
+		add(p.Next+d, p.WindowLow, p.WindowHigh)
+		add(p.Next-d, p.WindowLow, p.WindowHigh)
+	}
+	return ports
+}
+
+// BirthdaySuccess estimates the probability that birthday-style hole punching
+// succeeds when each peer uses probes ports, assuming ports are uniformly
+// distributed in the predicted window
+func (p PortPrediction) BirthdaySuccess(probes int) float64 {
+	w := float64(p.WindowSize())
+	if w <= float64(probes) {
+		return 1
+	}
+	return 1 - math.Exp(-float64(probes)*float64(probes)/w)
+}
+
+// Recommendation returns the traversal strategy suggested by the prediction
+func (p PortPrediction) Recommendation() string {
+	switch {
+	case p.Method == PredictLinear && p.Confidence >= linearConfidenceThreshold:
+		return "hole punching to predicted ports"
+	case p.BirthdaySuccess(defaultBirthdayProbes) >= birthdaySuccessThreshold:
+		return fmt.Sprintf("birthday-style hole punching (%d ports each side)", defaultBirthdayProbes)
+	default:
+		return "TURN relay"
+	}
+}
+
+func (p PortPrediction) String() string {
+	if p.Method == PredictLinear {
+		return fmt.Sprintf("linear (step %+d), next port %d in [%d, %d], confidence %.2f",
+			p.Step, p.Next, p.WindowLow, p.WindowHigh, p.Confidence)
+	}
+	return fmt.Sprintf("random, window [%d, %d] (%d ports), confidence %.4f",
+		p.WindowLow, p.WindowHigh, p.WindowSize(), p.Confidence)
+}
+
+// PredictNextPort estimates the next external port from external ports
+// observed in the order they were assigned
+func PredictNextPort(ports []int) (PortPrediction, error) {
+	if len(ports) < minPortPredictionSamples {
+		return PortPrediction{}, ErrTooFewPortSamples
+	}
+
+	deltas := make([]int, len(ports)-1)
+	for i := 1; i < len(ports); i++ {
+		deltas[i-1] = wrapDelta(ports[i] - ports[i-1])
+	}
+	median := medianInt(deltas)
+
+	var near []int
+	for _, d := range deltas {
+		if abs(d-median) <= deltaJitterTolerance {
+			near = append(near, d)
+		}
+	}
+	// more samples give more weight to the observed ratio
+	weight := float64(len(deltas)) / float64(len(deltas)+1)
+	ratio := float64(len(near)) / float64(len(deltas))
+	last := ports[len(ports)-1]
+
+	// step 0 means the same external port is reused for every socket
+	if ratio >= 0.5 {
+		sum, spread := 0, 0
+		for _, d := range near {
+			sum += d
+		}
+		step := int(math.Round(float64(sum) / float64(len(near))))
+		for _, d := range near {
+			spread = max(spread, abs(d-step))
+		}
+		next := wrapPort(last + step)
+		return PortPrediction{
+			Method:     PredictLinear,
+			Next:       next,
+			WindowLow:  clampPort(next - spread),
+			WindowHigh: clampPort(next + spread),
+			Step:       step,
+			Confidence: ratio * weight,
+		}, nil
+	}
+
+	// no regular step, the next port is somewhere in the range seen so far
+	low, high := ports[0], ports[0]
+	for _, p := range ports {
+		low = min(low, p)
+		high = max(high, p)
+	}
+	// observed range underestimates the pool, widen it by the average gap
+	gap := (high - low) / len(ports)
+	low = max(clampPort(low-gap), minDynamicPortNumber)
+	high = clampPort(high + gap)
+	if low > high {
+		low = high
+	}
+	return PortPrediction{
+		Method:     PredictRandom,
+		Next:       (low + high) / 2,
+		WindowLow:  low,
+		WindowHigh: high,
+		Confidence: weight / float64(high-low+1),
+	}, nil
+}
+
+// PredictPorts maps samples local sockets in sequence through public STUN server,
+// and predicts the next external port from the observed ports
+func PredictPorts(targetIface string, samples int) (PortAllocation, PortPrediction, error) {
+	choice, err := localIPv4(targetIface)
+	if err != nil {
+		return PortAllocation{}, PortPrediction{}, err
+	}
+	server, err := firstServer(defaultServers, "udp4")
+	if err != nil {
+		return PortAllocation{}, PortPrediction{}, err
+	}
+	alloc, err := probePortAllocation(choice.Addr.IP(), server, samples)
+	if err != nil {
+		return PortAllocation{}, PortPrediction{}, err
+	}
+	prediction, err := PredictNextPort(alloc.Ports())
+	if err != nil {
+		return alloc, PortPrediction{}, err
+	}
+	return alloc, prediction, nil
+}
+
+func medianInt(values []int) int {
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	return sorted[len(sorted)/2]
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// wrapDelta returns the shorter delta around the dynamic port range,
+// so that a sequence wrapping around past 65535 keeps its step
+func wrapDelta(d int) int {
+	switch {
+	case d > dynamicPortRange/2:
+		return d - dynamicPortRange
+	case d < -dynamicPortRange/2:
+		return d + dynamicPortRange
+	}
+	return d
+}
+
+// wrapPort wraps port out of the port number space around the dynamic port range
+func wrapPort(port int) int {
+	switch {
+	case port > maxPortNumber:
+		return port - dynamicPortRange
+	case port < 1:
+		return port + dynamicPortRange
+	}
+	return port
+}
+
+func clampPort(port int) int {
+	return min(max(port, 1), maxPortNumber)
+}
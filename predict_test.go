@@ -0,0 +1,132 @@
+package mynat
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestPredictNextPort(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []int
+		want  PortPrediction
+	}{
+		{
+			name:  "constant delta",
+			ports: []int{5000, 5001, 5002, 5003},
+			want:  PortPrediction{Method: PredictLinear, Next: 5004, WindowLow: 5004, WindowHigh: 5004, Step: 1, Confidence: 0.75},
+		},
+		{
+			name:  "delta greater than 1",
+			ports: []int{5000, 5004, 5008, 5012},
+			want:  PortPrediction{Method: PredictLinear, Next: 5016, WindowLow: 5016, WindowHigh: 5016, Step: 4, Confidence: 0.75},
+		},
+		{
+			name:  "negative delta",
+			ports: []int{5012, 5008, 5004},
+			want:  PortPrediction{Method: PredictLinear, Next: 5000, WindowLow: 5000, WindowHigh: 5000, Step: -4, Confidence: 2.0 / 3},
+		},
+		{
+			name:  "preserved port",
+			ports: []int{5000, 5000, 5000},
+			want:  PortPrediction{Method: PredictLinear, Next: 5000, WindowLow: 5000, WindowHigh: 5000, Step: 0, Confidence: 2.0 / 3},
+		},
+		{
+			name:  "jitter by other hosts",
+			ports: []int{5000, 5001, 5003, 5004, 5005},
+			want:  PortPrediction{Method: PredictLinear, Next: 5006, WindowLow: 5005, WindowHigh: 5007, Step: 1, Confidence: 0.8},
+		},
+		{
+			name:  "outlier lowers confidence",
+			ports: []int{5000, 5002, 5004, 30000, 30002},
+			want:  PortPrediction{Method: PredictLinear, Next: 30004, WindowLow: 30004, WindowHigh: 30004, Step: 2, Confidence: 0.75 * 0.8},
+		},
+		{
+			name:  "next wraps around past 65535",
+			ports: []int{65530, 65532, 65534},
+			want:  PortPrediction{Method: PredictLinear, Next: 1024, WindowLow: 1024, WindowHigh: 1024, Step: 2, Confidence: 2.0 / 3},
+		},
+		{
+			name:  "samples wrap around past 65535",
+			ports: []int{65531, 65533, 65535, 1025},
+			want:  PortPrediction{Method: PredictLinear, Next: 1027, WindowLow: 1027, WindowHigh: 1027, Step: 2, Confidence: 0.75},
+		},
+		{
+			name:  "random",
+			ports: []int{40000, 12000, 61000, 3000, 25000},
+			want:  PortPrediction{Method: PredictRandom, Next: 33279, WindowLow: 1024, WindowHigh: 65535, Confidence: 0.8 / 64512},
+		},
+		{
+			name:  "random in a narrow pool",
+			ports: []int{20000, 20500, 20100, 20900},
+			want:  PortPrediction{Method: PredictRandom, Next: 20450, WindowLow: 19775, WindowHigh: 21125, Confidence: 0.75 / 1351},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PredictNextPort(tt.ports)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got.Confidence-tt.want.Confidence) > 1e-9 {
+				t.Errorf("confidence = %v, want %v", got.Confidence, tt.want.Confidence)
+			}
+			got.Confidence = tt.want.Confidence
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPredictNextPortTooFewSamples(t *testing.T) {
+	for _, ports := range [][]int{nil, {5000}, {5000, 5001}} {
+		if _, err := PredictNextPort(ports); !errors.Is(err, ErrTooFewPortSamples) {
+			t.Errorf("%v: got %v", ports, err)
+		}
+	}
+}
+
+func TestBirthdaySuccess(t *testing.T) {
+	tests := []struct {
+		window int
+		probes int
+		want   float64
+	}{
+		{window: 1, probes: 1, want: 1},
+		{window: 256, probes: 256, want: 1},
+		{window: 1000, probes: 0, want: 0},
+		{window: 64512, probes: 256, want: 1 - math.Exp(-65536.0/64512)},
+		{window: 64512, probes: 64, want: 1 - math.Exp(-4096.0/64512)},
+		{window: 10000, probes: 100, want: 1 - math.Exp(-1)},
+	}
+	for _, tt := range tests {
+		p := PortPrediction{Method: PredictRandom, WindowLow: 1024, WindowHigh: 1024 + tt.window - 1}
+		if got := p.BirthdaySuccess(tt.probes); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("window %d, %d probes: got %v, want %v", tt.window, tt.probes, got, tt.want)
+		}
+	}
+	// about 64% with the default probes over the whole dynamic range
+	if got := (PortPrediction{WindowLow: minDynamicPortNumber, WindowHigh: maxPortNumber}).BirthdaySuccess(defaultBirthdayProbes); math.Abs(got-0.638) > 0.001 {
+		t.Errorf("default probes over dynamic range: got %v", got)
+	}
+}
+
+func TestRecommendation(t *testing.T) {
+	tests := []struct {
+		p    PortPrediction
+		want string
+	}{
+		{PortPrediction{Method: PredictLinear, Next: 5000, WindowLow: 5000, WindowHigh: 5000, Step: 1, Confidence: 0.75}, "hole punching to predicted ports"},
+		{PortPrediction{Method: PredictLinear, Next: 5000, WindowLow: 4990, WindowHigh: 5010, Step: 1, Confidence: 0.5}, "birthday-style hole punching (256 ports each side)"},
+		{PortPrediction{Method: PredictRandom, WindowLow: 1024, WindowHigh: 65535}, "birthday-style hole punching (256 ports each side)"},
+		// wider than any port range, only to cover the fallback
+		{PortPrediction{Method: PredictRandom, WindowLow: 1, WindowHigh: 65535 * 2}, "TURN relay"},
+	}
+	for _, tt := range tests {
+		if got := tt.p.Recommendation(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.p, got, tt.want)
+		}
+	}
+}
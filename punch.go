@@ -0,0 +1,320 @@
+package mynat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/rendezvous"
+	"github.com/ek-170/myroute/pkg/stun"
+	"github.com/ek-170/myroute/pkg/transport"
+)
+
+const (
+	defaultPunchTimeout  = 10 * time.Second
+	defaultPeerWait      = time.Minute
+	punchInterval        = 100 * time.Millisecond
+	punchGracePeriod     = time.Second
+	punchReceiveInterval = 100 * time.Millisecond
+)
+
+var (
+	errNoPeerCandidate = errors.New("peer registered no usable candidate")
+)
+
+type punchConfig struct {
+	lport     int
+	session   string
+	server    string
+	timeout   time.Duration
+	peerWait  time.Duration
+	transport transport.Transport
+}
+
+type PunchOption func(c *punchConfig)
+
+// WithPunchLocalPort binds the punching socket to port
+func WithPunchLocalPort(port int) PunchOption {
+	return func(c *punchConfig) {
+		c.lport = port
+	}
+}
+
+// WithSession joins rendezvous session sid, which is derived from
+// both peer ids if not specified
+func WithSession(sid string) PunchOption {
+	return func(c *punchConfig) {
+		c.session = sid
+	}
+}
+
+// WithPunchSTUNServer learns server reflexive candidate from server
+// instead of public STUN servers
+func WithPunchSTUNServer(server string) PunchOption {
+	return func(c *punchConfig) {
+		c.server = server
+	}
+}
+
+// WithPunchTimeout sets how long to keep punching
+func WithPunchTimeout(d time.Duration) PunchOption {
+	return func(c *punchConfig) {
+		c.timeout = d
+	}
+}
+
+// WithPeerWait sets how long to wait for the peer to register
+func WithPeerWait(d time.Duration) PunchOption {
+	return func(c *punchConfig) {
+		c.peerWait = d
+	}
+}
+
+// CandidatePair is a pair of candidates a connectivity check succeeded on
+type CandidatePair struct {
+	// Local is the address the peer saw the check from,
+	// which is one of local candidates if the NAT kept the mapping
+	Local *net.UDPAddr
+	// Remote is the candidate of the peer the check was sent to
+	Remote rendezvous.Candidate
+}
+
+func (p CandidatePair) String() string {
+	return fmt.Sprintf("%s -> %s (%s)", p.Local, p.Remote.Addr, p.Remote.Type)
+}
+
+// WithPunchTransport opens the punching socket with t instead of the host network stack
+func WithPunchTransport(t transport.Transport) PunchOption {
+	return func(c *punchConfig) {
+		c.transport = t
+	}
+}
+
+// PunchResult is a result of UDP hole punching between two peers
+type PunchResult struct {
+	Session string
+	ID      string
+	Peer    string
+	Local   []rendezvous.Candidate
+	Remote  []rendezvous.Candidate
+	Success bool
+	// FirstPacket is the time from the start of punching until the first
+	// packet from the peer arrived, 0 if nothing arrived
+	FirstPacket time.Duration
+	// FirstFrom is the address the first packet came from
+	FirstFrom *net.UDPAddr
+	// Pair is the first pair the check succeeded on, nil if failed
+	Pair *CandidatePair
+	RTT  time.Duration
+}
+
+func (r PunchResult) String() string {
+	if !r.Success {
+		if r.FirstFrom != nil {
+			return fmt.Sprintf("failed, packet from %s arrived after %s but no check succeeded", r.FirstFrom, r.FirstPacket)
+		}
+		return "failed, no packet arrived from the peer, relay is required"
+	}
+	return fmt.Sprintf("succeeded on %s, first packet after %s, rtt %s", r.Pair, r.FirstPacket.Round(time.Microsecond), r.RTT.Round(time.Microsecond))
+}
+
+// Detail returns candidates of both peers as lines
+func (r PunchResult) Detail() string {
+	var b strings.Builder
+	for _, c := range r.Local {
+		fmt.Fprintf(&b, "  local  %-5s %s\n", c.Type, c.Addr)
+	}
+	for _, c := range r.Remote {
+		fmt.Fprintf(&b, "  remote %-5s %s\n", c.Type, c.Addr)
+	}
+	return b.String()
+}
+
+// Punch registers candidates of this host as id in a session of rendezvous
+// server at rendezvousURL, waits for peer to join, and sends Binding-Request to
+// every candidate of peer from a single socket while answering the checks of
+// the peer. both peers start punching at the time the server scheduled, so that
+// each NAT sees outbound packets before inbound ones of the peer. USERNAME
+// carries "peer:id" as ICE does, so that checks of other sessions are not answered.
+func Punch(targetIface, rendezvousURL, id, peer string, opts ...PunchOption) (PunchResult, error) {
+	c := punchConfig{
+		timeout:  defaultPunchTimeout,
+		peerWait: defaultPeerWait,
+	}
+	for _, o := range opts {
+		o(&c)
+	}
+
+	choice, err := localIPv4(targetIface)
+	if err != nil {
+		return PunchResult{}, err
+	}
+	client, err := stun.NewPacketClient(choice.Addr.IP(), stun.WithLocalPort(c.lport), stun.WithTransport(c.transport))
+	if err != nil {
+		return PunchResult{}, err
+	}
+	defer client.Close()
+
+	if c.session == "" {
+		c.session = pairSession(id, peer)
+	}
+	result := PunchResult{Session: c.session, ID: id, Peer: peer}
+	result.Local = append(result.Local, rendezvous.Candidate{Type: "host", Addr: client.LocalAddr().String()})
+	candidates := defaultServers
+	if c.server != "" {
+		candidates = []string{c.server}
+	}
+	server, err := firstServer(candidates, "udp4")
+	if err != nil {
+		return result, err
+	}
+	if p, err := probeMapping(client, server); err != nil {
+		logger.Warn(fmt.Sprintf("could not learn server reflexive candidate: %s", err))
+	} else if !sameAddr(p.Mapped, client.LocalAddr()) {
+		result.Local = append(result.Local, rendezvous.Candidate{Type: "srflx", Addr: p.Mapped.String()})
+	}
+
+	rv := rendezvous.NewClient(rendezvousURL)
+	if _, err := rv.Join(c.session, id, result.Local); err != nil {
+		return result, err
+	}
+	logger.Info(fmt.Sprintf("joined session %s as %s, waiting for %s", c.session, id, peer))
+	session, err := rv.WaitPeer(c.session, peer, c.peerWait)
+	if err != nil {
+		return result, err
+	}
+	result.Remote = session.Peers[peer].Candidates
+
+	var targets []punchTarget
+	for _, cand := range result.Remote {
+		addr, err := net.ResolveUDPAddr("udp4", cand.Addr)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("skip candidate %s of %s: %s", cand.Addr, peer, err))
+			continue
+		}
+		targets = append(targets, punchTarget{cand: cand, addr: addr})
+	}
+	if len(targets) == 0 {
+		return result, errNoPeerCandidate
+	}
+
+	at := session.LocalPunchAt()
+	logger.Info(fmt.Sprintf("start punching in %s", time.Until(at).Round(time.Millisecond)))
+	time.Sleep(time.Until(at))
+	punchWith(client, &result, targets, c.timeout)
+	return result, nil
+}
+
+// pairSession derives session ID from peer ids, same for both peers
+func pairSession(id, peer string) string {
+	if id > peer {
+		id, peer = peer, id
+	}
+	return id + "+" + peer
+}
+
+type punchTarget struct {
+	cand rendezvous.Candidate
+	addr *net.UDPAddr
+}
+
+// punchWith sends checks to targets until one succeeds or timeout elapses,
+// then keeps answering the checks of the peer for a grace period
+func punchWith(client *stun.PacketClient, result *PunchResult, targets []punchTarget, timeout time.Duration) {
+	username := []byte(result.Peer + ":" + result.ID)
+	expected := result.ID + ":" + result.Peer
+
+	var mu sync.Mutex
+	sent := map[stun.TransactionID]int{}
+	sentAt := map[stun.TransactionID]time.Time{}
+	done := make(chan struct{})
+
+	start := time.Now()
+	go func() {
+		ticker := time.NewTicker(punchInterval)
+		defer ticker.Stop()
+		for {
+			for i, t := range targets {
+				req := stun.NewMessage(stun.BindingReq)
+				req.Attributes.Add(stun.AttrUsername, username)
+				mu.Lock()
+				sent[req.TransactionID] = i
+				sentAt[req.TransactionID] = time.Now()
+				mu.Unlock()
+				if err := client.Send(req, t.addr); err != nil {
+					logger.Debug(fmt.Sprintf("could not send check to %s: %s", t.addr, err))
+				}
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	defer close(done)
+
+	deadline := start.Add(timeout)
+	for time.Now().Before(deadline) {
+		msg, from, err := client.Receive(punchReceiveInterval)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				logger.Warn(fmt.Sprintf("punch receiver: %s", err))
+				return
+			}
+			continue
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			logger.Debug(fmt.Sprintf("ignore packet from %s, which is not a UDP address", from))
+			continue
+		}
+
+		switch msg.Type {
+		case stun.BindingReq:
+			attr, ok := msg.Attributes.Extract(stun.AttrUsername)
+			if !ok || string(attr.Value) != expected {
+				logger.Debug(fmt.Sprintf("ignore check from %s of another session", addr))
+				continue
+			}
+			if result.FirstFrom == nil {
+				result.FirstFrom = addr
+				result.FirstPacket = time.Since(start)
+			}
+			res := stun.NewMessage(stun.BindingRes)
+			res.TransactionID = msg.TransactionID
+			res.Attributes.Add(stun.AttrXorMappedAddress, stun.XORMappedAddress{Address: addr.IP, Port: uint16(addr.Port)}.Encode(res.TransactionID))
+			if err := client.Send(res, addr); err != nil {
+				logger.Debug(fmt.Sprintf("could not answer check of %s: %s", addr, err))
+			}
+		case stun.BindingRes:
+			mu.Lock()
+			i, ok := sent[msg.TransactionID]
+			at := sentAt[msg.TransactionID]
+			mu.Unlock()
+			if !ok || result.Success {
+				continue
+			}
+			if result.FirstFrom == nil {
+				result.FirstFrom = addr
+				result.FirstPacket = time.Since(start)
+			}
+			xadd := stun.XORMappedAddress{}
+			attr, ok := msg.Attributes.Extract(stun.AttrXorMappedAddress)
+			if !ok || xadd.Parse(attr, msg.TransactionID) != nil {
+				continue
+			}
+			result.Success = true
+			result.RTT = time.Since(at)
+			result.Pair = &CandidatePair{Local: xadd.UDPAddr(), Remote: targets[i].cand}
+			logger.Info(fmt.Sprintf("check succeeded on %s", result.Pair))
+			// the peer may not have received our answer yet
+			deadline = time.Now().Add(punchGracePeriod)
+		}
+	}
+}
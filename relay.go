@@ -0,0 +1,221 @@
+package mynat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/stun"
+	"github.com/ek-170/myroute/pkg/transport"
+)
+
+const (
+	defaultRelayPings = 5
+	relayPingTimeout  = 2 * time.Second
+)
+
+var (
+	errRelayNotEchoed = errors.New("no data came back through the relay")
+	errNoPeerAddress  = errors.New("public address of the peer is unknown, neither XOR-MAPPED-ADDRESS nor Binding-Response was received")
+)
+
+type relayConfig struct {
+	pings     int
+	transport transport.Transport
+}
+
+type RelayOption func(c *relayConfig)
+
+// WithRelayPings sets the number of round trips measured for each relay method
+func WithRelayPings(n int) RelayOption {
+	return func(c *relayConfig) {
+		c.pings = n
+	}
+}
+
+// WithRelayTransport opens sockets of the client and the test peer with t
+// instead of the host network stack
+func WithRelayTransport(t transport.Transport) RelayOption {
+	return func(c *relayConfig) {
+		c.transport = t
+	}
+}
+
+// RelayResult is a result of end-to-end test of TURN server
+type RelayResult struct {
+	Server   string
+	Local    *net.UDPAddr
+	Mapped   *net.UDPAddr // server reflexive address seen by TURN server
+	Relayed  *net.UDPAddr // relayed transport address allocated
+	Lifetime time.Duration
+	// Peer is the address of the test peer seen by the relay
+	Peer *net.UDPAddr
+	// IndicationRTT and ChannelRTT are round trip times of
+	// peer -> relay -> client -> relay -> peer for each method
+	IndicationRTT []time.Duration
+	ChannelRTT    []time.Duration
+	Lost          int
+}
+
+func (r RelayResult) String() string {
+	return fmt.Sprintf("relayed %s for %s, Send/Data indication rtt %s, ChannelData rtt %s, %d lost",
+		r.Relayed, r.Lifetime, rttStats(r.IndicationRTT), rttStats(r.ChannelRTT), r.Lost)
+}
+
+// Detail returns addresses and every round trip time as lines
+func (r RelayResult) Detail() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "  server  %s\n", r.Server)
+	fmt.Fprintf(&b, "  local   %s\n", r.Local)
+	fmt.Fprintf(&b, "  mapped  %s\n", r.Mapped)
+	fmt.Fprintf(&b, "  relayed %s\n", r.Relayed)
+	fmt.Fprintf(&b, "  peer    %s\n", r.Peer)
+	for i, rtt := range r.IndicationRTT {
+		fmt.Fprintf(&b, "  indication#%d %s\n", i+1, rtt)
+	}
+	for i, rtt := range r.ChannelRTT {
+		fmt.Fprintf(&b, "  channel#%d    %s\n", i+1, rtt)
+	}
+	return b.String()
+}
+
+func rttStats(samples []time.Duration) string {
+	if len(samples) == 0 {
+		return "-"
+	}
+	lo, hi, sum := samples[0], samples[0], time.Duration(0)
+	for _, s := range samples {
+		lo = min(lo, s)
+		hi = max(hi, s)
+		sum += s
+	}
+	avg := sum / time.Duration(len(samples))
+	return fmt.Sprintf("min/avg/max %s/%s/%s", lo.Round(time.Microsecond), avg.Round(time.Microsecond), hi.Round(time.Microsecond))
+}
+
+// MeasureRelay allocates a relayed address on TURN server, and measures
+// round trip time through it from a second local socket acting as a peer.
+// the peer sends Binding-Request to the relayed address, the client echoes
+// the relayed data back to the peer, first with Send indication, then with
+// ChannelData after ChannelBind.
+func MeasureRelay(targetIface, server, username, password string, opts ...RelayOption) (RelayResult, error) {
+	c := relayConfig{pings: defaultRelayPings}
+	for _, o := range opts {
+		o(&c)
+	}
+
+	choice, err := localIPv4(targetIface)
+	if err != nil {
+		return RelayResult{}, err
+	}
+	lip := choice.Addr.IP()
+	s, err := resolveServer(server, "udp4")
+	if err != nil {
+		return RelayResult{}, err
+	}
+
+	client, err := stun.NewTURNClient(s.addr, lip, username, password, stun.WithTransport(c.transport))
+	if err != nil {
+		return RelayResult{}, err
+	}
+	defer client.Close()
+	relayed, err := client.Allocate()
+	if err != nil {
+		return RelayResult{}, err
+	}
+	result := RelayResult{
+		Server:   s.name,
+		Local:    client.LocalAddr(),
+		Mapped:   client.MappedAddr(),
+		Relayed:  relayed,
+		Lifetime: client.Lifetime(),
+	}
+
+	peer, err := stun.NewPacketClient(lip, stun.WithTransport(c.transport))
+	if err != nil {
+		return result, err
+	}
+	defer peer.Close()
+	// the relay accepts data only from the IP address permitted
+	var peerIP net.IP
+	if p, err := probeMapping(peer, s); err == nil {
+		peerIP = p.Mapped.IP
+	} else if result.Mapped != nil {
+		peerIP = result.Mapped.IP
+		logger.Warn(fmt.Sprintf("TURN server did not answer Binding-Request, assume peer is mapped to %s: %s", peerIP, err))
+	} else {
+		return result, fmt.Errorf("%w: %s", errNoPeerAddress, err)
+	}
+	if err := client.CreatePermission(peerIP); err != nil {
+		return result, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	seen := make(chan *net.UDPAddr, 1)
+	go echoRelay(client, done, seen)
+
+	result.IndicationRTT = pingRelay(peer, relayed, c.pings, &result.Lost)
+	select {
+	case result.Peer = <-seen:
+	default:
+		return result, errRelayNotEchoed
+	}
+
+	if _, err := client.ChannelBind(result.Peer); err != nil {
+		return result, err
+	}
+	result.ChannelRTT = pingRelay(peer, relayed, c.pings, &result.Lost)
+	return result, nil
+}
+
+// echoRelay sends every data relayed from a peer back to it until done is closed.
+// the first peer seen is reported to seen.
+func echoRelay(client *stun.TURNClient, done <-chan struct{}, seen chan<- *net.UDPAddr) {
+	reported := false
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		d, err := client.Receive(100 * time.Millisecond)
+		if err != nil {
+			continue
+		}
+		if !reported {
+			seen <- d.Peer
+			reported = true
+		}
+		if err := client.WriteTo(d.Data, d.Peer); err != nil {
+			logger.Warn(fmt.Sprintf("could not echo back to %s: %s", d.Peer, err))
+		}
+	}
+}
+
+// pingRelay sends Binding-Request from peer to relayed count times,
+// and returns round trip times of the ones came back
+func pingRelay(peer *stun.PacketClient, relayed *net.UDPAddr, count int, lost *int) []time.Duration {
+	var rtts []time.Duration
+	for i := 0; i < count; i++ {
+		req := stun.NewMessage(stun.BindingReq)
+		start := time.Now()
+		if err := peer.Send(req, relayed); err != nil {
+			logger.Warn(fmt.Sprintf("could not send to relayed address: %s", err))
+			*lost++
+			continue
+		}
+		received, err := receiveTransaction(peer, req.TransactionID, relayPingTimeout)
+		if err != nil || !received {
+			*lost++
+			continue
+		}
+		rtt := time.Since(start)
+		logger.Debug(fmt.Sprintf("ping#%d through relay: %s", i+1, rtt))
+		rtts = append(rtts, rtt)
+	}
+	return rtts
+}
@@ -0,0 +1,97 @@
+package mynat
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+var probeNames = []string{"Test I  ", "Test II ", "Test III"}
+
+// Report writes probes and results of diagnosis in human readable form
+func (r *DiagnosisResult) Report(w io.Writer) {
+	fmt.Fprintln(w, "--- Probes ---")
+	if r.Reason != "" {
+		fmt.Fprintf(w, "Local Address: %s (%s)\n", r.Local.IP, r.Reason)
+	}
+	for i, p := range r.Probes {
+		fmt.Fprintf(w, "%s: %s\n", probeNames[i], p)
+	}
+	if r.Pooling != nil {
+		fmt.Fprintln(w, "IP Pooling:")
+		fmt.Fprint(w, r.Pooling.Detail())
+	}
+	if r.PortAllocation != nil {
+		fmt.Fprintln(w, "Port Allocation:")
+		fmt.Fprint(w, r.PortAllocation.Detail())
+	}
+	if r.CGN != nil {
+		fmt.Fprintln(w, "Address Spaces:")
+		fmt.Fprint(w, r.CGN.Detail())
+	}
+	if r.Gateway != nil {
+		fmt.Fprintln(w, "Port Mapping Protocols:")
+		fmt.Fprint(w, r.Gateway.Detail())
+	}
+	fmt.Fprintf(w, "\n")
+
+	fmt.Fprintln(w, "--- Results ---")
+	if r.Mapping == MappingNone {
+		fmt.Fprintln(w, "There is no NAT")
+		return
+	}
+	fmt.Fprintf(w, "NAT Mapping Type: %s\n", r.Mapping)
+	if r.Filtering != FilteringUnknown {
+		fmt.Fprintf(w, "NAT Filtering Type: %s\n", r.Filtering)
+	} else {
+		fmt.Fprintln(w, "NAT Filtering Type: could not determine")
+	}
+	if r.Hairpin != nil {
+		fmt.Fprintf(w, "NAT Hairpinning: %s\n", r.Hairpin)
+	}
+	if r.Pooling != nil {
+		fmt.Fprintf(w, "NAT IP Pooling: %s\n", r.Pooling)
+	}
+	if r.CGN != nil {
+		fmt.Fprintf(w, "Carrier-grade NAT: %s\n", r.CGN)
+	}
+	if r.Gateway != nil {
+		fmt.Fprintf(w, "Port Mapping Protocols: %s\n", r.Gateway)
+	}
+	if r.PortAllocation != nil {
+		fmt.Fprintf(w, "NAT Port Allocation: %s\n", r.PortAllocation)
+	}
+	if r.PortPrediction != nil {
+		fmt.Fprintf(w, "NAT Port Prediction: %s\n", r.PortPrediction)
+		fmt.Fprintf(w, "Suggested Traversal: %s\n", r.PortPrediction.Recommendation())
+	}
+}
+
+// ReportAll writes report of each local address, followed by a summary table
+func ReportAll(w io.Writer, results []*DiagnosisResult) {
+	for _, r := range results {
+		fmt.Fprintf(w, "=== %s %s ===\n", r.Iface, r.Local.IP)
+		if r.Error != "" {
+			fmt.Fprintf(w, "error has occured: %s\n\n", r.Error)
+			continue
+		}
+		r.Report(w)
+		fmt.Fprintf(w, "\n")
+	}
+
+	fmt.Fprintln(w, "--- Summary ---")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tLOCAL\tMAPPED\tMAPPING\tHAIRPIN")
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(tw, "%s\t%s\t-\terror: %s\t-\n", r.Iface, r.Local.IP, r.Error)
+			continue
+		}
+		hairpin := "-"
+		if r.Hairpin != nil {
+			hairpin = fmt.Sprintf("%t", r.Hairpin.Supported)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Iface, r.Local, r.Probes[0].Mapped, r.Mapping, hairpin)
+	}
+	tw.Flush()
+}
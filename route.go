@@ -0,0 +1,96 @@
+package mynat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ek-170/myroute/pkg/logger"
+)
+
+var (
+	ErrNoDefaultRoute = errors.New("could not detect default route")
+)
+
+// Route is the default route of the host
+type Route struct {
+	Iface   string
+	Gateway net.IP // nil if unknown
+}
+
+// DefaultRoute detects the interface and gateway of the default route.
+// the routing table of OS is read if supported, otherwise the interface is
+// detected from the source address chosen for a public destination.
+func DefaultRoute() (Route, error) {
+	r, err := defaultRouteFromTable()
+	if err == nil {
+		logger.Debug(fmt.Sprintf("default route from routing table: %s via %s", r.Iface, r.Gateway))
+		return r, nil
+	}
+	logger.Debug(fmt.Sprintf("could not read routing table: %s", err))
+
+	r, err = defaultRouteBySource()
+	if err != nil {
+		return Route{}, fmt.Errorf("%w: %w", ErrNoDefaultRoute, err)
+	}
+	logger.Debug(fmt.Sprintf("default route by source address: %s", r.Iface))
+	return r, nil
+}
+
+// defaultRouteBySource asks OS which source address is used for a public
+// destination. connecting UDP socket sends no packet.
+func defaultRouteBySource() (Route, error) {
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return Route{}, err
+	}
+	defer conn.Close()
+	src := conn.LocalAddr().(*net.UDPAddr).IP
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return Route{}, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(src) {
+				return Route{Iface: iface.Name}, nil
+			}
+		}
+	}
+	return Route{}, fmt.Errorf("no interface has source address %s", src)
+}
+
+// resolveIface returns targetIface, or the interface of default route if it is empty
+func resolveIface(targetIface string) (string, error) {
+	if targetIface != "" {
+		return targetIface, nil
+	}
+	r, err := DefaultRoute()
+	if err != nil {
+		return "", err
+	}
+	logger.Info(fmt.Sprintf("using interface of default route: %s", r.Iface))
+	return r.Iface, nil
+}
+
+// availableIfaces returns names of interfaces which are up and not loopback
+func availableIfaces() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var names []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		names = append(names, iface.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package mynat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	procNetRoute = "/proc/net/route"
+
+	rtfUp      = 0x0001
+	rtfGateway = 0x0002
+)
+
+// defaultRouteFromTable reads IPv4 routing table from /proc/net/route, and
+// returns the default route which has the lowest metric
+func defaultRouteFromTable() (Route, error) {
+	f, err := os.Open(procNetRoute)
+	if err != nil {
+		return Route{}, err
+	}
+	defer f.Close()
+
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+	var best Route
+	bestMetric := -1
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // skip header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		if fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&rtfUp == 0 {
+			continue
+		}
+		metric, err := strconv.Atoi(fields[6])
+		if err != nil {
+			continue
+		}
+		if bestMetric >= 0 && metric >= bestMetric {
+			continue
+		}
+		r := Route{Iface: fields[0]}
+		if flags&rtfGateway != 0 {
+			gw, err := parseProcIPv4(fields[2])
+			if err != nil {
+				continue
+			}
+			r.Gateway = gw
+		}
+		best = r
+		bestMetric = metric
+	}
+	if err := scanner.Err(); err != nil {
+		return Route{}, err
+	}
+	if bestMetric < 0 {
+		return Route{}, errors.New("no default route in " + procNetRoute)
+	}
+	return best, nil
+}
+
+// parseProcIPv4 parses IPv4 address of /proc/net/route, in host byte order hex
+func parseProcIPv4(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 4 {
+		return nil, errors.New("invalid address length")
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.NativeEndian.Uint32(b))
+	return ip, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package mynat
+
+import "errors"
+
+// defaultRouteFromTable is only implemented for Linux,
+// DefaultRoute falls back to the source address detection
+func defaultRouteFromTable() (Route, error) {
+	return Route{}, errors.New("reading routing table is not supported on this platform")
+}
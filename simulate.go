@@ -0,0 +1,414 @@
+package mynat
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/natsim"
+	"github.com/ek-170/myroute/pkg/rendezvous"
+	"github.com/ek-170/myroute/pkg/stun"
+	"github.com/ek-170/myroute/pkg/turn"
+)
+
+// STUN servers on the simulated network, Y also listens on an alternate port for Test III
+var simServers = []string{"198.51.100.1:3478", "198.51.100.2:3478", "198.51.100.3:3478"}
+
+// simSkipped is the result of a test diagnosis skipped on failure
+const simSkipped = "skipped"
+
+// simOutsider is a host on the simulated network sending unsolicited packets for filtering test
+var simOutsider = net.IPv4(198, 51, 100, 100)
+
+const (
+	simAlternateServer = "198.51.100.2:19302"
+
+	simPunchTimeout       = 3 * time.Second
+	simLifetimeInitial    = 500 * time.Millisecond
+	simLifetimeResolution = 250 * time.Millisecond
+)
+
+// modes of SimulationCase
+const (
+	SimulateMapping        = "mapping"
+	SimulateHairpin        = "hairpin"
+	SimulatePortAllocation = "port allocation"
+	SimulatePooling        = "pooling"
+	SimulateLifetime       = "lifetime"
+	SimulatePair           = "pair"
+	SimulateFiltering      = "filtering"
+)
+
+// SimulationCase is a check of one diagnosis mode against a simulated NAT,
+// Expected is derived from the NAT configuration and Got from diagnosis
+type SimulationCase struct {
+	// Profile is a NAT profile name, or "A + B" for pairs
+	Profile  string
+	Mode     string
+	Expected string
+	Got      string
+	Pass     bool
+	Err      error
+}
+
+func (c SimulationCase) String() string {
+	if c.Err != nil {
+		return fmt.Sprintf("%-44s %-16s error: %s", c.Profile, c.Mode, c.Err)
+	}
+	verdict := "ok"
+	if !c.Pass {
+		verdict = "FAIL"
+	}
+	return fmt.Sprintf("%-44s %-16s %-4s expected %s, got %s", c.Profile, c.Mode, verdict, c.Expected, c.Got)
+}
+
+// Simulate runs every diagnosis mode from a host behind each of profiles on
+// an in-process network, and UDP hole punching between hosts behind every pair
+// of profiles. each run has its own network, so that runs are independent.
+// cases are ordered by profile, then pairs follow.
+func Simulate(profiles []natsim.Config) []SimulationCase {
+	results := make([]*DiagnosisResult, len(profiles))
+	cases := make([][]SimulationCase, len(profiles))
+	var wg sync.WaitGroup
+	for i, p := range profiles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], cases[i] = simulateProfile(p)
+		}()
+	}
+	wg.Wait()
+
+	var pairs []SimulationCase
+	var mu sync.Mutex
+	for i := range profiles {
+		for j := i; j < len(profiles); j++ {
+			if results[i] == nil || results[j] == nil {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c := simulatePair(profiles[i], profiles[j], results[i], results[j])
+				mu.Lock()
+				defer mu.Unlock()
+				pairs = append(pairs, c)
+			}()
+		}
+	}
+	wg.Wait()
+
+	var all []SimulationCase
+	for _, c := range cases {
+		all = append(all, c...)
+	}
+	// keep the order of the matrix regardless of completion order
+	for i := range profiles {
+		for j := i; j < len(profiles); j++ {
+			name := pairName(profiles[i], profiles[j])
+			for _, c := range pairs {
+				if c.Profile == name {
+					all = append(all, c)
+				}
+			}
+		}
+	}
+	return all
+}
+
+// simNetwork is a simulated network with STUN servers
+type simNetwork struct {
+	*natsim.Network
+	servers []*turn.Server
+}
+
+func newSimNetwork() (*simNetwork, error) {
+	n := &simNetwork{Network: natsim.NewNetwork()}
+	for _, s := range append(simServers, simAlternateServer) {
+		addr, err := net.ResolveUDPAddr("udp4", s)
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		conn, err := n.ListenPacket("udp4", addr)
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		server := turn.NewServer(conn)
+		go server.Serve()
+		n.servers = append(n.servers, server)
+	}
+	return n, nil
+}
+
+func (n *simNetwork) Close() {
+	for _, s := range n.servers {
+		s.Close()
+	}
+}
+
+// addNAT attaches a NAT of cfg, and returns it with the address of the host behind it.
+// slot keeps addresses of NATs on the same network distinct.
+func (n *simNetwork) addNAT(cfg natsim.Config, slot int) (*natsim.NAT, net.IP, error) {
+	externals := []net.IP{net.IPv4(203, 0, 113, byte(10*slot+1))}
+	if cfg.ArbitraryPooling {
+		externals = append(externals, net.IPv4(203, 0, 113, byte(10*slot+2)))
+	}
+	nat, err := n.AddNAT(cfg, externals...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nat, net.IPv4(10, 0, byte(slot), 2), nil
+}
+
+// simulateProfile diagnoses a host behind a NAT of cfg, and compares results with cfg
+func simulateProfile(cfg natsim.Config) (*DiagnosisResult, []SimulationCase) {
+	fail := func(err error) []SimulationCase {
+		return []SimulationCase{{Profile: cfg.Name, Mode: SimulateMapping, Err: err}}
+	}
+	n, err := newSimNetwork()
+	if err != nil {
+		return nil, fail(err)
+	}
+	defer n.Close()
+	nat, lip, err := n.addNAT(cfg, 0)
+	if err != nil {
+		return nil, fail(err)
+	}
+
+	res, err := Diagnose(cfg.Name, lip, WithSTUNServers(simServers...), WithTransport(nat),
+		WithFilteringProbe(n.Network, simOutsider), WithFilteringPortProbe(n.Network))
+	if err != nil {
+		return nil, fail(err)
+	}
+
+	cases := []SimulationCase{
+		check(cfg.Name, SimulateMapping, string(simMapping(cfg.Mapping)), string(res.Mapping)),
+		check(cfg.Name, SimulateFiltering, string(simFiltering(cfg.Filtering)), string(res.Filtering)),
+		// the hairpin test opens the filter of the receiver toward the sender's mapping,
+		// which is the one the sender hairpins from only under EIM
+		check(cfg.Name, SimulateHairpin, simHairpin(cfg.Hairpin && (cfg.Filtering == natsim.EIF || cfg.Mapping == natsim.EIM), cfg.Mapping == natsim.EIM), simHairpinResult(res.Hairpin)),
+		check(cfg.Name, SimulatePortAllocation, simPortAllocation(cfg.PortAllocation), portAllocationBehavior(res.PortAllocation)),
+		check(cfg.Name, SimulatePooling, simPooling(!cfg.ArbitraryPooling), simPoolingResult(res.Pooling)),
+	}
+	if cfg.BindingTimeout > 0 {
+		cases = append(cases, simulateLifetime(cfg, lip, nat))
+	}
+	return res, cases
+}
+
+// simulateLifetime measures the binding lifetime, which must enclose BindingTimeout
+func simulateLifetime(cfg natsim.Config, lip net.IP, nat *natsim.NAT) SimulationCase {
+	c := SimulationCase{Profile: cfg.Name, Mode: SimulateLifetime, Expected: fmt.Sprintf("binding expires at %s idle", cfg.BindingTimeout)}
+	server, err := resolveServer(simServers[0], "udp4")
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	r, err := measureBindingLifetime(lip, server, lifetimeConfig{
+		initial:    simLifetimeInitial,
+		max:        8 * cfg.BindingTimeout,
+		resolution: simLifetimeResolution,
+		progress:   io.Discard,
+		clientOpts: []stun.ClientOption{stun.WithTransport(nat)},
+	})
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	c.Got = r.String()
+	c.Pass = r.Alive <= cfg.BindingTimeout && cfg.BindingTimeout <= r.Expired
+	return c
+}
+
+// simulatePair punches holes between hosts behind NATs of a and b, and compares
+// the outcome with PredictPair of their diagnosis results.
+// plain punching is expected to succeed only if direct connectivity is predicted.
+func simulatePair(a, b natsim.Config, ra, rb *DiagnosisResult) SimulationCase {
+	c := SimulationCase{Profile: pairName(a, b), Mode: SimulatePair}
+	prediction := PredictPair(simPrediction(ra), simPrediction(rb))
+	c.Expected = simConnectivity(prediction.Connectivity == ConnectivityDirect, string(prediction.Connectivity))
+
+	n, err := newSimNetwork()
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	defer n.Close()
+	server, err := resolveServer(simServers[0], "udp4")
+	if err != nil {
+		c.Err = err
+		return c
+	}
+
+	peers := make([]*simPeer, 2)
+	for i, cfg := range []natsim.Config{a, b} {
+		p, err := newSimPeer(n, cfg, i, server)
+		if err != nil {
+			c.Err = err
+			return c
+		}
+		defer p.client.Close()
+		peers[i] = p
+	}
+	peers[0].result.ID, peers[0].result.Peer = "A", "B"
+	peers[1].result.ID, peers[1].result.Peer = "B", "A"
+
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		other := peers[1-i]
+		p.result.Remote = other.result.Local
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			punchWith(p.client, &p.result, other.targets, simPunchTimeout)
+		}()
+	}
+	wg.Wait()
+
+	success := peers[0].result.Success || peers[1].result.Success
+	c.Got = simConnectivity(success, "no check succeeded")
+	c.Pass = success == (prediction.Connectivity == ConnectivityDirect)
+	return c
+}
+
+type simPeer struct {
+	client  *stun.PacketClient
+	result  PunchResult
+	targets []punchTarget
+}
+
+// newSimPeer binds a socket behind a NAT of cfg, and learns its candidates from server
+func newSimPeer(n *simNetwork, cfg natsim.Config, slot int, server stunServer) (*simPeer, error) {
+	nat, lip, err := n.addNAT(cfg, slot)
+	if err != nil {
+		return nil, err
+	}
+	client, err := stun.NewPacketClient(lip, stun.WithTransport(nat))
+	if err != nil {
+		return nil, err
+	}
+	probe, err := probeMapping(client, server)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	p := &simPeer{client: client}
+	for _, addr := range []struct {
+		typ  string
+		addr *net.UDPAddr
+	}{{"host", client.LocalAddr()}, {"srflx", probe.Mapped}} {
+		cand := rendezvous.Candidate{Type: addr.typ, Addr: addr.addr.String()}
+		p.result.Local = append(p.result.Local, cand)
+		p.targets = append(p.targets, punchTarget{cand: cand, addr: addr.addr})
+	}
+	logger.Debug(fmt.Sprintf("%s peer %s mapped to %s", cfg.Name, client.LocalAddr(), probe.Mapped))
+	return p, nil
+}
+
+func pairName(a, b natsim.Config) string {
+	return a.Name + " + " + b.Name
+}
+
+func check(profile, mode, expected, got string) SimulationCase {
+	return SimulationCase{Profile: profile, Mode: mode, Expected: expected, Got: got, Pass: expected == got}
+}
+
+// simPrediction returns r without probes, since the pair is simulated
+// behind distinct NATs even for the same profile
+func simPrediction(r *DiagnosisResult) *DiagnosisResult {
+	p := *r
+	p.Probes = nil
+	return &p
+}
+
+func simMapping(m natsim.Mapping) MappingType {
+	switch m {
+	case natsim.EIM:
+		return MappingEIM
+	case natsim.ADM:
+		return MappingADM
+	default:
+		return MappingAPDM
+	}
+}
+
+func simFiltering(f natsim.Filtering) FilteringType {
+	switch f {
+	case natsim.EIF:
+		return FilteringEIF
+	case natsim.ADF:
+		return FilteringADF
+	default:
+		return FilteringAPDF
+	}
+}
+
+func simHairpin(supported, external bool) string {
+	switch {
+	case !supported:
+		return "not supported"
+	case external:
+		return "supported with external source"
+	default:
+		return "supported with other source"
+	}
+}
+
+func simHairpinResult(r *HairpinResult) string {
+	if r == nil {
+		return simSkipped
+	}
+	return simHairpin(r.Supported, r.External())
+}
+
+func simPortAllocation(a natsim.PortAllocation) string {
+	switch a {
+	case natsim.PortPreserve:
+		return "port preservation"
+	case natsim.PortSequential:
+		return "contiguous"
+	default:
+		return "randomized"
+	}
+}
+
+func portAllocationBehavior(pa *PortAllocation) string {
+	switch {
+	case pa == nil:
+		return simSkipped
+	case pa.PortPreservation():
+		return "port preservation"
+	case pa.Contiguous():
+		return "contiguous"
+	case pa.Randomized():
+		return "randomized"
+	default:
+		return "unknown"
+	}
+}
+
+func simPooling(paired bool) string {
+	if paired {
+		return "paired"
+	}
+	return "arbitrary"
+}
+
+func simPoolingResult(r *PoolingResult) string {
+	if r == nil {
+		return simSkipped
+	}
+	return simPooling(r.Paired())
+}
+
+func simConnectivity(direct bool, otherwise string) string {
+	if direct {
+		return "direct"
+	}
+	return "no direct path (" + otherwise + ")"
+}
@@ -0,0 +1,25 @@
+package mynat
+
+import (
+	"testing"
+
+	"github.com/ek-170/myroute/pkg/natsim"
+)
+
+// TestSimulate runs every diagnosis mode against every NAT profile,
+// and hole punching between every pair of them
+func TestSimulate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulation takes a while")
+	}
+	for _, c := range Simulate(natsim.Profiles()) {
+		t.Run(c.Profile+"/"+c.Mode, func(t *testing.T) {
+			if c.Err != nil {
+				t.Fatalf("error: %s", c.Err)
+			}
+			if !c.Pass {
+				t.Errorf("expected %s, got %s", c.Expected, c.Got)
+			}
+		})
+	}
+}
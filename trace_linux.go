@@ -0,0 +1,169 @@
+//go:build linux
+
+package mynat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/ek-170/myroute/pkg/logger"
+	"github.com/ek-170/myroute/pkg/stun"
+)
+
+const (
+	traceWait = time.Second
+
+	// struct sock_extended_err in linux/errqueue.h
+	soEEOriginICMP       = 2
+	sockExtendedErrBytes = 16
+	icmpDestUnreachable  = 3
+	icmpTimeExceeded     = 11
+)
+
+type traceReply int
+
+const (
+	traceNoReply traceReply = iota
+	traceResponse
+	traceTimeExceeded
+	traceUnreachable
+)
+
+// traceHops sends Binding-Request to raddr with TTL from 1 to maxHops, and
+// collects routers from ICMP errors which IP_RECVERR delivers to the UDP
+// socket, so no privilege for raw socket is needed.
+// it stops when the STUN server answers, and reports whether it was reached.
+func traceHops(lip net.IP, raddr *net.UDPAddr, maxHops int) ([]Hop, bool, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: lip})
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := setSockoptInt(raw, syscall.SOL_IP, syscall.IP_RECVERR, 1); err != nil {
+		return nil, false, err
+	}
+
+	hops := make([]Hop, 0, maxHops)
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if err := setSockoptInt(raw, syscall.SOL_IP, syscall.IP_TTL, ttl); err != nil {
+			return nil, false, err
+		}
+		req, err := stun.NewMessage(stun.BindingReq).Encode()
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := conn.WriteToUDP(req, raddr); err != nil {
+			return nil, false, err
+		}
+
+		reply, addr, err := waitTraceReply(conn, raw)
+		if err != nil {
+			return nil, false, err
+		}
+		logger.Debug(fmt.Sprintf("ttl %d: reply %d from %s", ttl, reply, addr))
+		switch reply {
+		case traceResponse:
+			return hops, true, nil
+		case traceUnreachable:
+			// the server host itself answered with port unreachable
+			return hops, addr.Equal(raddr.IP), nil
+		}
+		hops = append(hops, Hop{TTL: ttl, Addr: addr})
+	}
+	return hops, false, nil
+}
+
+// waitTraceReply waits for either STUN response or ICMP error until traceWait elapses
+func waitTraceReply(conn *net.UDPConn, raw syscall.RawConn) (traceReply, net.IP, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(traceWait)); err != nil {
+		return traceNoReply, nil, err
+	}
+
+	buf := make([]byte, 1500)
+	oob := make([]byte, 512)
+	for {
+		reply := traceNoReply
+		var addr net.IP
+		var rerr error
+		err := raw.Read(func(fd uintptr) bool {
+			_, oobn, _, _, err := syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if err == nil {
+				reply, addr, rerr = parseICMPError(oob[:oobn])
+				return true
+			}
+			n, from, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_DONTWAIT)
+			switch {
+			case err == nil:
+				if n >= stun.HeaderByte {
+					reply = traceResponse
+					if sa, ok := from.(*syscall.SockaddrInet4); ok {
+						addr = net.IP(sa.Addr[:])
+					}
+				}
+				return true
+			case errors.Is(err, syscall.EAGAIN):
+				return false
+			default:
+				// pending ICMP error is reported once by recvfrom,
+				// the detail stays in the error queue
+				return true
+			}
+		})
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return traceNoReply, nil, nil
+			}
+			return traceNoReply, nil, err
+		}
+		if rerr != nil {
+			return traceNoReply, nil, rerr
+		}
+		if reply != traceNoReply {
+			return reply, addr, nil
+		}
+	}
+}
+
+// parseICMPError extracts ICMP type and offender address from IP_RECVERR control message
+func parseICMPError(oob []byte) (traceReply, net.IP, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return traceNoReply, nil, err
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_IP || m.Header.Type != syscall.IP_RECVERR {
+			continue
+		}
+		// sock_extended_err is followed by sockaddr_in of the offender
+		if len(m.Data) < sockExtendedErrBytes+8 || m.Data[4] != soEEOriginICMP {
+			continue
+		}
+		offender := net.IP(append([]byte(nil), m.Data[sockExtendedErrBytes+4:sockExtendedErrBytes+8]...))
+		switch m.Data[5] {
+		case icmpTimeExceeded:
+			return traceTimeExceeded, offender, nil
+		case icmpDestUnreachable:
+			return traceUnreachable, offender, nil
+		}
+	}
+	return traceNoReply, nil, nil
+}
+
+func setSockoptInt(raw syscall.RawConn, level, opt, value int) error {
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, value)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
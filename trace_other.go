@@ -0,0 +1,17 @@
+//go:build !linux
+
+package mynat
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	errTraceNotSupported = errors.New("TTL-limited probe is not supported on this platform")
+)
+
+// traceHops needs ICMP errors delivered to UDP socket, which is only implemented for Linux
+func traceHops(lip net.IP, raddr *net.UDPAddr, maxHops int) ([]Hop, bool, error) {
+	return nil, false, errTraceNotSupported
+}